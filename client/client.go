@@ -0,0 +1,465 @@
+// Package client is the Go client of the key-value server. It speaks the
+// binary protocol, so keys and values may contain arbitrary bytes.
+//
+//	c := client.New("localhost:8080")
+//	defer c.Close()
+//	err := c.Set(ctx, "greeting", []byte("hello world"))
+//	value, err := c.Get(ctx, "greeting")
+//
+// A Client is safe for concurrent use. Concurrent calls share a bounded
+// pool of connections, and calls on the same connection are pipelined:
+// a request is sent without waiting for the replies to earlier ones.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+const (
+	defaultPoolSize       = 4
+	defaultDialTimeout    = 5 * time.Second
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 50 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+)
+
+type Client struct {
+	addr           string
+	poolSize       int
+	dialTimeout    time.Duration
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	slots  []*slot
+	closed atomic.Bool
+}
+
+type Option func(*Client)
+
+// WithPoolSize bounds the number of connections, 4 by default.
+func WithPoolSize(size int) Option {
+	return func(c *Client) {
+		c.poolSize = max(size, 1)
+	}
+}
+
+// WithDialTimeout bounds how long connecting may take, 5s by default.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithRetry configures how idempotent calls are retried after a
+// connection failure: up to maxAttempts attempts in total, waiting
+// initialBackoff before the first retry and doubling the wait up to
+// maxBackoff. The default is 3 attempts starting at 50ms up to 1s.
+// maxAttempts of 1 disables retries.
+func WithRetry(maxAttempts int, initialBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxAttempts = max(maxAttempts, 1)
+		c.initialBackoff = initialBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New creates a client for the server at addr. Connections are opened
+// lazily.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:           addr,
+		poolSize:       defaultPoolSize,
+		dialTimeout:    defaultDialTimeout,
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.slots = make([]*slot, c.poolSize)
+	for i := range c.slots {
+		c.slots[i] = &slot{}
+	}
+	return c
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, true, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Kind {
+	case protocol.KindValue:
+		return reply.Value, nil
+	case protocol.KindNull:
+		return nil, ErrNotFound
+	default:
+		return nil, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+}
+
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, true, "SET", []byte(key), value)
+	return err
+}
+
+// SetWithTTL stores value and makes the key expire after ttl, which is
+// rounded down to milliseconds. A retried call restarts the ttl.
+func (c *Client) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+	_, err := c.do(ctx, true, "SET", []byte(key), value, []byte("PX"), []byte(ms))
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, true, "DEL", []byte(key))
+	return err
+}
+
+// GetVersion returns the value of key together with its version, which
+// changes on every write of the key. It returns ErrNotFound if the key
+// does not exist.
+func (c *Client) GetVersion(ctx context.Context, key string) ([]byte, uint64, error) {
+	reply, err := c.do(ctx, true, "GET", []byte(key), []byte("WITHVERSION"))
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case reply.Kind == protocol.KindNull:
+		return nil, 0, ErrNotFound
+	case reply.Kind != protocol.KindArray || len(reply.Array) != 2 ||
+		reply.Array[0].Kind != protocol.KindValue || reply.Array[1].Kind != protocol.KindInteger:
+		return nil, 0, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	return reply.Array[0].Value, uint64(reply.Array[1].Integer), nil
+}
+
+// SetIfNotExists stores value only if key does not exist and reports
+// whether it did. A ttl of zero means no expiry. It is not retried, since
+// a retry could not tell its own write from someone else's.
+func (c *Client) SetIfNotExists(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	args := [][]byte{[]byte(key), value}
+	if ttl != 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(ttl.Milliseconds(), 10)))
+	}
+	reply, err := c.do(ctx, false, "SET", append(args, []byte("NX"))...)
+	if err != nil {
+		return false, err
+	}
+	return reply.Kind != protocol.KindNull, nil
+}
+
+// CompareAndSwap stores value only if key is still at version, where
+// version 0 means that the key must not exist. A ttl of zero means no
+// expiry. It returns the new version and whether the value was stored.
+// It is not retried.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte, ttl time.Duration) (uint64, bool, error) {
+	args := [][]byte{[]byte(key), strconv.AppendUint(nil, version, 10), value}
+	if ttl != 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(ttl.Milliseconds(), 10)))
+	}
+	reply, err := c.do(ctx, false, "CAS", args...)
+	if err != nil {
+		return 0, false, err
+	}
+	switch reply.Kind {
+	case protocol.KindNull:
+		return 0, false, nil
+	case protocol.KindInteger:
+		return uint64(reply.Integer), true, nil
+	default:
+		return 0, false, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+}
+
+// Incr atomically adds delta to the integer stored at key, treating a
+// missing key as 0, and returns the new value. It is not retried, since
+// a retry could apply the increment twice.
+func (c *Client) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	reply, err := c.do(ctx, false, "INCRBY", []byte(key), strconv.AppendInt(nil, delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	if reply.Kind != protocol.KindInteger {
+		return 0, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	return reply.Integer, nil
+}
+
+// IncrFloat is like Incr for floating point numbers.
+func (c *Client) IncrFloat(ctx context.Context, key string, delta float64) (float64, error) {
+	reply, err := c.do(ctx, false, "INCRBYFLOAT", []byte(key), strconv.AppendFloat(nil, delta, 'g', -1, 64))
+	if err != nil {
+		return 0, err
+	}
+	if reply.Kind != protocol.KindValue {
+		return 0, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	return strconv.ParseFloat(string(reply.Value), 64)
+}
+
+// GetMulti returns the values of keys read at the same point in time,
+// nil for missing keys.
+func (c *Client) GetMulti(ctx context.Context, keys []string) ([][]byte, error) {
+	reply, err := c.do(ctx, true, "MGET", stringsToArgs(keys)...)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Kind != protocol.KindArray || len(reply.Array) != len(keys) {
+		return nil, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	values := make([][]byte, len(keys))
+	for i, item := range reply.Array {
+		switch item.Kind {
+		case protocol.KindValue:
+			values[i] = item.Value
+		case protocol.KindNull:
+		default:
+			return nil, &unexpectedReply{kind: byte(item.Kind)}
+		}
+	}
+	return values, nil
+}
+
+// SetMulti stores values[i] under keys[i] atomically.
+func (c *Client) SetMulti(ctx context.Context, keys []string, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.New("kv: keys and values differ in length")
+	}
+	args := make([][]byte, 0, 2*len(keys))
+	for i, key := range keys {
+		args = append(args, []byte(key), values[i])
+	}
+	_, err := c.do(ctx, true, "MSET", args...)
+	return err
+}
+
+// DeleteMulti deletes keys atomically and returns how many of them
+// existed. After a retry the count may miss keys deleted by the first
+// attempt.
+func (c *Client) DeleteMulti(ctx context.Context, keys []string) (int, error) {
+	reply, err := c.do(ctx, true, "MDEL", stringsToArgs(keys)...)
+	if err != nil {
+		return 0, err
+	}
+	if reply.Kind != protocol.KindInteger {
+		return 0, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	return int(reply.Integer), nil
+}
+
+// Scan returns the keys matching pattern among the next count keys after
+// cursor, and the cursor to continue from. A walk starts with cursor "0"
+// and is complete once "0" is returned. An empty pattern matches any key
+// and a count <= 0 uses the server default.
+func (c *Client) Scan(ctx context.Context, cursor, pattern string, count int) (string, []string, error) {
+	args := [][]byte{[]byte(cursor)}
+	if pattern != "" {
+		args = append(args, []byte("MATCH"), []byte(pattern))
+	}
+	if count > 0 {
+		args = append(args, []byte("COUNT"), []byte(strconv.Itoa(count)))
+	}
+	reply, err := c.do(ctx, true, "SCAN", args...)
+	if err != nil {
+		return "", nil, err
+	}
+	if reply.Kind != protocol.KindArray || len(reply.Array) != 2 ||
+		reply.Array[0].Kind != protocol.KindValue || reply.Array[1].Kind != protocol.KindArray {
+		return "", nil, &unexpectedReply{kind: byte(reply.Kind)}
+	}
+	keys := make([]string, len(reply.Array[1].Array))
+	for i, item := range reply.Array[1].Array {
+		if item.Kind != protocol.KindValue {
+			return "", nil, &unexpectedReply{kind: byte(item.Kind)}
+		}
+		keys[i] = string(item.Value)
+	}
+	return string(reply.Array[0].Value), keys, nil
+}
+
+func stringsToArgs(strs []string) [][]byte {
+	args := make([][]byte, len(strs))
+	for i, s := range strs {
+		args[i] = []byte(s)
+	}
+	return args
+}
+
+// Status is a status reply such as OK.
+type Status string
+
+// Do sends an arbitrary command, given as its name followed by its
+// arguments. The reply is a Status, a []byte value, nil for NULL, an int64
+// or a []any array of these. An error reply is returned as a
+// *ServerError. Do is not retried, since the command may not be
+// idempotent.
+func (c *Client) Do(ctx context.Context, args ...[]byte) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("kv: empty command")
+	}
+	reply, err := c.do(ctx, false, string(args[0]), args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return convertReply(reply), nil
+}
+
+func convertReply(r protocol.Reply) any {
+	switch r.Kind {
+	case protocol.KindStatus:
+		return Status(r.Str)
+	case protocol.KindValue:
+		return r.Value
+	case protocol.KindInteger:
+		return r.Integer
+	case protocol.KindArray:
+		items := make([]any, len(r.Array))
+		for i, item := range r.Array {
+			items[i] = convertReply(item)
+		}
+		return items
+	case protocol.KindError:
+		return &ServerError{Message: r.Str}
+	default:
+		return nil
+	}
+}
+
+// Close closes all connections. Calls in flight fail.
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	for _, s := range c.slots {
+		s.mu.Lock()
+		if cn := s.conn.Load(); cn != nil {
+			cn.close()
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// do sends a command and returns its reply, turning error replies into
+// a *ServerError. Idempotent commands are retried after connection
+// failures, since it is unknown whether the server executed them.
+func (c *Client) do(ctx context.Context, idempotent bool, cmd string, args ...[]byte) (protocol.Reply, error) {
+	request := append([][]byte{[]byte(cmd)}, args...)
+	attempts := 1
+	if idempotent {
+		attempts = c.maxAttempts
+	}
+
+	backoff := c.initialBackoff
+	for attempt := 1; ; attempt++ {
+		reply, err := c.roundTrip(ctx, request)
+		if err == nil {
+			if reply.Kind == protocol.KindError {
+				return reply, &ServerError{Message: reply.Str}
+			}
+			return reply, nil
+		}
+		if attempt >= attempts || !isConnError(err) {
+			return reply, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return reply, err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, request [][]byte) (protocol.Reply, error) {
+	cn, err := c.conn(ctx)
+	if err != nil {
+		return protocol.Reply{}, err
+	}
+	return cn.roundTrip(ctx, request)
+}
+
+// conn picks an idle connection if there is one, then an empty slot to
+// open a new connection in, and the least loaded connection otherwise.
+func (c *Client) conn(ctx context.Context) (*conn, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	var best, empty *slot
+	bestLoad := 0
+	for _, s := range c.slots {
+		cn := s.conn.Load()
+		load := -1
+		if cn != nil {
+			load = cn.load()
+		}
+		switch {
+		case load == 0:
+			return cn, nil
+		case load < 0:
+			if empty == nil {
+				empty = s
+			}
+		case best == nil || load < bestLoad:
+			best, bestLoad = s, load
+		}
+	}
+	if empty != nil {
+		return empty.open(ctx, c)
+	}
+	return best.open(ctx, c)
+}
+
+// slot holds one connection of the pool.
+type slot struct {
+	// mu is held while the connection is opened, so that callers picking
+	// the same slot wait for it instead of opening more connections.
+	mu   sync.Mutex
+	conn atomic.Pointer[conn]
+}
+
+// open returns the connection of the slot, opening a new one if there is
+// none or it is broken.
+func (s *slot) open(ctx context.Context, c *Client) (*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cn := s.conn.Load(); cn != nil && cn.load() >= 0 {
+		return cn, nil
+	}
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	cn, err := dial(ctx, c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.conn.Store(cn)
+	return cn, nil
+}
+
+// isConnError reports whether err means the connection failed, rather
+// than the server rejecting the request or the caller giving up.
+func isConnError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errConnClosed)
+}
@@ -0,0 +1,317 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/server"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// countingListener counts accepted connections and closes the first
+// drop of them right away.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+	drop     int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.accepted.Add(1) <= l.drop {
+		conn.Close()
+	}
+	return conn, nil
+}
+
+func startServer(t *testing.T, drop int32) (string, *countingListener) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	counting := &countingListener{Listener: listener, drop: drop}
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	srv := server.NewServer(listener.Addr().String(), store)
+	go srv.Serve(t.Context(), counting)
+	return listener.Addr().String(), counting
+}
+
+func TestClientGetSetDelete(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	key := "key with spaces"
+	value := []byte("hello\nworld\x00")
+	if err := c.Set(ctx, key, value); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := c.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(value) {
+		t.Fatalf("expected %q, got %q", value, got)
+	}
+
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	if err := c.SetWithTTL(ctx, "ttl", value, 20*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := c.Get(ctx, "ttl"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected key to expire, got %v", err)
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+
+	err := c.SetWithTTL(t.Context(), "key", []byte("value"), 0)
+	if !errors.Is(err, ErrInvalidExpire) {
+		t.Fatalf("expected %v, got %v", ErrInvalidExpire, err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Message != "invalid expire time" {
+		t.Fatalf("expected server error, got %v", err)
+	}
+}
+
+func TestClientPoolAndPipelining(t *testing.T) {
+	addr, listener := startServer(t, 0)
+	c := New(addr, WithPoolSize(2))
+	defer c.Close()
+	ctx := t.Context()
+
+	workers := 50
+	wg := &sync.WaitGroup{}
+	errCh := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("key_%d", i)
+			for j := range 20 {
+				value := fmt.Sprintf("value_%d_%d", i, j)
+				if err := c.Set(ctx, key, []byte(value)); err != nil {
+					errCh <- err
+					return
+				}
+				got, err := c.Get(ctx, key)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if string(got) != value {
+					errCh <- fmt.Errorf("expected %q, got %q", value, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if accepted := listener.accepted.Load(); accepted > 2 {
+		t.Fatalf("expected at most 2 connections, got %d", accepted)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	addr, _ := startServer(t, 2)
+
+	c := New(addr, WithPoolSize(1), WithRetry(1, 0, 0))
+	if err := c.Set(t.Context(), "key", []byte("value")); err == nil {
+		t.Fatalf("expected an error without retries")
+	}
+	c.Close()
+
+	c = New(addr, WithPoolSize(1), WithRetry(3, time.Millisecond, 10*time.Millisecond))
+	defer c.Close()
+	if err := c.Set(t.Context(), "key", []byte("value")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := c.Get(ctx, "key"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	c.Close()
+	if _, err := c.Get(t.Context(), "key"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestClientMulti(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	if err := c.SetMulti(ctx, []string{"a", "b"}, [][]byte{[]byte("1"), []byte("2 2")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values, err := c.GetMulti(ctx, []string{"a", "missing", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(values, [][]byte{[]byte("1"), nil, []byte("2 2")}) {
+		t.Fatalf("unexpected values %q", values)
+	}
+	deleted, err := c.DeleteMulti(ctx, []string{"a", "missing"})
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 deleted key, got %d, %v", deleted, err)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	for i := range 5 {
+		if err := c.Set(ctx, fmt.Sprintf("user:%d", i), []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	c.Set(ctx, "order:1", []byte("x"))
+
+	var keys []string
+	cursor := "0"
+	for {
+		next, page, err := c.Scan(ctx, cursor, "user:*", 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keys = append(keys, page...)
+		if cursor = next; cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(keys, []string{"user:0", "user:1", "user:2", "user:3", "user:4"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestClientCompareAndSwap(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	ok, err := c.SetIfNotExists(ctx, "lock", []byte("a"), time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("expected lock to be taken, got %v, %v", ok, err)
+	}
+	if ok, _ := c.SetIfNotExists(ctx, "lock", []byte("b"), 0); ok {
+		t.Fatalf("expected lock to be held")
+	}
+
+	value, version, err := c.GetVersion(ctx, "lock")
+	if err != nil || string(value) != "a" || version == 0 {
+		t.Fatalf("unexpected GetVersion result %q, %d, %v", value, version, err)
+	}
+	if _, ok, _ := c.CompareAndSwap(ctx, "lock", version+1, []byte("b"), 0); ok {
+		t.Fatalf("expected CAS with a wrong version to fail")
+	}
+	next, ok, err := c.CompareAndSwap(ctx, "lock", version, []byte("b"), time.Minute)
+	if err != nil || !ok || next <= version {
+		t.Fatalf("expected CAS to succeed, got %d, %v, %v", next, ok, err)
+	}
+	if _, _, err := c.GetVersion(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestClientIncr(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	if n, err := c.Incr(ctx, "n", 5); err != nil || n != 5 {
+		t.Fatalf("expected 5, got %d, %v", n, err)
+	}
+	if n, err := c.Incr(ctx, "n", -7); err != nil || n != -2 {
+		t.Fatalf("expected -2, got %d, %v", n, err)
+	}
+	if f, err := c.IncrFloat(ctx, "f", 1.25); err != nil || f != 1.25 {
+		t.Fatalf("expected 1.25, got %v, %v", f, err)
+	}
+	if _, err := c.Incr(ctx, "f", 1); !errors.Is(err, ErrNotNumber) {
+		t.Fatalf("expected %v, got %v", ErrNotNumber, err)
+	}
+	if _, err := c.Incr(ctx, "n", math.MinInt64); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected %v, got %v", ErrOverflow, err)
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	addr, _ := startServer(t, 0)
+	c := New(addr)
+	defer c.Close()
+	ctx := t.Context()
+
+	tests := []struct {
+		args []string
+		want any
+	}{
+		{[]string{"SET", "a", "1"}, Status("OK")},
+		{[]string{"GET", "a"}, []byte("1")},
+		{[]string{"GET", "b"}, nil},
+		{[]string{"TTL", "a"}, int64(-1)},
+	}
+	for _, tt := range tests {
+		args := make([][]byte, len(tt.args))
+		for i, arg := range tt.args {
+			args[i] = []byte(arg)
+		}
+		got, err := c.Do(ctx, args...)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.args, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%v: expected %#v, got %#v", tt.args, tt.want, got)
+		}
+	}
+
+	if _, err := c.Do(ctx, []byte("NOPE")); !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("expected %v, got %v", ErrInvalidCommand, err)
+	}
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+var errConnClosed = errors.New("kv: connection closed")
+
+type result struct {
+	reply protocol.Reply
+	err   error
+}
+
+// conn is a connection that any number of callers use at once. Requests
+// are written in order, and since the server answers them in order,
+// replies are matched to the waiting callers first in, first out.
+type conn struct {
+	netConn net.Conn
+
+	// writeMu serializes requests, so that the order of pending matches
+	// the order on the wire.
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu      sync.Mutex
+	pending []chan result
+	err     error
+}
+
+func newConn(netConn net.Conn) *conn {
+	c := &conn{
+		netConn: netConn,
+		writer:  bufio.NewWriter(netConn),
+	}
+	go c.readLoop(bufio.NewReader(netConn))
+	return c
+}
+
+// roundTrip sends a request and waits for its reply. If ctx is done
+// first, the request stays in flight and its reply is discarded.
+func (c *conn) roundTrip(ctx context.Context, args [][]byte) (protocol.Reply, error) {
+	ch := make(chan result, 1)
+
+	c.writeMu.Lock()
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		return protocol.Reply{}, c.err
+	}
+	c.pending = append(c.pending, ch)
+	c.mu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	c.netConn.SetWriteDeadline(deadline)
+	err := protocol.WriteRequest(c.writer, args)
+	c.writeMu.Unlock()
+	if err != nil {
+		// A partially written request breaks the framing.
+		c.fail(err)
+	}
+
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return protocol.Reply{}, ctx.Err()
+	}
+}
+
+func (c *conn) readLoop(reader *bufio.Reader) {
+	for {
+		reply, err := protocol.ReadReply(reader)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			c.fail(errors.New("kv: unsolicited reply"))
+			return
+		}
+		ch := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		ch <- result{reply: reply}
+	}
+}
+
+// fail closes the connection and fails every pending request with err.
+func (c *conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.netConn.Close()
+	}
+	for _, ch := range c.pending {
+		ch <- result{err: c.err}
+	}
+	c.pending = nil
+}
+
+func (c *conn) close() {
+	c.fail(errConnClosed)
+}
+
+// load returns the number of requests waiting for a reply, or -1 if the
+// connection is broken.
+func (c *conn) load() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return -1
+	}
+	return len(c.pending)
+}
+
+func dial(ctx context.Context, addr string, timeout time.Duration) (*conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(netConn), nil
+}
@@ -0,0 +1,72 @@
+package client
+
+import "errors"
+
+var (
+	// ErrNotFound is returned by Get for a missing key.
+	ErrNotFound = errors.New("kv: key not found")
+	// ErrClosed is returned by calls on a closed Client.
+	ErrClosed = errors.New("kv: client closed")
+
+	ErrInvalidArguments = errors.New("kv: invalid arguments")
+	ErrInvalidCommand   = errors.New("kv: invalid command")
+	ErrInvalidExpire    = errors.New("kv: invalid expire time")
+	ErrInternal         = errors.New("kv: internal server error")
+
+	// ErrNotNumber is returned by Incr and IncrFloat if the value of the key
+	// is not a number of the expected kind.
+	ErrNotNumber = errors.New("kv: value is not a number")
+	// ErrOverflow is returned by Incr and IncrFloat if the result would
+	// overflow.
+	ErrOverflow = errors.New("kv: increment would overflow")
+	// ErrOutOfMemory is returned by writes the server refuses because it
+	// reached its memory limit.
+	ErrOutOfMemory = errors.New("kv: server out of memory")
+	// ErrWrongType is returned for a key that holds a value of another
+	// type, e.g. by Get on a hash.
+	ErrWrongType = errors.New("kv: key holds a value of another type")
+)
+
+// ServerError is an error reply of the server. Errors with a known
+// message match the corresponding sentinel error with errors.Is.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "kv: server error: " + e.Message
+}
+
+func (e *ServerError) Unwrap() error {
+	switch e.Message {
+	case "invalid arguments":
+		return ErrInvalidArguments
+	case "invalid command":
+		return ErrInvalidCommand
+	case "invalid expire time":
+		return ErrInvalidExpire
+	case "internal error":
+		return ErrInternal
+	case "value is not an integer or out of range", "value is not a valid float":
+		return ErrNotNumber
+	case "increment or decrement would overflow", "increment would produce NaN or Infinity":
+		return ErrOverflow
+	case "OOM command not allowed when used memory > 'maxmemory'":
+		return ErrOutOfMemory
+	case "WRONGTYPE Operation against a key holding the wrong kind of value":
+		return ErrWrongType
+	default:
+		return nil
+	}
+}
+
+// unexpectedReply is returned when the server answers with a reply of an
+// unexpected kind, which means the client and server disagree on the
+// protocol.
+type unexpectedReply struct {
+	kind byte
+}
+
+func (e *unexpectedReply) Error() string {
+	return "kv: unexpected reply kind " + string(e.kind)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+type config struct {
+	addr        string
+	connections int
+	pipeline    int
+	duration    time.Duration
+	keys        int
+	keyPrefix   string
+	mix         mix
+	valueSize   sizeDist
+	prefill     bool
+	seed        uint64
+}
+
+// stats are the results of one connection.
+type stats struct {
+	latency [numOps]histogram
+	misses  uint64 // GETs of missing keys
+	errors  uint64 // error replies
+}
+
+func (s *stats) merge(other *stats) {
+	for op := range s.latency {
+		s.latency[op].merge(&other.latency[op])
+	}
+	s.misses += other.misses
+	s.errors += other.errors
+}
+
+// worker drives the load over one connection of the binary protocol.
+type worker struct {
+	cfg    *config
+	conn   net.Conn
+	reader *bufio.Reader
+	batch  bytes.Buffer
+	writer *bufio.Writer
+	rng    *rand.Rand
+	values []byte
+}
+
+func newWorker(ctx context.Context, cfg *config, id int) (*worker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", cfg.addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &worker{
+		cfg:    cfg,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		rng:    rand.New(rand.NewPCG(cfg.seed, uint64(id))),
+	}
+	// Requests are encoded into batch and sent with a single write, so
+	// that a pipeline goes out together.
+	w.writer = bufio.NewWriter(&w.batch)
+	w.values = make([]byte, cfg.valueSize.max)
+	for i := range w.values {
+		w.values[i] = 'a' + byte(w.rng.IntN(26))
+	}
+	return w, nil
+}
+
+// prefill sets the keys lo..hi-1 of the key space.
+func (w *worker) prefill(lo, hi int) error {
+	const batchSize = 64
+	for start := lo; start < hi; start += batchSize {
+		end := min(start+batchSize, hi)
+		w.batch.Reset()
+		for i := start; i < end; i++ {
+			w.writeSet(keyName(w.cfg.keyPrefix, i))
+		}
+		if _, err := w.conn.Write(w.batch.Bytes()); err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			reply, err := protocol.ReadReply(w.reader)
+			if err != nil {
+				return err
+			}
+			if reply.Kind == protocol.KindError {
+				return fmt.Errorf("prefill: %s", reply.Str)
+			}
+		}
+	}
+	return nil
+}
+
+// run sends pipelines of requests until ctx is done. The latency of a
+// request is measured from sending its pipeline to reading its reply.
+func (w *worker) run(ctx context.Context) (*stats, error) {
+	s := &stats{}
+	ops := make([]int, w.cfg.pipeline)
+	for ctx.Err() == nil {
+		w.batch.Reset()
+		for i := range ops {
+			op := w.cfg.mix.pick(w.rng)
+			ops[i] = op
+			key := keyName(w.cfg.keyPrefix, w.rng.IntN(w.cfg.keys))
+			switch op {
+			case opGet:
+				protocol.WriteRequest(w.writer, [][]byte{[]byte("GET"), key})
+			case opSet:
+				w.writeSet(key)
+			case opDel:
+				protocol.WriteRequest(w.writer, [][]byte{[]byte("DEL"), key})
+			}
+		}
+
+		start := time.Now()
+		if _, err := w.conn.Write(w.batch.Bytes()); err != nil {
+			return s, err
+		}
+		for _, op := range ops {
+			reply, err := protocol.ReadReply(w.reader)
+			if err != nil {
+				return s, err
+			}
+			s.latency[op].record(time.Since(start))
+			switch {
+			case reply.Kind == protocol.KindError:
+				s.errors++
+			case op == opGet && reply.Kind == protocol.KindNull:
+				s.misses++
+			}
+		}
+	}
+	return s, nil
+}
+
+func (w *worker) writeSet(key []byte) {
+	value := w.values[:w.cfg.valueSize.sample(w.rng)]
+	protocol.WriteRequest(w.writer, [][]byte{[]byte("SET"), key, value})
+}
+
+func (w *worker) close() {
+	w.conn.Close()
+}
+
+// result is the outcome of a benchmark run.
+type result struct {
+	stats
+	elapsed time.Duration
+}
+
+// runBench opens the connections, optionally fills the key space, and
+// then drives the load for the configured duration or until ctx is done.
+// If a connection fails, the run stops and the results so far are
+// returned together with the error.
+func runBench(ctx context.Context, cfg *config) (*result, error) {
+	workers := make([]*worker, cfg.connections)
+	defer func() {
+		for _, w := range workers {
+			if w != nil {
+				w.close()
+			}
+		}
+	}()
+	for i := range workers {
+		w, err := newWorker(ctx, cfg, i)
+		if err != nil {
+			return nil, err
+		}
+		workers[i] = w
+	}
+
+	if cfg.prefill {
+		errs := make(chan error, len(workers))
+		share := (cfg.keys + len(workers) - 1) / len(workers)
+		for i, w := range workers {
+			lo, hi := min(i*share, cfg.keys), min((i+1)*share, cfg.keys)
+			go func() { errs <- w.prefill(lo, hi) }()
+		}
+		for range workers {
+			if err := <-errs; err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	// Unblock reads and writes of a stuck server once the run is over.
+	stop := context.AfterFunc(ctx, func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, w := range workers {
+			w.conn.SetDeadline(deadline)
+		}
+	})
+	defer stop()
+
+	type outcome struct {
+		stats *stats
+		err   error
+	}
+	outcomes := make(chan outcome, len(workers))
+	start := time.Now()
+	for _, w := range workers {
+		go func() {
+			s, err := w.run(ctx)
+			if err != nil {
+				cancel()
+			}
+			outcomes <- outcome{s, err}
+		}()
+	}
+
+	res := &result{}
+	var firstErr error
+	for range workers {
+		o := <-outcomes
+		res.merge(o.stats)
+		if o.err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("connection failed: %w", o.err)
+		}
+	}
+	res.elapsed = time.Since(start)
+	return res, firstErr
+}
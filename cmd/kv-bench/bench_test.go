@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/server"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func TestRunBench(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	srv := server.NewServer(listener.Addr().String(), store)
+	go srv.Serve(t.Context(), listener)
+
+	cfg := &config{
+		addr:        listener.Addr().String(),
+		connections: 4,
+		pipeline:    8,
+		duration:    200 * time.Millisecond,
+		keys:        100,
+		keyPrefix:   "bench:",
+		mix:         mix{1, 0, 0},
+		valueSize:   sizeDist{kind: "fixed", min: 16, max: 16},
+		prefill:     true,
+		seed:        1,
+	}
+	res, err := runBench(t.Context(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.latency[opGet].total == 0 || res.errors != 0 || res.misses != 0 {
+		t.Fatalf("unexpected result: %d GETs, %d errors, %d misses",
+			res.latency[opGet].total, res.errors, res.misses)
+	}
+	keys, _ := store.Keys("bench:")
+	if len(keys) != cfg.keys {
+		t.Fatalf("expected %d prefilled keys, got %d", cfg.keys, len(keys))
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, newReport(cfg, res)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var r report
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("invalid JSON report: %v", err)
+	}
+	if r.Requests != res.latency[opGet].total || r.Ops["GET"].P99 <= 0 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if err := writeText(&bytes.Buffer{}, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
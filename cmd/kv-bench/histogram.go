@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// subBucketBits sets the precision of a histogram: every power of two is
+// split into 1<<subBucketBits linear buckets, so recorded latencies are
+// accurate to about 3%.
+const (
+	subBucketBits = 5
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = (64 - subBucketBits + 1) * subBuckets
+)
+
+// histogram records latencies in log-linear buckets of nanoseconds.
+type histogram struct {
+	counts [numBuckets]uint64
+	total  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(v int64) int {
+	if v < subBuckets {
+		return int(max(v, 0))
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits - 1
+	return (shift+1)*subBuckets + int(v>>shift) - subBuckets
+}
+
+// bucketLow returns the smallest value that falls into bucket i.
+func bucketLow(i int) int64 {
+	shift := i/subBuckets - 1
+	if shift <= 0 {
+		return int64(i)
+	}
+	return int64(i%subBuckets+subBuckets) << shift
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.counts[bucketOf(int64(d))]++
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.total++
+	h.sum += d
+}
+
+func (h *histogram) merge(other *histogram) {
+	if other.total == 0 {
+		return
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	h.max = max(h.max, other.max)
+	h.total += other.total
+	h.sum += other.sum
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
+
+// quantile returns the latency below which a fraction q of the recorded
+// latencies fall, rounded up to the end of its bucket.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.total))
+	rank = min(max(rank, 1), h.total)
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			high := time.Duration(bucketLow(i+1) - 1)
+			return min(max(high, h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// bucket is a range of a histogram printed in the report.
+type bucket struct {
+	Upper time.Duration
+	Count uint64
+}
+
+// reportBounds are the upper bounds of the printed histogram buckets.
+var reportBounds = []time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond,
+	500 * time.Microsecond, time.Millisecond, 2500 * time.Microsecond,
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second,
+}
+
+// buckets groups the recorded latencies by reportBounds. Latencies above
+// the last bound are counted in a final bucket whose Upper is the maximum.
+func (h *histogram) buckets() []bucket {
+	out := make([]bucket, len(reportBounds)+1)
+	for i, upper := range reportBounds {
+		out[i].Upper = upper
+	}
+	out[len(reportBounds)].Upper = max(h.max, reportBounds[len(reportBounds)-1])
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		low := time.Duration(bucketLow(i))
+		j := 0
+		for j < len(reportBounds) && low > reportBounds[j] {
+			j++
+		}
+		out[j].Count += n
+	}
+	for len(out) > 0 && out[len(out)-1].Count == 0 {
+		out = out[:len(out)-1]
+	}
+	return out
+}
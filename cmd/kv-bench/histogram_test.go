@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBounds(t *testing.T) {
+	prev := -1
+	for _, v := range []int64{0, 1, 31, 32, 63, 64, 65, 127, 128, 1000, 1 << 20, 1<<62 + 12345} {
+		i := bucketOf(v)
+		if i < prev {
+			t.Fatalf("bucket of %d is %d, before the bucket %d of a smaller value", v, i, prev)
+		}
+		prev = i
+		if low, next := bucketLow(i), bucketLow(i+1); v < low || v >= next {
+			t.Fatalf("%d is not in bucket %d [%d, %d)", v, i, low, next)
+		}
+		if width := bucketLow(i+1) - bucketLow(i); v >= subBuckets && width*subBuckets > v {
+			t.Fatalf("bucket %d of %d is %d wide", i, v, width)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 500 * time.Microsecond},
+		{0.99, 990 * time.Microsecond},
+		{0.999, 999 * time.Microsecond},
+		{1, time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := h.quantile(tt.q)
+		if got < tt.want || float64(got) > float64(tt.want)*1.04 {
+			t.Fatalf("quantile %v: expected about %v, got %v", tt.q, tt.want, got)
+		}
+	}
+	if h.min != time.Microsecond || h.max != time.Millisecond || h.mean() != 500500*time.Nanosecond {
+		t.Fatalf("unexpected min %v, max %v, mean %v", h.min, h.max, h.mean())
+	}
+
+	var merged histogram
+	merged.merge(&h)
+	merged.merge(&h)
+	if merged.total != 2000 || merged.quantile(0.5) != h.quantile(0.5) {
+		t.Fatalf("unexpected merged histogram: total %d, p50 %v", merged.total, merged.quantile(0.5))
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	var h histogram
+	h.record(10 * time.Microsecond)
+	h.record(200 * time.Microsecond)
+	h.record(2 * time.Second)
+
+	got := h.buckets()
+	if len(got) != len(reportBounds)+1 {
+		t.Fatalf("expected %d buckets, got %d", len(reportBounds)+1, len(got))
+	}
+	counts := map[time.Duration]uint64{}
+	for _, b := range got {
+		counts[b.Upper] += b.Count
+	}
+	if counts[50*time.Microsecond] != 1 || counts[250*time.Microsecond] != 1 || counts[2*time.Second] != 1 {
+		t.Fatalf("unexpected buckets %v", got)
+	}
+}
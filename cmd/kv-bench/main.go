@@ -0,0 +1,68 @@
+// Command kv-bench generates load against a running key-value server and
+// reports throughput and latency percentiles.
+//
+//	kv-bench -addr localhost:8080 -c 50 -d 30s -mix get=80,set=20 -value-size 64-1024 -P 16
+//
+// Each connection uses the binary protocol and sends pipelines of -P
+// requests, waiting for all replies before sending the next pipeline.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("kv-bench: ")
+
+	cfg := config{}
+	flag.StringVar(&cfg.addr, "addr", "localhost:8080", "server address")
+	flag.IntVar(&cfg.connections, "c", 50, "number of concurrent connections")
+	flag.IntVar(&cfg.pipeline, "P", 1, "pipelining depth, requests in flight per connection")
+	flag.DurationVar(&cfg.duration, "d", 10*time.Second, "duration of the run")
+	flag.IntVar(&cfg.keys, "keys", 100000, "size of the key space")
+	flag.StringVar(&cfg.keyPrefix, "key-prefix", "bench:", "prefix of the keys")
+	mixFlag := flag.String("mix", "get=80,set=20", "operation weights, e.g. get=70,set=25,del=5")
+	sizeFlag := flag.String("value-size", "100", "value size in bytes: N, MIN-MAX (uniform) or exp:MEAN")
+	flag.BoolVar(&cfg.prefill, "prefill", false, "set every key of the key space before the run")
+	flag.Uint64Var(&cfg.seed, "seed", uint64(time.Now().UnixNano()), "random seed")
+	jsonOut := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	var err error
+	if cfg.mix, err = parseMix(*mixFlag); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.valueSize, err = parseSizeDist(*sizeFlag); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.connections < 1 || cfg.pipeline < 1 || cfg.keys < 1 || cfg.duration <= 0 {
+		log.Fatal("-c, -P, -keys and -d must be positive")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	res, runErr := runBench(ctx, &cfg)
+	if res == nil {
+		log.Fatal(runErr)
+	}
+	r := newReport(&cfg, res)
+	if *jsonOut {
+		err = writeJSON(os.Stdout, r)
+	} else {
+		err = writeText(os.Stdout, r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
+	}
+}
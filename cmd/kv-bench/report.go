@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// report is the JSON form of a result. Latencies are in microseconds.
+type report struct {
+	Addr        string              `json:"addr"`
+	Connections int                 `json:"connections"`
+	Pipeline    int                 `json:"pipeline"`
+	Keys        int                 `json:"keys"`
+	Mix         string              `json:"mix"`
+	ValueSize   string              `json:"value_size"`
+	Duration    float64             `json:"duration_s"`
+	Requests    uint64              `json:"requests"`
+	Throughput  float64             `json:"requests_per_s"`
+	Errors      uint64              `json:"errors"`
+	Misses      uint64              `json:"get_misses"`
+	Total       opReport            `json:"total"`
+	Ops         map[string]opReport `json:"ops"`
+}
+
+type opReport struct {
+	Requests   uint64       `json:"requests"`
+	Throughput float64      `json:"requests_per_s"`
+	Min        float64      `json:"min_us"`
+	Mean       float64      `json:"mean_us"`
+	P50        float64      `json:"p50_us"`
+	P95        float64      `json:"p95_us"`
+	P99        float64      `json:"p99_us"`
+	P999       float64      `json:"p999_us"`
+	Max        float64      `json:"max_us"`
+	Histogram  []bucketJSON `json:"histogram"`
+}
+
+type bucketJSON struct {
+	Upper float64 `json:"le_us"`
+	Count uint64  `json:"count"`
+}
+
+func newReport(cfg *config, res *result) report {
+	r := report{
+		Addr:        cfg.addr,
+		Connections: cfg.connections,
+		Pipeline:    cfg.pipeline,
+		Keys:        cfg.keys,
+		Mix:         cfg.mix.String(),
+		ValueSize:   cfg.valueSize.String(),
+		Duration:    res.elapsed.Seconds(),
+		Errors:      res.errors,
+		Misses:      res.misses,
+		Ops:         make(map[string]opReport),
+	}
+	var total histogram
+	for op := range res.latency {
+		h := &res.latency[op]
+		total.merge(h)
+		if h.total > 0 {
+			r.Ops[opNames[op]] = newOpReport(h, res.elapsed)
+		}
+	}
+	r.Total = newOpReport(&total, res.elapsed)
+	r.Requests = r.Total.Requests
+	r.Throughput = r.Total.Throughput
+	return r
+}
+
+func newOpReport(h *histogram, elapsed time.Duration) opReport {
+	r := opReport{
+		Requests: h.total,
+		Min:      micros(h.min),
+		Mean:     micros(h.mean()),
+		P50:      micros(h.quantile(0.5)),
+		P95:      micros(h.quantile(0.95)),
+		P99:      micros(h.quantile(0.99)),
+		P999:     micros(h.quantile(0.999)),
+		Max:      micros(h.max),
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(h.total) / elapsed.Seconds()
+	}
+	for _, b := range h.buckets() {
+		r.Histogram = append(r.Histogram, bucketJSON{Upper: micros(b.Upper), Count: b.Count})
+	}
+	return r
+}
+
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+func writeJSON(w io.Writer, r report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeText prints a table of throughput and latency percentiles per
+// operation, followed by the latency histogram of all requests.
+func writeText(w io.Writer, r report) error {
+	fmt.Fprintf(w, "%s: %d connections, pipeline %d, %d keys, mix %s, value size %s\n",
+		r.Addr, r.Connections, r.Pipeline, r.Keys, r.Mix, r.ValueSize)
+	fmt.Fprintf(w, "%.2fs, %d requests, %.1f req/s, %d errors, %d GET misses\n\n",
+		r.Duration, r.Requests, r.Throughput, r.Errors, r.Misses)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\treq/s\tmin\tmean\tp50\tp95\tp99\tp99.9\tmax\t")
+	row := func(name string, op opReport) {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, op.Requests, op.Throughput,
+			formatMicros(op.Min), formatMicros(op.Mean), formatMicros(op.P50), formatMicros(op.P95),
+			formatMicros(op.P99), formatMicros(op.P999), formatMicros(op.Max))
+	}
+	for _, name := range opNames {
+		if op, ok := r.Ops[name]; ok {
+			row(name, op)
+		}
+	}
+	row("ALL", r.Total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nlatency histogram:")
+	const barWidth = 40
+	for _, b := range r.Total.Histogram {
+		share := 0.0
+		if r.Total.Requests > 0 {
+			share = float64(b.Count) / float64(r.Total.Requests)
+		}
+		bar := strings.Repeat("#", int(share*barWidth+0.5))
+		fmt.Fprintf(w, "  <= %8s %10d %6.2f%% %s\n", formatMicros(b.Upper), b.Count, share*100, bar)
+	}
+	return nil
+}
+
+func formatMicros(us float64) string {
+	d := time.Duration(us * float64(time.Microsecond))
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.2fms", us/1000)
+	default:
+		return fmt.Sprintf("%.0fµs", us)
+	}
+}
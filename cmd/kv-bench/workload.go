@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// Operations of the workload.
+const (
+	opGet = iota
+	opSet
+	opDel
+	numOps
+)
+
+var opNames = [numOps]string{"GET", "SET", "DEL"}
+
+// mix is the relative weight of each operation.
+type mix [numOps]int
+
+// parseMix parses weights such as "get=80,set=15,del=5". Operations that
+// are not mentioned have a weight of zero.
+func parseMix(s string) (mix, error) {
+	var m mix
+	total := 0
+	for part := range strings.SplitSeq(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return m, fmt.Errorf("invalid mix %q", part)
+		}
+		op := -1
+		for i, opName := range opNames {
+			if strings.EqualFold(name, opName) {
+				op = i
+			}
+		}
+		if op < 0 {
+			return m, fmt.Errorf("unknown operation %q", name)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return m, fmt.Errorf("invalid weight %q", weight)
+		}
+		m[op] = n
+		total += n
+	}
+	if total == 0 {
+		return m, fmt.Errorf("mix %q has no operations", s)
+	}
+	return m, nil
+}
+
+func (m mix) pick(rng *rand.Rand) int {
+	total := 0
+	for _, w := range m {
+		total += w
+	}
+	n := rng.IntN(total)
+	for op, w := range m {
+		if n < w {
+			return op
+		}
+		n -= w
+	}
+	return opGet
+}
+
+func (m mix) String() string {
+	parts := make([]string, 0, numOps)
+	for op, w := range m {
+		if w > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", strings.ToLower(opNames[op]), w))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// sizeDist is a distribution of value sizes in bytes.
+type sizeDist struct {
+	kind     string // fixed, uniform or exp
+	min, max int
+	mean     float64
+}
+
+// parseSizeDist parses a value size: "N" for a fixed size, "MIN-MAX" for
+// sizes uniformly distributed in the range, or "exp:MEAN" for
+// exponentially distributed sizes with the given mean, capped at 64 times
+// the mean.
+func parseSizeDist(s string) (sizeDist, error) {
+	if mean, ok := strings.CutPrefix(s, "exp:"); ok {
+		n, err := strconv.Atoi(mean)
+		if err != nil || n <= 0 {
+			return sizeDist{}, fmt.Errorf("invalid value size %q", s)
+		}
+		return sizeDist{kind: "exp", mean: float64(n), max: 64 * n}, nil
+	}
+	if lo, hi, ok := strings.Cut(s, "-"); ok {
+		minSize, err1 := strconv.Atoi(lo)
+		maxSize, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || minSize < 0 || maxSize < minSize {
+			return sizeDist{}, fmt.Errorf("invalid value size %q", s)
+		}
+		return sizeDist{kind: "uniform", min: minSize, max: maxSize}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return sizeDist{}, fmt.Errorf("invalid value size %q", s)
+	}
+	return sizeDist{kind: "fixed", min: n, max: n}, nil
+}
+
+func (d sizeDist) sample(rng *rand.Rand) int {
+	switch d.kind {
+	case "uniform":
+		return d.min + rng.IntN(d.max-d.min+1)
+	case "exp":
+		return min(int(math.Round(rng.ExpFloat64()*d.mean)), d.max)
+	default:
+		return d.min
+	}
+}
+
+func (d sizeDist) String() string {
+	switch d.kind {
+	case "uniform":
+		return fmt.Sprintf("%d-%d", d.min, d.max)
+	case "exp":
+		return fmt.Sprintf("exp:%d", int(d.mean))
+	default:
+		return strconv.Itoa(d.min)
+	}
+}
+
+// keyName returns the name of key i of the key space.
+func keyName(prefix string, i int) []byte {
+	return strconv.AppendInt([]byte(prefix), int64(i), 10)
+}
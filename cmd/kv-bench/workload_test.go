@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+func TestParseMix(t *testing.T) {
+	m, err := parseMix("GET=70, set=25,del=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != (mix{70, 25, 5}) || m.String() != "get=70,set=25,del=5" {
+		t.Fatalf("unexpected mix %v", m)
+	}
+
+	for _, s := range []string{"", "get", "get=-1", "incr=5", "get=0,set=0"} {
+		if _, err := parseMix(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	m = mix{0, 1, 0}
+	for range 100 {
+		if op := m.pick(rng); op != opSet {
+			t.Fatalf("expected %d, got %d", opSet, op)
+		}
+	}
+}
+
+func TestParseSizeDist(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	tests := []struct {
+		s        string
+		min, max int
+	}{
+		{"100", 100, 100},
+		{"10-20", 10, 20},
+		{"exp:50", 0, 3200},
+	}
+	for _, tt := range tests {
+		d, err := parseSizeDist(tt.s)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.s, err)
+		}
+		if d.String() != tt.s || d.max != tt.max {
+			t.Fatalf("%q: unexpected distribution %+v", tt.s, d)
+		}
+		for range 1000 {
+			if n := d.sample(rng); n < tt.min || n > tt.max {
+				t.Fatalf("%q: sample %d out of range", tt.s, n)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "-1", "20-10", "a-b", "exp:0", "exp:x"} {
+		if _, err := parseSizeDist(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
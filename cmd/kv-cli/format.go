@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aptolon/kv-store/client"
+)
+
+// Output formats of replies.
+const (
+	formatPretty = "pretty"
+	formatRaw    = "raw"
+	formatJSON   = "json"
+)
+
+// writeReply writes the reply of a command, or its error reply, in the
+// given format.
+func writeReply(w io.Writer, format string, reply any, err error) error {
+	var serverErr *client.ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		return err
+	}
+	if serverErr != nil {
+		reply = serverErr
+	}
+	switch format {
+	case formatRaw:
+		_, err = io.WriteString(w, formatRawReply(reply)+"\n")
+	case formatJSON:
+		var data []byte
+		data, err = json.Marshal(jsonReply(reply))
+		if err == nil {
+			_, err = w.Write(append(data, '\n'))
+		}
+	default:
+		_, err = io.WriteString(w, formatPrettyReply(reply, "")+"\n")
+	}
+	return err
+}
+
+// formatPrettyReply formats a reply the way redis-cli does. Values are
+// quoted, or shown in hex if they are not printable text.
+func formatPrettyReply(reply any, indent string) string {
+	switch r := reply.(type) {
+	case client.Status:
+		return string(r)
+	case []byte:
+		if printable(r) {
+			return strconv.Quote(string(r))
+		}
+		return "(hex) " + hex.EncodeToString(r)
+	case int64:
+		return "(integer) " + strconv.FormatInt(r, 10)
+	case *client.ServerError:
+		return "(error) " + r.Message
+	case []any:
+		if len(r) == 0 {
+			return "(empty array)"
+		}
+		width := len(strconv.Itoa(len(r)))
+		var b strings.Builder
+		for i, item := range r {
+			if i > 0 {
+				b.WriteString("\n" + indent)
+			}
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			b.WriteString(prefix)
+			b.WriteString(formatPrettyReply(item, indent+strings.Repeat(" ", len(prefix))))
+		}
+		return b.String()
+	default:
+		return "(nil)"
+	}
+}
+
+// formatRawReply formats a reply without any decoration, one array item
+// per line.
+func formatRawReply(reply any) string {
+	switch r := reply.(type) {
+	case client.Status:
+		return string(r)
+	case []byte:
+		return string(r)
+	case int64:
+		return strconv.FormatInt(r, 10)
+	case *client.ServerError:
+		return "ERROR " + r.Message
+	case []any:
+		lines := make([]string, len(r))
+		for i, item := range r {
+			lines[i] = formatRawReply(item)
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return ""
+	}
+}
+
+// jsonReply converts a reply into a value for encoding/json. Values that
+// are not valid UTF-8 are encoded as {"hex": ...}.
+func jsonReply(reply any) any {
+	switch r := reply.(type) {
+	case client.Status:
+		return map[string]string{"status": string(r)}
+	case []byte:
+		if utf8.Valid(r) {
+			return string(r)
+		}
+		return map[string]string{"hex": hex.EncodeToString(r)}
+	case *client.ServerError:
+		return map[string]string{"error": r.Message}
+	case []any:
+		items := make([]any, len(r))
+		for i, item := range r {
+			items[i] = jsonReply(item)
+		}
+		return items
+	default:
+		return r
+	}
+}
+
+func printable(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if !unicode.IsPrint(r) && !strings.ContainsRune("\n\r\t", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aptolon/kv-store/client"
+)
+
+func TestWriteReply(t *testing.T) {
+	reply := []any{client.Status("OK"), []byte("text"), []byte{0, 0xff}, int64(7), nil}
+	tests := []struct {
+		format string
+		reply  any
+		err    error
+		want   string
+	}{
+		{formatPretty, []byte("a\tb"), nil, "\"a\\tb\"\n"},
+		{formatPretty, []byte{0, 0xff}, nil, "(hex) 00ff\n"},
+		{formatPretty, nil, nil, "(nil)\n"},
+		{formatPretty, int64(3), nil, "(integer) 3\n"},
+		{formatPretty, nil, &client.ServerError{Message: "invalid command"}, "(error) invalid command\n"},
+		{formatPretty, []any{}, nil, "(empty array)\n"},
+		{formatPretty, reply, nil, "1) OK\n2) \"text\"\n3) (hex) 00ff\n4) (integer) 7\n5) (nil)\n"},
+		{formatPretty, []any{[]any{[]byte("a"), []byte("b")}}, nil, "1) 1) \"a\"\n   2) \"b\"\n"},
+		{formatRaw, []byte("raw\x00"), nil, "raw\x00\n"},
+		{formatRaw, reply, nil, "OK\ntext\n\x00\xff\n7\n\n"},
+		{formatRaw, nil, &client.ServerError{Message: "oops"}, "ERROR oops\n"},
+		{formatJSON, reply, nil, `[{"status":"OK"},"text",{"hex":"00ff"},7,null]` + "\n"},
+		{formatJSON, nil, &client.ServerError{Message: "oops"}, `{"error":"oops"}` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeReply(&buf, tt.format, tt.reply, tt.err); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tt.want {
+			t.Fatalf("%s %#v: expected %q, got %q", tt.format, tt.reply, tt.want, buf.String())
+		}
+	}
+
+	if err := writeReply(&bytes.Buffer{}, formatPretty, nil, client.ErrClosed); err != client.ErrClosed {
+		t.Fatalf("expected %v, got %v", client.ErrClosed, err)
+	}
+}
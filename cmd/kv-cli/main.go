@@ -0,0 +1,130 @@
+// Command kv-cli is the command line client of the key-value server.
+//
+// Without arguments it starts an interactive shell, or runs the commands
+// read from standard input if it is not a terminal. Otherwise the arguments
+// are sent as a single command:
+//
+//	kv-cli GET foo
+//	kv-cli -x SET foo < value.bin
+//	kv-cli -f value.bin SET foo
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/aptolon/kv-store/client"
+)
+
+type options struct {
+	addr    string
+	format  string
+	timeout time.Duration
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("kv-cli: ")
+
+	addr := os.Getenv("KV_ADDR")
+	if addr == "" {
+		addr = "localhost:8080"
+	}
+	var opts options
+	flag.StringVar(&opts.addr, "addr", addr, "server address, $KV_ADDR by default")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "timeout of each command")
+	raw := flag.Bool("raw", false, "print replies without formatting")
+	jsonOut := flag.Bool("json", false, "print replies as JSON, one per line")
+	stdinArg := flag.Bool("x", false, "read the last argument of the command from stdin")
+	fileArg := flag.String("f", "", "read the last argument of the command from `file`")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: kv-cli [flags] [command [arg...]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch {
+	case *raw && *jsonOut:
+		log.Fatal("-raw and -json are mutually exclusive")
+	case *raw:
+		opts.format = formatRaw
+	case *jsonOut:
+		opts.format = formatJSON
+	default:
+		opts.format = formatPretty
+	}
+	if *stdinArg && *fileArg != "" {
+		log.Fatal("-x and -f are mutually exclusive")
+	}
+
+	// A single connection keeps the state of MULTI and WATCH between
+	// commands.
+	c := client.New(opts.addr, client.WithPoolSize(1))
+	defer c.Close()
+	ctx := context.Background()
+
+	if flag.NArg() == 0 {
+		if *stdinArg || *fileArg != "" {
+			log.Fatal("-x and -f require a command")
+		}
+		var err error
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			err = repl(ctx, c, opts)
+		} else {
+			err = script(ctx, c, os.Stdin, opts)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	args := make([][]byte, 0, flag.NArg()+1)
+	for _, arg := range flag.Args() {
+		args = append(args, []byte(arg))
+	}
+	switch {
+	case *stdinArg:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, data)
+	case *fileArg != "":
+		data, err := os.ReadFile(*fileArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, data)
+	}
+	failed, err := run(ctx, c, os.Stdout, opts, args)
+	if err != nil {
+		c.Close()
+		log.Fatal(err)
+	}
+	if failed {
+		c.Close()
+		os.Exit(1)
+	}
+}
+
+// run sends a command and writes its reply to w. It reports whether the
+// server answered with an error.
+func run(ctx context.Context, c *client.Client, w io.Writer, opts options, args [][]byte) (failed bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	reply, err := c.Do(ctx, args...)
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) {
+		failed = true
+	}
+	return failed, writeReply(w, opts.format, reply, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// word is an argument of a command line. Quoted words are taken literally,
+// while an unquoted word of the form @path stands for the contents of a file.
+type word struct {
+	text   []byte
+	quoted bool
+}
+
+var errUnbalancedQuotes = errors.New("unbalanced quotes")
+
+// splitLine splits a command line into words separated by whitespace.
+// Double-quoted words may contain the escapes \n, \r, \t, \\, \" and \xHH;
+// single-quoted words are taken as is.
+func splitLine(line string) ([]word, error) {
+	var words []word
+	for i := 0; i < len(line); {
+		if isSpace(line[i]) {
+			i++
+			continue
+		}
+		var w word
+		for i < len(line) && !isSpace(line[i]) {
+			switch line[i] {
+			case '"':
+				w.quoted = true
+				i++
+				for {
+					if i >= len(line) {
+						return nil, errUnbalancedQuotes
+					}
+					c := line[i]
+					if c == '"' {
+						i++
+						break
+					}
+					if c != '\\' {
+						w.text = append(w.text, c)
+						i++
+						continue
+					}
+					if i+1 >= len(line) {
+						return nil, errUnbalancedQuotes
+					}
+					switch e := line[i+1]; e {
+					case 'n':
+						w.text = append(w.text, '\n')
+					case 'r':
+						w.text = append(w.text, '\r')
+					case 't':
+						w.text = append(w.text, '\t')
+					case 'x':
+						if i+3 >= len(line) {
+							return nil, fmt.Errorf("invalid escape %q", line[i:])
+						}
+						b, err := strconv.ParseUint(line[i+2:i+4], 16, 8)
+						if err != nil {
+							return nil, fmt.Errorf("invalid escape %q", line[i:i+4])
+						}
+						w.text = append(w.text, byte(b))
+						i += 2
+					default:
+						w.text = append(w.text, e)
+					}
+					i += 2
+				}
+			case '\'':
+				w.quoted = true
+				i++
+				for {
+					if i >= len(line) {
+						return nil, errUnbalancedQuotes
+					}
+					if line[i] == '\'' {
+						i++
+						break
+					}
+					w.text = append(w.text, line[i])
+					i++
+				}
+			default:
+				w.text = append(w.text, line[i])
+				i++
+			}
+		}
+		if w.text == nil {
+			w.text = []byte{}
+		}
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// expandWords turns words into command arguments, replacing each unquoted
+// @path with the contents of the file.
+func expandWords(words []word) ([][]byte, error) {
+	args := make([][]byte, len(words))
+	for i, w := range words {
+		if w.quoted || len(w.text) < 2 || w.text[0] != '@' {
+			args[i] = w.text
+			continue
+		}
+		data, err := os.ReadFile(string(w.text[1:]))
+		if err != nil {
+			return nil, err
+		}
+		args[i] = data
+	}
+	return args, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []word
+	}{
+		{`SET foo bar`, []word{{[]byte("SET"), false}, {[]byte("foo"), false}, {[]byte("bar"), false}}},
+		{`  GET   foo `, []word{{[]byte("GET"), false}, {[]byte("foo"), false}}},
+		{`SET k "a b\n\x00\"c"`, []word{{[]byte("SET"), false}, {[]byte("k"), false}, {[]byte("a b\n\x00\"c"), true}}},
+		{`SET k 'a\nb'`, []word{{[]byte("SET"), false}, {[]byte("k"), false}, {[]byte(`a\nb`), true}}},
+		{`SET k ""`, []word{{[]byte("SET"), false}, {[]byte("k"), false}, {[]byte{}, true}}},
+		{`SET k @file`, []word{{[]byte("SET"), false}, {[]byte("k"), false}, {[]byte("@file"), false}}},
+	}
+	for _, tt := range tests {
+		got, err := splitLine(tt.line)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.line, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%q: expected %v, got %v", tt.line, tt.want, got)
+		}
+	}
+
+	for _, line := range []string{`SET k "abc`, `SET k 'abc`, `SET k "\x4"`, `SET k "\xzz"`} {
+		if _, err := splitLine(line); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestExpandWords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value")
+	if err := os.WriteFile(path, []byte("from file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	words := []word{{[]byte("SET"), false}, {[]byte("@" + path), false}, {[]byte("@" + path), true}}
+	got, err := expandWords(words)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]byte{[]byte("SET"), []byte("from file"), []byte("@" + path)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	if _, err := expandWords([]word{{[]byte("@" + path + ".missing"), false}}); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		line    string
+		pos     int
+		want    string
+		wantPos int
+		ok      bool
+	}{
+		{"pi", 2, "PING ", 5, true},
+		{"ge", 2, "GET", 3, true},
+		{"P", 1, "P", 1, true},
+		{"pe", 2, "PERSIST ", 8, true},
+		{"LAST foo", 4, "LASTSAVE foo", 9, true},
+		{"GET fo", 6, "", 0, false},
+		{"xyz", 3, "", 0, false},
+	}
+	for _, tt := range tests {
+		got, pos, ok := complete(tt.line, tt.pos, '\t')
+		if got != tt.want || pos != tt.wantPos || ok != tt.ok {
+			t.Fatalf("%q: expected %q %d %v, got %q %d %v", tt.line, tt.want, tt.wantPos, tt.ok, got, pos, ok)
+		}
+	}
+}
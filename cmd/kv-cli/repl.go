@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/aptolon/kv-store/client"
+)
+
+// commands are the names offered by tab completion.
+var commands = []string{
+	"BGSAVE", "CAS", "DECR", "DECRBY", "DEL", "DISCARD", "EXEC", "EXPIRE",
+	"GET", "GETSET", "HDEL", "HGET", "HGETALL", "HSET", "INCR", "INCRBY",
+	"INCRBYFLOAT", "INFO", "KEYS", "LASTSAVE", "LPOP", "LPUSH", "LRANGE",
+	"MDEL", "MGET", "MSET", "MULTI", "PERSIST", "PING", "PTTL", "RANGE",
+	"RESTORESNAPSHOT", "RPOP", "RPUSH", "SADD", "SAVE", "SCAN", "SET", "SETNX",
+	"SISMEMBER", "SMEMBERS", "SNAPSHOTS", "SREM", "TTL", "TYPE", "UNWATCH",
+	"WATCH", "ZADD", "ZRANGE", "ZRANGEBYSCORE",
+}
+
+const maxHistory = 1000
+
+// repl reads commands from the terminal until EOF or QUIT, with line
+// editing, a history kept in ~/.kv_cli_history and tab completion of
+// command names.
+func repl(ctx context.Context, c *client.Client, opts options) error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+	t := term.NewTerminal(rw, opts.addr+"> ")
+	t.AutoCompleteCallback = complete
+
+	history := &fileHistory{}
+	if home, err := os.UserHomeDir(); err == nil {
+		history.path = filepath.Join(home, ".kv_cli_history")
+		history.load()
+	}
+	t.History = history
+
+	for {
+		line, err := t.ReadLine()
+		if errors.Is(err, term.ErrPasteIndicator) {
+			err = nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.EqualFold(line, "quit") || strings.EqualFold(line, "exit") {
+			return nil
+		}
+		if err := runLine(ctx, c, t, opts, line); err != nil {
+			fmt.Fprintf(t, "error: %v\n", err)
+		}
+	}
+}
+
+// script runs the commands read line by line from r, as when the input of
+// kv-cli is not a terminal.
+func script(ctx context.Context, c *client.Client, r io.Reader, opts options) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := runLine(ctx, c, os.Stdout, opts, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func runLine(ctx context.Context, c *client.Client, w io.Writer, opts options, line string) error {
+	words, err := splitLine(line)
+	if err != nil {
+		return err
+	}
+	args, err := expandWords(words)
+	if err != nil {
+		return err
+	}
+	_, err = run(ctx, c, w, opts, args)
+	return err
+}
+
+// complete completes the command name under the cursor when tab is
+// pressed: fully if a single command matches, else up to the longest
+// common prefix of the matches.
+func complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := len(line) - len(strings.TrimLeft(line, " "))
+	if pos < start || strings.Contains(line[start:pos], " ") {
+		return "", 0, false
+	}
+	prefix := strings.ToUpper(line[start:pos])
+	var matches []string
+	for _, cmd := range commands {
+		if strings.HasPrefix(cmd, prefix) {
+			matches = append(matches, cmd)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	completion := matches[0]
+	if len(matches) == 1 {
+		completion += " "
+	} else {
+		for _, m := range matches[1:] {
+			for !strings.HasPrefix(m, completion) {
+				completion = completion[:len(completion)-1]
+			}
+		}
+	}
+	rest := strings.TrimLeft(line[pos:], " ")
+	if len(matches) > 1 {
+		rest = line[pos:]
+	}
+	return line[:start] + completion + rest, start + len(completion), true
+}
+
+// fileHistory is a term.History that is persisted to a file, one line per
+// entry. Entries are appended to the file as they are added.
+type fileHistory struct {
+	path    string
+	entries []string // oldest first
+}
+
+func (h *fileHistory) load() {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return
+	}
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimRight(line, "\n"); line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if len(h.entries) > maxHistory {
+		h.entries = slices.Clone(h.entries[len(h.entries)-maxHistory:])
+	}
+}
+
+func (h *fileHistory) Add(entry string) {
+	if entry == "" || strings.ContainsAny(entry, "\r\n") {
+		return
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry {
+		return
+	}
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[1:]
+	}
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(entry + "\n")
+}
+
+func (h *fileHistory) Len() int {
+	return len(h.entries)
+}
+
+// At returns the entry at idx, where 0 is the most recent one.
+func (h *fileHistory) At(idx int) string {
+	return h.entries[len(h.entries)-1-idx]
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"maps"
 	"os"
 	"testing"
 
 	"github.com/aptolon/kv-store/internal/persistence"
 	"github.com/aptolon/kv-store/internal/storage"
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func TestPersistenceRestart(t *testing.T) {
@@ -18,21 +20,21 @@ func TestPersistenceRestart(t *testing.T) {
 	if db == "" {
 		t.Fatal("DATABASE_URL not set")
 	}
-	conn, err := pgx.Connect(ctx, db)
+	pool, err := pgxpool.New(ctx, db)
 
 	if err != nil {
 		t.Fatalf("postgres connect error: %v", err)
 	}
-	defer conn.Close(ctx)
+	defer pool.Close()
 
 	nameTable := "kv_snapshot_test"
 
-	if err := persistence.CreateSnapshotTable(ctx, conn, nameTable); err != nil {
+	if err := persistence.CreateSnapshotTable(ctx, pool, nameTable); err != nil {
 		t.Fatalf("create table error: %v", err)
 	}
-	repo := persistence.NewPostgresSnapshotRepository(conn, nameTable)
+	repo := persistence.NewPostgresSnapshotRepository(pool, nameTable)
 
-	data, err := repo.Load(ctx)
+	data, err := persistence.LoadMap(ctx, repo)
 	if err != nil {
 		t.Fatalf("load snapshot error: %v", err)
 	}
@@ -47,14 +49,13 @@ func TestPersistenceRestart(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := repo.Save(
-		context.Background(),
-		store.Snapshot(),
-	); err != nil {
+	view := store.View()
+	defer view.Close()
+	if err := repo.Save(context.Background(), view.All()); err != nil {
 		t.Fatalf("snapshot save error: %v", err)
 	}
 
-	data2, err := repo.Load(ctx)
+	data2, err := persistence.LoadMap(ctx, repo)
 	if err != nil {
 		t.Fatalf("failed to load snapshot after restart: %v", err)
 	}
@@ -69,7 +70,139 @@ func TestPersistenceRestart(t *testing.T) {
 	if string(got) != string(value) {
 		t.Fatalf("expected %q, got %q", value, got)
 	}
-	if err := persistence.DropSnapshotTable(ctx, conn, nameTable); err != nil {
+	if err := persistence.DropSnapshotTable(ctx, pool, nameTable); err != nil {
 		t.Fatalf("drop table error: %v", err)
 	}
 }
+
+func TestPersistenceDelta(t *testing.T) {
+	ctx := t.Context()
+
+	db := os.Getenv("DATABASE_URL")
+
+	if db == "" {
+		t.Fatal("DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(ctx, db)
+
+	if err != nil {
+		t.Fatalf("postgres connect error: %v", err)
+	}
+	defer pool.Close()
+
+	nameTable := "kv_snapshot_delta_test"
+
+	if err := persistence.CreateSnapshotTable(ctx, pool, nameTable); err != nil {
+		t.Fatalf("create table error: %v", err)
+	}
+	defer persistence.DropSnapshotTable(ctx, pool, nameTable)
+
+	repo := persistence.NewPostgresSnapshotRepository(pool, nameTable)
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set(key, []byte(key)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	store.ResetDirty()
+	if err := persistence.SaveMap(ctx, repo, store.Snapshot()); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+
+	if err := store.Set("a", []byte("updated")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Set("d", []byte("d")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := repo.SaveDelta(ctx, store.TakeDelta()); err != nil {
+		t.Fatalf("delta save error: %v", err)
+	}
+
+	data, err := persistence.LoadMap(ctx, repo)
+	if err != nil {
+		t.Fatalf("load snapshot error: %v", err)
+	}
+
+	want := map[string]string{"a": "updated", "c": "c", "d": "d"}
+	if len(data) != len(want) {
+		t.Fatalf("expected %d keys, got %d", len(want), len(data))
+	}
+	for key, value := range want {
+		if string(data[key].Value) != value {
+			t.Fatalf("key %q: expected %q, got %q", key, value, data[key].Value)
+		}
+	}
+}
+
+func TestPersistenceHistory(t *testing.T) {
+	ctx := context.Background()
+	db := os.Getenv("DATABASE_URL")
+
+	if db == "" {
+		t.Fatal("DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(ctx, db)
+
+	if err != nil {
+		t.Fatalf("postgres connect error: %v", err)
+	}
+	defer pool.Close()
+
+	nameTable := "kv_snapshot_history_test"
+
+	if err := persistence.CreateSnapshotTable(ctx, pool, nameTable); err != nil {
+		t.Fatalf("create table error: %v", err)
+	}
+	defer persistence.DropSnapshotTable(ctx, pool, nameTable)
+
+	repo := persistence.NewPostgresSnapshotRepository(pool, nameTable)
+	repo.SetRetention(persistence.Retention{Keep: 2})
+
+	for _, value := range []string{"1", "2", "3"} {
+		data := map[string]storage.Entry{"a": {Value: []byte(value)}}
+		if err := persistence.SaveMap(ctx, repo, data); err != nil {
+			t.Fatalf("snapshot save error: %v", err)
+		}
+	}
+	if err := repo.SaveDelta(ctx, storage.Delta{
+		Upserts: map[string]storage.Entry{"b": {Value: []byte("b")}},
+	}); err != nil {
+		t.Fatalf("delta save error: %v", err)
+	}
+
+	snapshots, err := repo.ListSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("list snapshots error: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 generations, got %d", len(snapshots))
+	}
+	if snapshots[0].Keys != 2 || snapshots[1].Keys != 1 {
+		t.Fatalf("unexpected key counts: %+v", snapshots)
+	}
+
+	for i, want := range []map[string]string{{"a": "3", "b": "b"}, {"a": "2"}} {
+		data := make(map[string]string)
+		err := repo.LoadSnapshot(ctx, snapshots[i].ID, func(key string, entry storage.Entry) error {
+			data[key] = string(entry.Value)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("load snapshot %d error: %v", snapshots[i].ID, err)
+		}
+		if !maps.Equal(data, want) {
+			t.Fatalf("snapshot %d: expected %v, got %v", snapshots[i].ID, want, data)
+		}
+	}
+
+	err = repo.LoadSnapshot(ctx, snapshots[1].ID-1, func(string, storage.Entry) error { return nil })
+	if !errors.Is(err, persistence.ErrSnapshotNotFound) {
+		t.Fatalf("expected %v, got %v", persistence.ErrSnapshotNotFound, err)
+	}
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/aptolon/kv-store/internal/grpcapi"
+	"github.com/aptolon/kv-store/internal/httpapi"
 	"github.com/aptolon/kv-store/internal/persistence"
 	"github.com/aptolon/kv-store/internal/server"
+	"github.com/aptolon/kv-store/internal/snapshot"
 	"github.com/aptolon/kv-store/internal/storage"
-	"github.com/jackc/pgx/v5"
+	"github.com/aptolon/kv-store/internal/wal"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 func main() {
@@ -22,43 +31,82 @@ func main() {
 	)
 	defer cancel()
 
-	db := os.Getenv("DATABASE_URL")
-
-	if db == "" {
-		log.Fatal("DATABASE_URL not set")
+	repo, closeRepo, err := openRepository(ctx)
+	if err != nil {
+		log.Fatalf("snapshot repository error: %v", err)
 	}
-	conn, err := pgx.Connect(ctx, db)
+	defer closeRepo()
 
-	for i := 1; i <= 15; i++ {
-		conn, err = pgx.Connect(ctx, db)
-		if err == nil {
-			break
-		}
+	dumpPath := os.Getenv("SNAPSHOT_DUMP_PATH")
+	if dumpPath == "" {
+		dumpPath = "kv-snapshot.dump"
+	}
 
-		log.Printf("waiting for postgres (%d/15): %v", i, err)
-		time.Sleep(1 * time.Second)
+	// A dump left by a shutdown whose save failed is newer than the
+	// repository and takes precedence until it is saved.
+	store, err := newStore()
+	if err != nil {
+		log.Fatalf("storage config error: %v", err)
+	}
+	dumped, err := persistence.ReadDump(dumpPath, store.Restore)
+	if err != nil {
+		log.Fatalf("load dump error: %v", err)
+	}
+	if dumped {
+		log.Printf("snapshot loaded from dump %s", dumpPath)
+	} else if err := repo.LoadInto(ctx, store.Restore); err != nil {
+		log.Fatalf("load snapshot error: %v", err)
 	}
 
+	walPath := os.Getenv("WAL_PATH")
+	if walPath == "" {
+		walPath = "kv.wal"
+	}
+	syncPolicy, err := wal.ParseSyncPolicy(os.Getenv("WAL_FSYNC"))
+	if err != nil {
+		log.Fatalf("wal config error: %v", err)
+	}
+	if err := wal.Replay(walPath, store); err != nil {
+		log.Fatalf("wal replay error: %v", err)
+	}
+	walLog, err := wal.Open(walPath, syncPolicy)
 	if err != nil {
-		log.Fatalf("postgres not available: %v", err)
+		log.Fatalf("wal open error: %v", err)
 	}
-	defer conn.Close(ctx)
+	defer walLog.Close()
+	go walLog.Run(ctx)
 
-	nameTable := "kv_snapshot"
-	if err := persistence.CreateSnapshotTable(ctx, conn, nameTable); err != nil {
-		log.Fatalf("create table error: %v", err)
+	// The limit applies from here on: the data loaded so far was stored
+	// within it before the restart, or under a higher one.
+	maxMemory, policy, err := memoryLimit()
+	if err != nil {
+		log.Fatalf("memory config error: %v", err)
 	}
-	repo := persistence.NewPostgresSnapshotRepository(conn, nameTable)
+	logged := wal.NewStorage(store, walLog)
+	logged.SetMemoryLimit(maxMemory, policy)
+	go store.RunExpiry(ctx, 100*time.Millisecond)
 
-	data, err := repo.Load(ctx)
+	snapshotCfg, err := snapshotConfig()
 	if err != nil {
-		log.Fatalf("load snapshot error: %v", err)
+		log.Fatalf("snapshot config error: %v", err)
 	}
+	scheduler := snapshot.NewScheduler(
+		saveFunc(repo, logged, walLog, dumpPath),
+		store.Changes,
+		snapshotCfg,
+	)
+	go scheduler.Run(ctx)
 
-	store := storage.NewMemoryStorage(data)
+	opts := []server.Option{
+		server.WithSnapshotter(scheduler),
+		server.WithMemoryReporter(store),
+	}
+	if history, ok := repo.(persistence.HistoryRepository); ok {
+		opts = append(opts, server.WithSnapshotHistory(snapshot.NewRestorer(history, logged, scheduler)))
+	}
 
 	port := os.Getenv("SERV_PORT")
-	serv := server.NewServer(port, store)
+	serv := server.NewServer(port, logged, opts...)
 	go func() {
 		if err := serv.Start(ctx); err != nil {
 			log.Printf("server stopped with error: %v", err)
@@ -66,12 +114,245 @@ func main() {
 		}
 	}()
 
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		grpcServ := grpcapi.NewServer(grpcPort, logged)
+		go func() {
+			if err := grpcServ.Start(ctx); err != nil {
+				log.Printf("grpc server stopped with error: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	if httpPort := os.Getenv("HTTP_PORT"); httpPort != "" {
+		httpServ := httpapi.NewServer(httpPort, logged)
+		go func() {
+			if err := httpServ.Start(ctx); err != nil {
+				log.Printf("http server stopped with error: %v", err)
+				cancel()
+			}
+		}()
+	}
+
 	<-ctx.Done()
-	if err := repo.Save(
-		context.Background(),
-		store.Snapshot(),
-	); err != nil {
+	if err := scheduler.Save(context.Background(), false); err != nil {
 		log.Printf("snapshot save error: %v", err)
+		view, _ := logged.CheckpointView()
+		err := persistence.WriteDump(dumpPath, view.All())
+		view.Close()
+		if err != nil {
+			log.Printf("snapshot dump error: %v", err)
+		} else {
+			log.Printf("snapshot dumped to %s", dumpPath)
+		}
 	}
 	log.Println("shutdown signal received")
 }
+
+// memoryStore is the in-memory storage the server keeps its data in.
+type memoryStore interface {
+	wal.Backend
+	Restore(key string, loaded storage.Entry) error
+	Changes() uint64
+	RunExpiry(ctx context.Context, interval time.Duration)
+	MemoryStats() storage.MemoryStats
+}
+
+// newStore creates the storage selected by STORAGE_SHARDS: a single
+// MemoryStorage by default, or a ShardedStorage with that many shards.
+func newStore() (memoryStore, error) {
+	shards := 1
+	if v := os.Getenv("STORAGE_SHARDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("STORAGE_SHARDS: invalid shard count %q", v)
+		}
+		shards = n
+	}
+	if shards == 1 {
+		return storage.NewMemoryStorage(nil), nil
+	}
+	return storage.NewShardedStorage(shards, nil), nil
+}
+
+// memoryLimit reads the memory limit from MAXMEMORY, in bytes or with a
+// kb, mb or gb suffix (0, the default, means no limit), and the eviction
+// policy from MAXMEMORY_POLICY (noeviction by default).
+func memoryLimit() (int64, storage.EvictionPolicy, error) {
+	var maxMemory int64
+	if v := os.Getenv("MAXMEMORY"); v != "" {
+		n, err := parseBytes(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("MAXMEMORY: invalid size %q", v)
+		}
+		maxMemory = n
+	}
+	policy := storage.NoEviction
+	if v := os.Getenv("MAXMEMORY_POLICY"); v != "" {
+		var err error
+		if policy, err = storage.ParseEvictionPolicy(v); err != nil {
+			return 0, 0, fmt.Errorf("MAXMEMORY_POLICY: %w", err)
+		}
+	}
+	return maxMemory, policy, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	unit := int64(1)
+	lower := strings.ToLower(s)
+	for _, suffix := range []struct {
+		name string
+		unit int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}} {
+		if strings.HasSuffix(lower, suffix.name) {
+			lower, unit = strings.TrimSuffix(lower, suffix.name), suffix.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, errors.New("invalid size")
+	}
+	return n * unit, nil
+}
+
+// openRepository creates the snapshot backend selected by SNAPSHOT_BACKEND:
+// "postgres" (the default) or "file".
+func openRepository(ctx context.Context) (persistence.SnapshotRepository, func(), error) {
+	switch backend := os.Getenv("SNAPSHOT_BACKEND"); backend {
+	case "", "postgres":
+		return openPostgres(ctx)
+	case "file":
+		path := os.Getenv("SNAPSHOT_FILE_PATH")
+		if path == "" {
+			path = "kv.snapshot"
+		}
+		log.Printf("using file snapshot backend %s", path)
+		return persistence.NewFileSnapshotRepository(path), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown SNAPSHOT_BACKEND %q", backend)
+	}
+}
+
+func openPostgres(ctx context.Context) (persistence.SnapshotRepository, func(), error) {
+	db := os.Getenv("DATABASE_URL")
+
+	if db == "" {
+		return nil, nil, errors.New("DATABASE_URL not set")
+	}
+	poolConfig, err := pgxpool.ParseConfig(db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DATABASE_URL: %w", err)
+	}
+	poolConfig.HealthCheckPeriod = 10 * time.Second
+	poolConfig.ConnConfig.ConnectTimeout = 5 * time.Second
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("postgres pool error: %w", err)
+	}
+
+	for i := 1; i <= 15; i++ {
+		err = pool.Ping(ctx)
+		if err == nil {
+			break
+		}
+
+		log.Printf("waiting for postgres (%d/15): %v", i, err)
+		time.Sleep(1 * time.Second)
+	}
+
+	if err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("postgres not available: %w", err)
+	}
+
+	retention, err := snapshotRetention()
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+
+	nameTable := "kv_snapshot"
+	if err := persistence.CreateSnapshotTable(ctx, pool, nameTable); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("create table error: %w", err)
+	}
+	repo := persistence.NewPostgresSnapshotRepository(pool, nameTable)
+	repo.SetRetention(retention)
+	return repo, pool.Close, nil
+}
+
+// snapshotRetention reads how many snapshot generations to keep:
+// SNAPSHOT_KEEP newest ones (10 by default) and all from the last
+// SNAPSHOT_KEEP_DAYS days. Zero disables the respective limit.
+func snapshotRetention() (persistence.Retention, error) {
+	retention := persistence.Retention{Keep: 10}
+	if v := os.Getenv("SNAPSHOT_KEEP"); v != "" {
+		keep, err := strconv.Atoi(v)
+		if err != nil {
+			return retention, fmt.Errorf("SNAPSHOT_KEEP: %w", err)
+		}
+		retention.Keep = keep
+	}
+	if v := os.Getenv("SNAPSHOT_KEEP_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			return retention, fmt.Errorf("SNAPSHOT_KEEP_DAYS: %w", err)
+		}
+		retention.MaxAge = time.Duration(days) * 24 * time.Hour
+	}
+	return retention, nil
+}
+
+// saveFunc saves the storage behind the write-ahead log and truncates the
+// log up to the saved state. Incremental saves are used when the
+// repository supports them. A shutdown dump is removed once a full save
+// has made it redundant.
+func saveFunc(
+	repo persistence.SnapshotRepository,
+	logged *wal.Storage,
+	walLog *wal.Log,
+	dumpPath string,
+) snapshot.SaveFunc {
+	return func(ctx context.Context, full bool) error {
+		deltaRepo, ok := repo.(persistence.DeltaRepository)
+		if full || !ok {
+			view, offset := logged.CheckpointView()
+			defer view.Close()
+			if err := repo.Save(ctx, view.All()); err != nil {
+				return err
+			}
+			if err := persistence.RemoveDump(dumpPath); err != nil {
+				return err
+			}
+			return walLog.TruncateBefore(offset)
+		}
+
+		delta, offset := logged.CheckpointDelta()
+		if err := deltaRepo.SaveDelta(ctx, delta); err != nil {
+			logged.MarkDirty(delta)
+			return err
+		}
+		return walLog.TruncateBefore(offset)
+	}
+}
+
+func snapshotConfig() (snapshot.Config, error) {
+	var cfg snapshot.Config
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("SNAPSHOT_INTERVAL: %w", err)
+		}
+		cfg.Interval = interval
+	}
+	if v := os.Getenv("SNAPSHOT_WRITES"); v != "" {
+		writes, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("SNAPSHOT_WRITES: %w", err)
+		}
+		cfg.Writes = writes
+	}
+	return cfg, nil
+}
@@ -0,0 +1,234 @@
+// Package grpcapi serves the storage over gRPC, see api/kv/v1/kv.proto.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	kvv1 "github.com/aptolon/kv-store/api/kv/v1"
+	"github.com/aptolon/kv-store/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultPageSize = 100
+	// maxPageSize bounds the page a client may ask for, so that a single
+	// read does not hold the storage for long.
+	maxPageSize = 1000
+)
+
+// Server implements the KV service on top of storage.Storage.
+type Server struct {
+	kvv1.UnimplementedKVServer
+
+	addr    string
+	storage storage.Storage
+	ready   chan string
+}
+
+func NewServer(addr string, storage storage.Storage) *Server {
+	return &Server{
+		addr:    addr,
+		storage: storage,
+		ready:   make(chan string, 1),
+	}
+}
+
+// Start serves gRPC until ctx is done, then stops gracefully, waiting for
+// the calls in flight.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ready <- listener.Addr().String()
+
+	srv := grpc.NewServer()
+	kvv1.RegisterKVServer(srv, s)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	log.Printf("grpc server started on port %s", s.addr)
+	return srv.Serve(listener)
+}
+
+func (s *Server) Get(ctx context.Context, req *kvv1.GetRequest) (*kvv1.GetResponse, error) {
+	if req.GetKey() == "" {
+		return nil, errEmptyKey
+	}
+	value, err := s.storage.Get(req.GetKey())
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if value == nil {
+		return nil, status.Errorf(codes.NotFound, "key %q not found", req.GetKey())
+	}
+	return &kvv1.GetResponse{Value: value}, nil
+}
+
+func (s *Server) Set(ctx context.Context, req *kvv1.SetRequest) (*kvv1.SetResponse, error) {
+	if err := s.set(req); err != nil {
+		return nil, err
+	}
+	return &kvv1.SetResponse{}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *kvv1.DeleteRequest) (*kvv1.DeleteResponse, error) {
+	if req.GetKey() == "" {
+		return nil, errEmptyKey
+	}
+	if err := s.storage.Delete(req.GetKey()); err != nil {
+		return nil, internalError(err)
+	}
+	return &kvv1.DeleteResponse{}, nil
+}
+
+func (s *Server) BatchGet(ctx context.Context, req *kvv1.BatchGetRequest) (*kvv1.BatchGetResponse, error) {
+	keys := req.GetKeys()
+	for _, key := range keys {
+		if key == "" {
+			return nil, errEmptyKey
+		}
+	}
+	values, err := s.storage.GetMulti(keys)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	resp := &kvv1.BatchGetResponse{}
+	for i, value := range values {
+		if value != nil {
+			resp.Entries = append(resp.Entries, &kvv1.Entry{Key: keys[i], Value: value})
+			continue
+		}
+		// GetMulti leaves out keys of other kinds, which are reported
+		// rather than taken for missing ones.
+		entry, ok, err := s.storage.GetEntry(keys[i])
+		if err != nil {
+			return nil, internalError(err)
+		}
+		if ok && entry.Kind != storage.KindString {
+			return nil, status.Errorf(codes.FailedPrecondition, "key %q holds a value of another type", keys[i])
+		}
+	}
+	return resp, nil
+}
+
+// BatchSet validates every entry and then writes them all atomically.
+func (s *Server) BatchSet(ctx context.Context, req *kvv1.BatchSetRequest) (*kvv1.BatchSetResponse, error) {
+	keys := make([]string, len(req.GetEntries()))
+	entries := make([]storage.Entry, len(req.GetEntries()))
+	now := time.Now()
+	for i, entry := range req.GetEntries() {
+		if err := validateSet(entry); err != nil {
+			return nil, err
+		}
+		keys[i] = entry.GetKey()
+		entries[i].Value = entry.GetValue()
+		if ttl := entry.GetTtl(); ttl != nil {
+			entries[i].ExpireAt = now.Add(ttl.AsDuration())
+		}
+	}
+	if err := s.storage.SetMulti(keys, entries); err != nil {
+		return nil, internalError(err)
+	}
+	return &kvv1.BatchSetResponse{}, nil
+}
+
+func (s *Server) BatchDelete(ctx context.Context, req *kvv1.BatchDeleteRequest) (*kvv1.BatchDeleteResponse, error) {
+	for _, key := range req.GetKeys() {
+		if key == "" {
+			return nil, errEmptyKey
+		}
+	}
+	if _, err := s.storage.DeleteMulti(req.GetKeys()); err != nil {
+		return nil, internalError(err)
+	}
+	return &kvv1.BatchDeleteResponse{}, nil
+}
+
+// Scan streams the matching entries in key order, reading one page at a
+// time, so that writes are not held up by a long scan. Each page is read
+// at a single point in time. Keys holding other kinds than strings are
+// skipped, as their values are encoded for storage only.
+func (s *Server) Scan(req *kvv1.ScanRequest, stream grpc.ServerStreamingServer[kvv1.ScanResponse]) error {
+	pageSize := min(int(req.GetPageSize()), maxPageSize)
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	end := storage.PrefixEnd(req.GetPrefix())
+	for start := req.GetPrefix(); ; {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		items, err := s.storage.Scan(start, end, pageSize)
+		if err != nil {
+			return internalError(err)
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		page := &kvv1.ScanResponse{Entries: make([]*kvv1.Entry, 0, len(items))}
+		for _, item := range items {
+			if item.Kind == storage.KindString {
+				page.Entries = append(page.Entries, &kvv1.Entry{Key: item.Key, Value: item.Value})
+			}
+		}
+		if len(page.Entries) > 0 {
+			if err := stream.Send(page); err != nil {
+				return err
+			}
+		}
+		if len(items) < pageSize {
+			return nil
+		}
+		start = items[len(items)-1].Key + "\x00"
+	}
+}
+
+func (s *Server) set(req *kvv1.SetRequest) error {
+	if err := validateSet(req); err != nil {
+		return err
+	}
+	var err error
+	if req.GetTtl() != nil {
+		err = s.storage.SetWithExpiry(req.GetKey(), req.GetValue(), time.Now().Add(req.GetTtl().AsDuration()))
+	} else {
+		err = s.storage.Set(req.GetKey(), req.GetValue())
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+func validateSet(req *kvv1.SetRequest) error {
+	if req.GetKey() == "" {
+		return errEmptyKey
+	}
+	if ttl := req.GetTtl(); ttl != nil {
+		if err := ttl.CheckValid(); err != nil || ttl.AsDuration() <= 0 {
+			return status.Error(codes.InvalidArgument, "ttl must be positive")
+		}
+	}
+	return nil
+}
+
+var errEmptyKey = status.Error(codes.InvalidArgument, "key must not be empty")
+
+func internalError(err error) error {
+	if errors.Is(err, storage.ErrOutOfMemory) {
+		return status.Error(codes.ResourceExhausted, "out of memory")
+	}
+	if errors.Is(err, storage.ErrWrongType) {
+		return status.Error(codes.FailedPrecondition, "key holds a value of another type")
+	}
+	log.Printf("grpc storage error: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
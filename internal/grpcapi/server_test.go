@@ -0,0 +1,228 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	kvv1 "github.com/aptolon/kv-store/api/kv/v1"
+	"github.com/aptolon/kv-store/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func newTestClient(t *testing.T) (kvv1.KVClient, storage.Storage) {
+	t.Helper()
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	listener := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	kvv1.RegisterKVServer(srv, NewServer("", store))
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvv1.NewKVClient(conn), store
+}
+
+func TestGetSetDelete(t *testing.T) {
+	client, store := newTestClient(t)
+	ctx := t.Context()
+
+	_, err := client.Get(ctx, &kvv1.GetRequest{Key: "a"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	value := []byte("hello world\n\x00")
+	if _, err := client.Set(ctx, &kvv1.SetRequest{Key: "a", Value: value}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := client.Get(ctx, &kvv1.GetRequest{Key: "a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(resp.GetValue()) != string(value) {
+		t.Fatalf("expected %q, got %q", value, resp.GetValue())
+	}
+
+	_, err = client.Set(ctx, &kvv1.SetRequest{Key: "b", Value: value, Ttl: durationpb.New(time.Minute)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expireAt, ok, _ := store.ExpireTime("b")
+	if !ok || expireAt.IsZero() {
+		t.Fatalf("expected b to expire, got %v %v", expireAt, ok)
+	}
+
+	if _, err := client.Delete(ctx, &kvv1.DeleteRequest{Key: "a"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Get(ctx, &kvv1.GetRequest{Key: "a"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := t.Context()
+
+	calls := []func() error{
+		func() error { _, err := client.Get(ctx, &kvv1.GetRequest{}); return err },
+		func() error { _, err := client.Set(ctx, &kvv1.SetRequest{}); return err },
+		func() error {
+			_, err := client.Set(ctx, &kvv1.SetRequest{Key: "a", Ttl: durationpb.New(-time.Second)})
+			return err
+		},
+		func() error {
+			_, err := client.BatchSet(ctx, &kvv1.BatchSetRequest{Entries: []*kvv1.SetRequest{{Key: "a"}, {}}})
+			return err
+		},
+	}
+	for i, call := range calls {
+		if err := call(); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("call %d: expected InvalidArgument, got %v", i, err)
+		}
+	}
+	if _, err := client.Get(ctx, &kvv1.GetRequest{Key: "a"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected invalid batch not to write anything, got %v", err)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := t.Context()
+
+	_, err := client.BatchSet(ctx, &kvv1.BatchSetRequest{Entries: []*kvv1.SetRequest{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "c", Value: []byte("3")},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.BatchDelete(ctx, &kvv1.BatchDeleteRequest{Keys: []string{"b"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, err := client.BatchGet(ctx, &kvv1.BatchGetRequest{Keys: []string{"c", "b", "a"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries := resp.GetEntries()
+	if len(entries) != 2 || entries[0].GetKey() != "c" || entries[1].GetKey() != "a" {
+		t.Fatalf("expected entries c and a, got %v", entries)
+	}
+}
+
+func TestScan(t *testing.T) {
+	client, store := newTestClient(t)
+
+	for _, key := range []string{"user:2", "user:1", "user:3", "order:1"} {
+		store.Set(key, []byte(key))
+	}
+
+	stream, err := client.Scan(t.Context(), &kvv1.ScanRequest{Prefix: "user:", PageSize: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var pages [][]string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var keys []string
+		for _, entry := range resp.GetEntries() {
+			if string(entry.GetValue()) != entry.GetKey() {
+				t.Fatalf("unexpected value %q for %q", entry.GetValue(), entry.GetKey())
+			}
+			keys = append(keys, entry.GetKey())
+		}
+		pages = append(pages, keys)
+	}
+	if len(pages) != 2 || len(pages[0]) != 2 || pages[0][0] != "user:1" || pages[1][0] != "user:3" {
+		t.Fatalf("unexpected pages %v", pages)
+	}
+}
+
+func TestScanPageSizeLimit(t *testing.T) {
+	client, store := newTestClient(t)
+	for i := range maxPageSize + 5 {
+		store.Set(fmt.Sprintf("k%04d", i), []byte("v"))
+	}
+
+	stream, err := client.Scan(t.Context(), &kvv1.ScanRequest{PageSize: 1 << 30})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var sizes []int
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sizes = append(sizes, len(resp.GetEntries()))
+	}
+	if len(sizes) != 2 || sizes[0] != maxPageSize || sizes[1] != 5 {
+		t.Fatalf("expected pages of %d and 5 entries, got %v", maxPageSize, sizes)
+	}
+}
+
+func TestTypedKeys(t *testing.T) {
+	client, store := newTestClient(t)
+	store.Set("user:1", []byte("user:1"))
+	store.Set("user:3", []byte("user:3"))
+	hash := storage.EncodeHash(map[string][]byte{"f": []byte("v")})
+	if err := store.SetMulti([]string{"user:2"}, []storage.Entry{{Value: hash, Kind: storage.KindHash}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stream, err := client.Scan(t.Context(), &kvv1.ScanRequest{Prefix: "user:", PageSize: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var keys []string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, entry := range resp.GetEntries() {
+			keys = append(keys, entry.GetKey())
+		}
+	}
+	if len(keys) != 2 || keys[0] != "user:1" || keys[1] != "user:3" {
+		t.Fatalf("expected the hash to be skipped, got %v", keys)
+	}
+
+	_, err = client.BatchGet(t.Context(), &kvv1.BatchGetRequest{Keys: []string{"user:1", "user:2"}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected %v, got %v", codes.FailedPrecondition, err)
+	}
+}
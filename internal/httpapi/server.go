@@ -0,0 +1,172 @@
+// Package httpapi serves the storage over HTTP for clients that cannot
+// speak the TCP protocols.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// shutdownTimeout bounds how long Start waits for requests in flight
+// once the context is done.
+const shutdownTimeout = 5 * time.Second
+
+// Server exposes GET, HEAD, PUT and DELETE on /v1/keys/{key}. Values are
+// raw request and response bodies. The content type of a PUT is stored in
+// an envelope in front of the body, see wrap, and served back by GET;
+// values without one are served as application/octet-stream.
+type Server struct {
+	addr    string
+	storage storage.Storage
+	ready   chan string
+}
+
+func NewServer(addr string, storage storage.Storage) *Server {
+	return &Server{
+		addr:    addr,
+		storage: storage,
+		ready:   make(chan string, 1),
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// GET also serves HEAD; net/http drops the body.
+	mux.HandleFunc("GET /v1/keys/{key...}", s.get)
+	mux.HandleFunc("PUT /v1/keys/{key...}", s.put)
+	mux.HandleFunc("DELETE /v1/keys/{key...}", s.delete)
+	return mux
+}
+
+// Start serves HTTP until ctx is done, then shuts down gracefully.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.ready <- listener.Addr().String()
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("http server shutdown error: %v", err)
+		}
+	}()
+
+	log.Printf("http server started on port %s", s.addr)
+	if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	value, err := s.storage.Get(r.PathValue("key"))
+	if errors.Is(err, storage.ErrWrongType) {
+		writeError(w, http.StatusConflict, "key holds a value of another type")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if value == nil {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	contentType, value := unwrap(value)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Write(value)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxArgSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		value = wrap(contentType, value)
+	}
+	if err := s.storage.Set(r.PathValue("key"), value); err != nil {
+		if errors.Is(err, storage.ErrOutOfMemory) {
+			writeError(w, http.StatusInsufficientStorage, "out of memory")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.Delete(r.PathValue("key")); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// envelopeMagic starts a value stored together with its content type.
+// The other protocols see the envelope as part of the value.
+const envelopeMagic = "\x00kv-http\x00"
+
+// wrap returns body preceded by envelopeMagic and contentType as a
+// uvarint length and the bytes.
+func wrap(contentType string, body []byte) []byte {
+	buf := make([]byte, 0, len(envelopeMagic)+binary.MaxVarintLen64+len(contentType)+len(body))
+	buf = append(buf, envelopeMagic...)
+	buf = binary.AppendUvarint(buf, uint64(len(contentType)))
+	buf = append(buf, contentType...)
+	return append(buf, body...)
+}
+
+// unwrap returns the content type and body of a value stored by wrap, or
+// an empty content type and the value itself for any other value.
+func unwrap(value []byte) (string, []byte) {
+	rest, ok := bytes.CutPrefix(value, []byte(envelopeMagic))
+	if !ok {
+		return "", value
+	}
+	n, size := binary.Uvarint(rest)
+	if size <= 0 || n > uint64(len(rest)-size) {
+		return "", value
+	}
+	rest = rest[size:]
+	return string(rest[:n]), rest[n:]
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
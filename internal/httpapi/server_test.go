@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func newTestServer() (*httptest.Server, storage.Storage) {
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	return httptest.NewServer(NewServer(":0", store).Handler()), store
+}
+
+func do(t *testing.T, method, url, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resp, string(data)
+}
+
+func TestKeys(t *testing.T) {
+	srv, store := newTestServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/keys/dir/some%20key"
+
+	resp, body := do(t, http.MethodGet, url, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+	if body != "{\"error\":\"key not found\"}\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	resp, _ = do(t, http.MethodHead, url, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+
+	value := "hello world\n\x00"
+	resp, _ = do(t, http.MethodPut, url, value)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if stored, _ := store.Get("dir/some key"); string(stored) != value {
+		t.Fatalf("expected %q to be stored, got %q", value, stored)
+	}
+
+	resp, body = do(t, http.MethodGet, url, "")
+	if resp.StatusCode != http.StatusOK || body != value {
+		t.Fatalf("expected 200 %q, got %d %q", value, resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	resp, body = do(t, http.MethodHead, url, "")
+	if resp.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("expected 200 without body, got %d %q", resp.StatusCode, body)
+	}
+	if resp.ContentLength != int64(len(value)) {
+		t.Fatalf("expected content length %d, got %d", len(value), resp.ContentLength)
+	}
+
+	resp, _ = do(t, http.MethodDelete, url, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp, _ = do(t, http.MethodGet, url, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(t, http.MethodPost, url, "")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	srv, store := newTestServer()
+	defer srv.Close()
+	url := srv.URL + "/v1/keys/doc"
+
+	value := `{"a":1}`
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, url, strings.NewReader(value))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	resp, body := do(t, http.MethodGet, url, "")
+	if resp.StatusCode != http.StatusOK || body != value {
+		t.Fatalf("expected 200 %q, got %d %q", value, resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected application/json, got %q", ct)
+	}
+	resp, _ = do(t, http.MethodHead, url, "")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected application/json, got %q", ct)
+	}
+	if resp.ContentLength != int64(len(value)) {
+		t.Fatalf("expected content length %d, got %d", len(value), resp.ContentLength)
+	}
+
+	// A value written by another protocol is served as is.
+	store.Set("doc", []byte(value))
+	resp, body = do(t, http.MethodGet, url, "")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" || body != value {
+		t.Fatalf("expected %q as application/octet-stream, got %q as %q", value, body, ct)
+	}
+}
@@ -0,0 +1,111 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// Binary COPY format, see
+// https://www.postgresql.org/docs/current/sql-copy.html#id-1.9.3.55.9.4
+var copySignature = []byte("PGCOPY\n\377\r\n\x00")
+
+// postgresEpoch is the origin of binary timestamptz values, which are
+// microseconds since 2000-01-01 UTC.
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var errCopyFormat = errors.New("unexpected binary copy format")
+
+// readCopyEntries decodes the output of
+// COPY (SELECT key, value, expire_at, kind ...) TO STDOUT (FORMAT binary)
+// and passes every row to fn. Rows without kind hold strings.
+func readCopyEntries(r io.Reader, fn func(key string, entry storage.Entry) error) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	header := make([]byte, len(copySignature)+8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("%w: %v", errCopyFormat, err)
+	}
+	if !bytes.Equal(header[:len(copySignature)], copySignature) {
+		return fmt.Errorf("%w: bad signature", errCopyFormat)
+	}
+	extension := binary.BigEndian.Uint32(header[len(copySignature)+4:])
+	if _, err := reader.Discard(int(extension)); err != nil {
+		return fmt.Errorf("%w: %v", errCopyFormat, err)
+	}
+
+	var buf [4]byte
+	for {
+		if _, err := io.ReadFull(reader, buf[:2]); err != nil {
+			return fmt.Errorf("%w: %v", errCopyFormat, err)
+		}
+		fields := int16(binary.BigEndian.Uint16(buf[:2]))
+		if fields == -1 {
+			return nil
+		}
+		if fields != 3 && fields != 4 {
+			return fmt.Errorf("%w: expected 4 fields, got %d", errCopyFormat, fields)
+		}
+
+		key, err := readCopyField(reader, buf[:])
+		if err != nil {
+			return err
+		}
+		value, err := readCopyField(reader, buf[:])
+		if err != nil {
+			return err
+		}
+		expireAt, err := readCopyField(reader, buf[:])
+		if err != nil {
+			return err
+		}
+
+		entry := storage.Entry{Value: value}
+		if fields == 4 {
+			kind, err := readCopyField(reader, buf[:])
+			if err != nil {
+				return err
+			}
+			if len(kind) != 2 || binary.BigEndian.Uint16(kind) > uint16(storage.KindZSet) {
+				return fmt.Errorf("%w: bad kind", errCopyFormat)
+			}
+			entry.Kind = storage.Kind(binary.BigEndian.Uint16(kind))
+		}
+		if expireAt != nil {
+			if len(expireAt) != 8 {
+				return fmt.Errorf("%w: bad timestamptz length %d", errCopyFormat, len(expireAt))
+			}
+			micros := int64(binary.BigEndian.Uint64(expireAt))
+			entry.ExpireAt = postgresEpoch.Add(time.Duration(micros) * time.Microsecond)
+		}
+		if err := fn(string(key), entry); err != nil {
+			return err
+		}
+	}
+}
+
+// readCopyField reads one length-prefixed field. A NULL field is
+// returned as nil, an empty one as an empty non-nil slice.
+func readCopyField(reader *bufio.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(reader, buf[:4]); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCopyFormat, err)
+	}
+	length := int32(binary.BigEndian.Uint32(buf[:4]))
+	if length == -1 {
+		return nil, nil
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("%w: bad field length %d", errCopyFormat, length)
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCopyFormat, err)
+	}
+	return field, nil
+}
@@ -0,0 +1,96 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func copyField(buf *bytes.Buffer, field []byte) {
+	if field == nil {
+		binary.Write(buf, binary.BigEndian, int32(-1))
+		return
+	}
+	binary.Write(buf, binary.BigEndian, int32(len(field)))
+	buf.Write(field)
+}
+
+func copyStream(rows [][][]byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(copySignature)
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	for _, row := range rows {
+		binary.Write(buf, binary.BigEndian, int16(len(row)))
+		for _, field := range row {
+			copyField(buf, field)
+		}
+	}
+	binary.Write(buf, binary.BigEndian, int16(-1))
+	return buf.Bytes()
+}
+
+func TestReadCopyEntries(t *testing.T) {
+	expireAt := time.Date(2030, 1, 2, 3, 4, 5, 6000, time.UTC)
+	micros := make([]byte, 8)
+	binary.BigEndian.PutUint64(micros, uint64(expireAt.Sub(postgresEpoch).Microseconds()))
+
+	stream := copyStream([][][]byte{
+		{[]byte("a"), []byte("1"), nil},
+		{[]byte("b"), []byte{}, micros},
+		{[]byte("h"), storage.EncodeHash(map[string][]byte{"f": []byte("v")}), nil, {0, byte(storage.KindHash)}},
+	})
+
+	got := make(map[string]storage.Entry)
+	err := readCopyEntries(bytes.NewReader(stream), func(key string, entry storage.Entry) error {
+		got[key] = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(got))
+	}
+	if string(got["a"].Value) != "1" || !got["a"].ExpireAt.IsZero() {
+		t.Fatalf("unexpected entry a: %v", got["a"])
+	}
+	if len(got["b"].Value) != 0 || !got["b"].ExpireAt.Equal(expireAt) {
+		t.Fatalf("unexpected entry b: %v", got["b"])
+	}
+	if got["a"].Kind != storage.KindString || got["h"].Kind != storage.KindHash {
+		t.Fatalf("unexpected kinds: %v, %v", got["a"].Kind, got["h"].Kind)
+	}
+}
+
+func TestReadCopyEntriesTruncated(t *testing.T) {
+	stream := copyStream([][][]byte{
+		{[]byte("a"), []byte("1"), nil},
+	})
+
+	err := readCopyEntries(bytes.NewReader(stream[:len(stream)-4]), func(string, storage.Entry) error {
+		return nil
+	})
+	if !errors.Is(err, errCopyFormat) {
+		t.Fatalf("expected %v, got %v", errCopyFormat, err)
+	}
+}
+
+func TestReadCopyEntriesCallbackError(t *testing.T) {
+	stream := copyStream([][][]byte{
+		{[]byte("a"), []byte("1"), nil},
+	})
+
+	stop := errors.New("stop")
+	err := readCopyEntries(bytes.NewReader(stream), func(string, storage.Entry) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("expected %v, got %v", stop, err)
+	}
+}
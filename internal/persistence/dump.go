@@ -0,0 +1,37 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"os"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// WriteDump writes entries to a local snapshot file. It is the last
+// resort when the snapshot cannot be saved to the database at shutdown.
+func WriteDump(path string, entries iter.Seq2[string, storage.Entry]) error {
+	return NewFileSnapshotRepository(path).Save(context.Background(), entries)
+}
+
+// ReadDump passes the entries of the dump at path to fn. It reports
+// false if there is no dump.
+func ReadDump(path string, fn func(key string, entry storage.Entry) error) (bool, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err := NewFileSnapshotRepository(path).LoadInto(context.Background(), fn); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoveDump deletes the dump once its contents are saved elsewhere.
+func RemoveDump(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package persistence
+
+import (
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.dump")
+	expireAt := time.Now().Add(time.Hour)
+
+	data := map[string]storage.Entry{
+		"a": {Value: []byte("1")},
+		"b": {Value: []byte("2"), ExpireAt: expireAt},
+	}
+	if err := WriteDump(path, maps.All(data)); err != nil {
+		t.Fatalf("write dump error: %v", err)
+	}
+
+	got := make(map[string]storage.Entry)
+	ok, err := ReadDump(path, func(key string, entry storage.Entry) error {
+		got[key] = entry
+		return nil
+	})
+	if err != nil || !ok {
+		t.Fatalf("expected dump to be read, got %v, %v", ok, err)
+	}
+	if len(got) != 2 || string(got["a"].Value) != "1" || !got["b"].ExpireAt.Equal(expireAt) {
+		t.Fatalf("unexpected dump contents: %v", got)
+	}
+
+	if err := RemoveDump(path); err != nil {
+		t.Fatalf("remove dump error: %v", err)
+	}
+	ok, err = ReadDump(path, func(string, storage.Entry) error { return nil })
+	if err != nil || ok {
+		t.Fatalf("expected no dump, got %v, %v", ok, err)
+	}
+	if err := RemoveDump(path); err != nil {
+		t.Fatalf("remove missing dump error: %v", err)
+	}
+}
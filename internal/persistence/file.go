@@ -0,0 +1,338 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// Snapshot file layout, all integers big-endian:
+//
+//	header:  magic "KVSNAP" | version uint16
+//	block:   payload length uint32 (> 0) | record count uint32 | payload | CRC32(payload) uint32
+//	trailer: 0 uint32 | total record count uint64 | CRC32 of every preceding byte uint32
+//
+// A record inside a block payload is
+//
+//	key length uvarint | key | value length uvarint | value | expiry varint | kind byte
+//
+// where expiry is in Unix nanoseconds and 0 means no expiry. Version 1
+// files, which hold only strings, have no kind byte.
+const (
+	fileMagic   = "KVSNAP"
+	fileVersion = 2
+
+	// fileBlockSize is the payload size after which a block is flushed.
+	fileBlockSize = 64 * 1024
+	// maxFileBlockSize guards Load against huge allocations caused by a
+	// corrupted length field.
+	maxFileBlockSize = 1 << 30
+)
+
+var ErrCorruptSnapshot = errors.New("corrupt snapshot file")
+
+// FileSnapshotRepository stores snapshots in a local file. Saves write a
+// temporary file and atomically rename it over the previous snapshot.
+type FileSnapshotRepository struct {
+	path string
+}
+
+func NewFileSnapshotRepository(path string) *FileSnapshotRepository {
+	return &FileSnapshotRepository{
+		path: path,
+	}
+}
+
+// Save writes entries to a temporary file as they are read and renames it
+// over the previous snapshot once complete.
+func (r *FileSnapshotRepository) Save(
+	ctx context.Context,
+	entries iter.Seq2[string, storage.Entry],
+) error {
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeSnapshotFile(ctx, tmp, entries)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(r.path))
+}
+
+// LoadInto streams the entries of the snapshot file to fn. A missing file
+// is an empty snapshot. Every block is verified before its entries are
+// passed on, but a corruption found later in the file is only reported
+// after the entries of the preceding blocks were delivered.
+func (r *FileSnapshotRepository) LoadInto(
+	ctx context.Context,
+	fn func(key string, entry storage.Entry) error,
+) error {
+	file, err := os.Open(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := readSnapshotFile(ctx, file, fn); err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+	return nil
+}
+
+func writeSnapshotFile(ctx context.Context, w io.Writer, entries iter.Seq2[string, storage.Entry]) error {
+	sum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(w, sum))
+
+	header := make([]byte, 0, len(fileMagic)+2)
+	header = append(header, fileMagic...)
+	header = binary.BigEndian.AppendUint16(header, fileVersion)
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	block := make([]byte, 0, fileBlockSize)
+	var blockRecords uint32
+	var total uint64
+	flush := func() error {
+		if blockRecords == 0 {
+			return nil
+		}
+		var buf []byte
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(block)))
+		buf = binary.BigEndian.AppendUint32(buf, blockRecords)
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+		if _, err := writer.Write(block); err != nil {
+			return err
+		}
+		if _, err := writer.Write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(block))); err != nil {
+			return err
+		}
+		block = block[:0]
+		blockRecords = 0
+		return ctx.Err()
+	}
+
+	for key, entry := range entries {
+		block = binary.AppendUvarint(block, uint64(len(key)))
+		block = append(block, key...)
+		block = binary.AppendUvarint(block, uint64(len(entry.Value)))
+		block = append(block, entry.Value...)
+		var expireAt int64
+		if !entry.ExpireAt.IsZero() {
+			expireAt = entry.ExpireAt.UnixNano()
+		}
+		block = binary.AppendVarint(block, expireAt)
+		block = append(block, byte(entry.Kind))
+		blockRecords++
+		total++
+
+		if len(block) >= fileBlockSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	var trailer []byte
+	trailer = binary.BigEndian.AppendUint32(trailer, 0)
+	trailer = binary.BigEndian.AppendUint64(trailer, total)
+	if _, err := writer.Write(trailer); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, sum.Sum32()))
+	return err
+}
+
+func readSnapshotFile(
+	ctx context.Context,
+	r io.Reader,
+	fn func(key string, entry storage.Entry) error,
+) error {
+	sum := crc32.NewIEEE()
+	reader := &checksumReader{r: bufio.NewReader(r), sum: sum}
+
+	header := make([]byte, len(fileMagic)+2)
+	if err := readFull(reader, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(fileMagic)], []byte(fileMagic)) {
+		return fmt.Errorf("%w: not a snapshot file", ErrCorruptSnapshot)
+	}
+	version := binary.BigEndian.Uint16(header[len(fileMagic):])
+	if version != 1 && version != fileVersion {
+		return fmt.Errorf("unsupported snapshot file version %d", version)
+	}
+
+	var buf [12]byte
+	var total uint64
+	for {
+		if err := readFull(reader, buf[:4]); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(buf[:4])
+		if length == 0 {
+			break
+		}
+		if length > maxFileBlockSize {
+			return fmt.Errorf("%w: block of %d bytes", ErrCorruptSnapshot, length)
+		}
+		if err := readFull(reader, buf[:4]); err != nil {
+			return err
+		}
+		count := binary.BigEndian.Uint32(buf[:4])
+
+		block := make([]byte, length)
+		if err := readFull(reader, block); err != nil {
+			return err
+		}
+		if err := readFull(reader, buf[:4]); err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(block) != binary.BigEndian.Uint32(buf[:4]) {
+			return fmt.Errorf("%w: block checksum mismatch", ErrCorruptSnapshot)
+		}
+		if err := decodeFileBlock(block, count, version, fn); err != nil {
+			return err
+		}
+		total += uint64(count)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := readFull(reader, buf[:8]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(buf[:8]) != total {
+		return fmt.Errorf("%w: record count mismatch", ErrCorruptSnapshot)
+	}
+	expected := sum.Sum32()
+	reader.sum = nil
+	if err := readFull(reader, buf[:4]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf[:4]) != expected {
+		return fmt.Errorf("%w: file checksum mismatch", ErrCorruptSnapshot)
+	}
+	if _, err := reader.Read(buf[:1]); err != io.EOF {
+		return fmt.Errorf("%w: trailing data", ErrCorruptSnapshot)
+	}
+	return nil
+}
+
+func decodeFileBlock(block []byte, count uint32, version uint16, fn func(key string, entry storage.Entry) error) error {
+	for range count {
+		key, rest, err := readFileBytes(block)
+		if err != nil {
+			return err
+		}
+		value, rest, err := readFileBytes(rest)
+		if err != nil {
+			return err
+		}
+		expireAt, n := binary.Varint(rest)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad record", ErrCorruptSnapshot)
+		}
+		block = rest[n:]
+		var kind storage.Kind
+		if version > 1 {
+			if len(block) == 0 || !storage.Kind(block[0]).Valid() {
+				return fmt.Errorf("%w: bad record", ErrCorruptSnapshot)
+			}
+			kind = storage.Kind(block[0])
+			block = block[1:]
+		}
+
+		// The value is copied so that a long-lived entry does not pin the
+		// whole block in memory.
+		entry := storage.Entry{Value: bytes.Clone(value), Kind: kind}
+		if expireAt != 0 {
+			entry.ExpireAt = time.Unix(0, expireAt)
+		}
+		if err := fn(string(key), entry); err != nil {
+			return err
+		}
+	}
+	if len(block) != 0 {
+		return fmt.Errorf("%w: record count mismatch", ErrCorruptSnapshot)
+	}
+	return nil
+}
+
+func readFileBytes(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, fmt.Errorf("%w: bad record", ErrCorruptSnapshot)
+	}
+	buf = buf[size:]
+	return buf[:n:n], buf[n:], nil
+}
+
+func readFull(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: unexpected end of file", ErrCorruptSnapshot)
+		}
+		return err
+	}
+	return nil
+}
+
+// checksumReader feeds everything it reads into sum, unless sum is nil.
+type checksumReader struct {
+	r   io.Reader
+	sum hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.sum != nil {
+		c.sum.Write(p[:n])
+	}
+	return n, err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
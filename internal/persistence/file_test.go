@@ -0,0 +1,182 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func newTestFileRepository(t *testing.T) (*FileSnapshotRepository, string) {
+	path := filepath.Join(t.TempDir(), "kv.snapshot")
+	return NewFileSnapshotRepository(path), path
+}
+
+func TestFileSnapshotRoundTrip(t *testing.T) {
+	repo, _ := newTestFileRepository(t)
+	expireAt := time.Now().Add(time.Hour)
+
+	data := map[string]storage.Entry{
+		"a":     {Value: []byte("1")},
+		"b":     {Value: []byte("hello\nworld\x00"), ExpireAt: expireAt},
+		"empty": {Value: []byte{}},
+		"list":  {Value: storage.EncodeList([][]byte{[]byte("x")}), Kind: storage.KindList},
+		"zset":  {Value: storage.EncodeZSet([]storage.ZMember{{Member: "m", Score: 1}}), Kind: storage.KindZSet, ExpireAt: expireAt},
+	}
+	// Enough data to span several blocks.
+	for i := range 10000 {
+		data[fmt.Sprintf("key_%d", i)] = storage.Entry{Value: fmt.Appendf(nil, "value_%d", i)}
+	}
+
+	if err := SaveMap(t.Context(), repo, data); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+
+	got, err := LoadMap(t.Context(), repo)
+	if err != nil {
+		t.Fatalf("load snapshot error: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("expected %d keys, got %d", len(data), len(got))
+	}
+	for key, want := range data {
+		g := got[key]
+		if string(g.Value) != string(want.Value) || !g.ExpireAt.Equal(want.ExpireAt) || g.Kind != want.Kind {
+			t.Fatalf("key %q: expected %v, got %v", key, want, g)
+		}
+	}
+}
+
+func TestFileSnapshotStreamsStorage(t *testing.T) {
+	repo, _ := newTestFileRepository(t)
+	source := storage.NewMemoryStorage(nil)
+	for i := range 5000 {
+		source.Set(fmt.Sprintf("key_%d", i), fmt.Appendf(nil, "value_%d", i))
+	}
+
+	view := source.View()
+	defer view.Close()
+	// Writes made while the view is saved are not part of the snapshot.
+	saved := 0
+	entries := func(yield func(string, storage.Entry) bool) {
+		for key, entry := range view.All() {
+			source.Set(key, []byte("changed"))
+			saved++
+			if !yield(key, entry) {
+				return
+			}
+		}
+	}
+	if err := repo.Save(t.Context(), entries); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+
+	target := storage.NewMemoryStorage(nil)
+	if err := repo.LoadInto(t.Context(), target.Restore); err != nil {
+		t.Fatalf("load snapshot error: %v", err)
+	}
+	got := target.Snapshot()
+	if saved != 5000 || len(got) != 5000 || string(got["key_42"].Value) != "value_42" {
+		t.Fatalf("expected the state at the time of the view, got %d keys", len(got))
+	}
+}
+
+func TestFileSnapshotMissingFile(t *testing.T) {
+	repo, _ := newTestFileRepository(t)
+
+	got, err := LoadMap(t.Context(), repo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected empty snapshot, got %v", got)
+	}
+}
+
+func TestFileSnapshotOverwrite(t *testing.T) {
+	repo, path := newTestFileRepository(t)
+
+	if err := SaveMap(t.Context(), repo, map[string]storage.Entry{"a": {Value: []byte("1")}}); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+	if err := SaveMap(t.Context(), repo, map[string]storage.Entry{"b": {Value: []byte("2")}}); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+
+	got, err := LoadMap(t.Context(), repo)
+	if err != nil {
+		t.Fatalf("load snapshot error: %v", err)
+	}
+	if len(got) != 1 || string(got["b"].Value) != "2" {
+		t.Fatalf("expected only key b, got %v", got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("read dir error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, got %d files", len(entries))
+	}
+}
+
+func TestFileSnapshotRejectsCorruption(t *testing.T) {
+	repo, path := newTestFileRepository(t)
+
+	data := map[string]storage.Entry{
+		"a": {Value: []byte("1")},
+		"b": {Value: []byte("2")},
+	}
+	if err := SaveMap(t.Context(), repo, data); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	tests := map[string]func([]byte) []byte{
+		"bad magic":        func(b []byte) []byte { b[0] = 'X'; return b },
+		"block payload":    func(b []byte) []byte { b[20] ^= 0xff; return b },
+		"file checksum":    func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b },
+		"record count":     func(b []byte) []byte { b[len(b)-5] ^= 0xff; return b },
+		"truncated":        func(b []byte) []byte { return b[:len(b)-3] },
+		"trailing data":    func(b []byte) []byte { return append(b, 0) },
+		"empty":            func(b []byte) []byte { return b[:0] },
+		"truncated header": func(b []byte) []byte { return b[:4] },
+	}
+	for name, corrupt := range tests {
+		b := corrupt(append([]byte(nil), valid...))
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		_, err := LoadMap(t.Context(), repo)
+		if !errors.Is(err, ErrCorruptSnapshot) {
+			t.Fatalf("%s: expected %v, got %v", name, ErrCorruptSnapshot, err)
+		}
+	}
+}
+
+func TestFileSnapshotUnsupportedVersion(t *testing.T) {
+	repo, path := newTestFileRepository(t)
+
+	if err := SaveMap(t.Context(), repo, map[string]storage.Entry{"a": {Value: []byte("1")}}); err != nil {
+		t.Fatalf("snapshot save error: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	b[len(fileMagic)+1] = 99
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	if _, err := LoadMap(t.Context(), repo); err == nil {
+		t.Fatalf("expected error for unsupported version")
+	}
+}
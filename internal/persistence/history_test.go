@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func TestRetentionKeeps(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		retention Retention
+		i         int
+		age       time.Duration
+		want      bool
+	}{
+		{Retention{}, 100, 365 * day, true},
+		{Retention{Keep: 3}, 0, 365 * day, true},
+		{Retention{Keep: 3}, 2, 365 * day, true},
+		{Retention{Keep: 3}, 3, time.Minute, false},
+		{Retention{MaxAge: 7 * day}, 10, 6 * day, true},
+		{Retention{MaxAge: 7 * day}, 1, 8 * day, false},
+		{Retention{Keep: 3, MaxAge: 7 * day}, 5, 6 * day, true},
+		{Retention{Keep: 3, MaxAge: 7 * day}, 1, 8 * day, true},
+		{Retention{Keep: 3, MaxAge: 7 * day}, 5, 8 * day, false},
+	}
+	for _, tt := range tests {
+		if got := tt.retention.keeps(tt.i, tt.age); got != tt.want {
+			t.Fatalf("%+v keeps(%d, %v): expected %v, got %v", tt.retention, tt.i, tt.age, tt.want, got)
+		}
+	}
+}
+
+func TestEntryChecksum(t *testing.T) {
+	expireAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := map[string]storage.Entry{
+		"a": {Value: []byte("1")},
+		"b": {Value: []byte("2"), ExpireAt: expireAt},
+	}
+	var sum uint64
+	for key, entry := range entries {
+		sum += entryChecksum(key, entry)
+	}
+
+	// The checksum must match what is read back from PostgreSQL, which
+	// keeps only microseconds.
+	truncated := storage.Entry{Value: []byte("2"), ExpireAt: expireAt.Add(999 * time.Nanosecond)}
+	if entryChecksum("b", truncated) != entryChecksum("b", entries["b"]) {
+		t.Fatalf("expected nanoseconds to be ignored")
+	}
+
+	// An incremental update gives the same checksum as a full recompute.
+	updated := sum - entryChecksum("a", entries["a"]) + entryChecksum("a", storage.Entry{Value: []byte("3")})
+	want := entryChecksum("a", storage.Entry{Value: []byte("3")}) + entryChecksum("b", entries["b"])
+	if updated != want {
+		t.Fatalf("expected %x, got %x", want, updated)
+	}
+
+	if entryChecksum("ab", storage.Entry{Value: []byte("c")}) == entryChecksum("a", storage.Entry{Value: []byte("bc")}) {
+		t.Fatalf("expected key and value boundaries to change the checksum")
+	}
+}
@@ -2,102 +2,378 @@ package persistence
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"time"
 
+	"github.com/aptolon/kv-store/internal/storage"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+const deltaBatchSize = 10000
+
+// PostgresSnapshotRepository stores snapshots in a PostgreSQL table.
+// Operations that fail with a transient error, such as a lost connection
+// during a database restart, are retried with backoff.
+//
+// Every full save creates a new generation and keeps the previous ones,
+// subject to the retention policy, in tables named name_<id>. The catalog
+// of generations is the name_generations table. Incremental saves update
+// the current generation in place.
 type PostgresSnapshotRepository struct {
-	conn *pgx.Conn
-	name string
+	pool      *pgxpool.Pool
+	name      string
+	retention Retention
 }
 
-func NewPostgresSnapshotRepository(conn *pgx.Conn, name string) *PostgresSnapshotRepository {
+func NewPostgresSnapshotRepository(pool *pgxpool.Pool, name string) *PostgresSnapshotRepository {
 	return &PostgresSnapshotRepository{
-		conn: conn,
+		pool: pool,
 		name: name,
 	}
 }
 
+// Save stores entries as a new generation. The rows are streamed
+// with COPY into a staging table, which then atomically takes the place of
+// the snapshot table, so readers never observe a partially written
+// snapshot. The previous generation is kept unless the retention policy
+// drops it. A retry reads entries again.
 func (r *PostgresSnapshotRepository) Save(
 	ctx context.Context,
-	data map[string][]byte,
+	entries iter.Seq2[string, storage.Entry],
+) error {
+	return withRetry(ctx, "snapshot save", func(ctx context.Context) error {
+		return r.save(ctx, entries)
+	})
+}
+
+func (r *PostgresSnapshotRepository) save(
+	ctx context.Context,
+	entries iter.Seq2[string, storage.Entry],
 ) error {
-	tx, err := r.conn.Begin(ctx)
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, fmt.Sprintf(`DELETE FROM %s`, r.name))
+	staging := r.name + "_staging"
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+	DROP TABLE IF EXISTS %[1]s;
+	CREATE TABLE %[1]s (
+		key TEXT NOT NULL,
+		value BYTEA NOT NULL,
+		expire_at TIMESTAMPTZ,
+		kind SMALLINT NOT NULL DEFAULT 0
+	);
+	`, staging))
 	if err != nil {
 		return err
 	}
 
-	for key, value := range data {
-		_, err := tx.Exec(
-			ctx,
-			fmt.Sprintf(`INSERT INTO %s (key, value) VALUES ($1, $2)`, r.name),
-			key,
-			value,
-		)
-		if err != nil {
-			return err
-		}
+	next, stop := iter.Pull2(entries)
+	defer stop()
+	var checksum uint64
+	var count int64
+	_, err = tx.CopyFrom(
+		ctx,
+		pgx.Identifier{staging},
+		[]string{"key", "value", "expire_at", "kind"},
+		pgx.CopyFromFunc(func() ([]any, error) {
+			key, entry, ok := next()
+			if !ok {
+				return nil, nil
+			}
+			checksum += entryChecksum(key, entry)
+			count++
+			return []any{key, entry.Value, nullableTime(entry.ExpireAt), int16(entry.Kind)}, nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	// The primary key is built after the bulk load, which is much faster
+	// than maintaining it row by row.
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+	ALTER TABLE %[1]s ADD CONSTRAINT %[1]s_pkey PRIMARY KEY (key);
+	`, staging))
+	if err != nil {
+		return err
+	}
+
+	var previous *int64
+	err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT max(id) FROM %s`, r.generations())).Scan(&previous)
+	if err != nil {
+		return err
+	}
+	// A snapshot table without a generation predates the history and is
+	// replaced.
+	retire := fmt.Sprintf(`DROP TABLE %s;`, r.name)
+	if previous != nil {
+		retire = fmt.Sprintf(`
+		ALTER TABLE %[1]s RENAME TO %[2]s;
+		ALTER TABLE %[2]s RENAME CONSTRAINT %[1]s_pkey TO %[2]s_pkey;
+		`, r.name, r.generationTable(*previous))
+	}
+	_, err = tx.Exec(ctx, retire+fmt.Sprintf(`
+	ALTER TABLE %[1]s RENAME TO %[2]s;
+	ALTER TABLE %[2]s RENAME CONSTRAINT %[1]s_pkey TO %[2]s_pkey;
+	`, staging, r.name))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+	INSERT INTO %s (created_at, key_count, checksum) VALUES (now(), $1, $2)
+	`, r.generations()), count, int64(checksum))
+	if err != nil {
+		return err
+	}
+	if err := r.applyRetention(ctx, tx); err != nil {
+		return err
 	}
 
 	return tx.Commit(ctx)
 }
 
-func (r *PostgresSnapshotRepository) Load(
+// SaveDelta applies the changes since the previous save. Upserts and
+// deletes are sent in batches of deltaBatchSize keys.
+func (r *PostgresSnapshotRepository) SaveDelta(
 	ctx context.Context,
-) (map[string][]byte, error) {
+	delta storage.Delta,
+) error {
+	return withRetry(ctx, "snapshot delta save", func(ctx context.Context) error {
+		return r.saveDelta(ctx, delta)
+	})
+}
 
-	rows, err := r.conn.Query(
-		ctx,
-		fmt.Sprintf(`SELECT key, value FROM %s`, r.name),
-	)
+func (r *PostgresSnapshotRepository) saveDelta(
+	ctx context.Context,
+	delta storage.Delta,
+) error {
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-
-	result := make(map[string][]byte)
+	defer tx.Rollback(ctx)
 
-	for rows.Next() {
+	// The key count and checksum of the current generation are adjusted
+	// by the entries the delta replaces, adds and removes.
+	var generation *SnapshotInfo
+	var info SnapshotInfo
+	var checksum int64
+	err = tx.QueryRow(ctx, fmt.Sprintf(`
+	SELECT id, key_count, checksum FROM %s ORDER BY id DESC LIMIT 1 FOR UPDATE
+	`, r.generations())).Scan(&info.ID, &info.Keys, &checksum)
+	switch {
+	case err == nil:
+		info.Checksum = uint64(checksum)
+		generation = &info
+	case !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+	// forget removes the replaced or deleted rows from the checksum.
+	forget := func(rows pgx.Rows) error {
+		if generation == nil {
+			rows.Close()
+			return rows.Err()
+		}
 		var key string
-		var value []byte
+		var entry storage.Entry
+		var expireAt *time.Time
+		var kind int16
+		_, err := pgx.ForEachRow(rows, []any{&key, &entry.Value, &expireAt, &kind}, func() error {
+			entry.ExpireAt = time.Time{}
+			if expireAt != nil {
+				entry.ExpireAt = *expireAt
+			}
+			entry.Kind = storage.Kind(kind)
+			generation.Keys--
+			generation.Checksum -= entryChecksum(key, entry)
+			return nil
+		})
+		return err
+	}
 
-		if err := rows.Scan(&key, &value); err != nil {
-			return nil, err
+	existing := fmt.Sprintf(`SELECT key, value, expire_at, kind FROM %s WHERE key = ANY($1)`, r.name)
+	upsert := fmt.Sprintf(`
+	INSERT INTO %s (key, value, expire_at, kind)
+	SELECT * FROM unnest($1::text[], $2::bytea[], $3::timestamptz[], $4::smallint[])
+	ON CONFLICT (key) DO UPDATE
+	SET value = EXCLUDED.value, expire_at = EXCLUDED.expire_at, kind = EXCLUDED.kind
+	`, r.name)
+
+	keys := make([]string, 0, min(len(delta.Upserts), deltaBatchSize))
+	values := make([][]byte, 0, cap(keys))
+	expires := make([]*time.Time, 0, cap(keys))
+	kinds := make([]int16, 0, cap(keys))
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if generation != nil {
+			rows, err := tx.Query(ctx, existing, keys)
+			if err != nil {
+				return err
+			}
+			if err := forget(rows); err != nil {
+				return err
+			}
 		}
+		_, err := tx.Exec(ctx, upsert, keys, values, expires, kinds)
+		keys, values, expires, kinds = keys[:0], values[:0], expires[:0], kinds[:0]
+		return err
+	}
+	for key, entry := range delta.Upserts {
+		keys = append(keys, key)
+		values = append(values, entry.Value)
+		expires = append(expires, nullableTime(entry.ExpireAt))
+		kinds = append(kinds, int16(entry.Kind))
+		if generation != nil {
+			generation.Keys++
+			generation.Checksum += entryChecksum(key, entry)
+		}
+		if len(keys) == deltaBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
 
-		v := make([]byte, len(value))
-		copy(v, value)
+	remove := fmt.Sprintf(`DELETE FROM %s WHERE key = ANY($1) RETURNING key, value, expire_at, kind`, r.name)
+	for batch := range slices.Chunk(delta.Deletes, deltaBatchSize) {
+		rows, err := tx.Query(ctx, remove, batch)
+		if err != nil {
+			return err
+		}
+		if err := forget(rows); err != nil {
+			return err
+		}
+	}
 
-		result[key] = v
+	if generation != nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+		UPDATE %s SET key_count = $2, checksum = $3 WHERE id = $1
+		`, r.generations()), generation.ID, generation.Keys, int64(generation.Checksum))
+		if err != nil {
+			return err
+		}
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return tx.Commit(ctx)
+}
+
+// LoadInto streams the stored entries to fn without materializing the
+// whole snapshot. Rows are read with COPY in binary format. If the load is
+// retried after a transient error, fn sees the entries delivered before
+// the failure again.
+func (r *PostgresSnapshotRepository) LoadInto(
+	ctx context.Context,
+	fn func(key string, entry storage.Entry) error,
+) error {
+	return withRetry(ctx, "snapshot load", func(ctx context.Context) error {
+		return r.loadInto(ctx, fmt.Sprintf(`
+		SELECT key, value, expire_at, kind FROM %s
+		WHERE expire_at IS NULL OR expire_at > now()
+		`, r.name), fn)
+	})
+}
+
+// loadInto streams the rows returned by query, which must select key,
+// value, expire_at and kind, to fn.
+func (r *PostgresSnapshotRepository) loadInto(
+	ctx context.Context,
+	query string,
+	fn func(key string, entry storage.Entry) error,
+) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		return err
 	}
+	defer conn.Release()
+
+	reader, writer := io.Pipe()
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Conn().PgConn().CopyTo(ctx, writer,
+			fmt.Sprintf(`COPY (%s) TO STDOUT (FORMAT binary)`, query))
+		writer.CloseWithError(err)
+		copyErr <- err
+	}()
 
-	return result, nil
+	err = readCopyEntries(reader, fn)
+	// Unblock the copy if decoding stopped early.
+	reader.CloseWithError(err)
+	if err := <-copyErr; err != nil {
+		return err
+	}
+	return err
 }
 
-func CreateSnapshotTable(ctx context.Context, conn *pgx.Conn, name string) error {
+func CreateSnapshotTable(ctx context.Context, pool *pgxpool.Pool, name string) error {
 	sqlQuery := fmt.Sprintf(`
-	CREATE TABLE IF NOT EXISTS %s (
+	CREATE TABLE IF NOT EXISTS %[1]s (
 		key TEXT PRIMARY KEY,
-		value BYTEA NOT NULL
+		value BYTEA NOT NULL,
+		expire_at TIMESTAMPTZ,
+		kind SMALLINT NOT NULL DEFAULT 0
+	);
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS expire_at TIMESTAMPTZ;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS kind SMALLINT NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS %[1]s_generations (
+		id BIGSERIAL PRIMARY KEY,
+		created_at TIMESTAMPTZ NOT NULL,
+		key_count BIGINT NOT NULL,
+		checksum BIGINT NOT NULL
 	);
+	-- Generations saved before values had kinds hold only strings.
+	DO $$
+	DECLARE t TEXT;
+	BEGIN
+		FOR t IN SELECT tablename FROM pg_tables
+			WHERE schemaname = current_schema() AND tablename ~ '^%[1]s_[0-9]+$'
+		LOOP
+			EXECUTE format('ALTER TABLE %%I ADD COLUMN IF NOT EXISTS kind SMALLINT NOT NULL DEFAULT 0', t);
+		END LOOP;
+	END $$;
 	`, name)
-	_, err := conn.Exec(ctx, sqlQuery)
+	_, err := pool.Exec(ctx, sqlQuery)
 	return err
 }
 
-func DropSnapshotTable(ctx context.Context, conn *pgx.Conn, name string) error {
-	sqlQuery := fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, name)
-	_, err := conn.Exec(ctx, sqlQuery)
-	return err
+// DropSnapshotTable drops the snapshot table together with its history.
+func DropSnapshotTable(ctx context.Context, pool *pgxpool.Pool, name string) error {
+	rows, err := pool.Query(ctx, `
+	SELECT tablename FROM pg_tables
+	WHERE schemaname = current_schema() AND tablename ~ ('^' || $1 || '_[0-9]+$')
+	`, name)
+	if err != nil {
+		return err
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	tables = append(tables, name, name+"_generations")
+	for _, table := range tables {
+		if _, err := pool.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullableTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
 }
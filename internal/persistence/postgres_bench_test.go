@@ -0,0 +1,70 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/storage"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const benchKeys = 1_000_000
+
+func newBenchRepository(b *testing.B) *PostgresSnapshotRepository {
+	db := os.Getenv("DATABASE_URL")
+	if db == "" {
+		b.Skip("DATABASE_URL not set")
+	}
+	ctx := b.Context()
+
+	pool, err := pgxpool.New(ctx, db)
+	if err != nil {
+		b.Fatalf("postgres connect error: %v", err)
+	}
+	b.Cleanup(pool.Close)
+
+	nameTable := "kv_snapshot_bench"
+	if err := CreateSnapshotTable(ctx, pool, nameTable); err != nil {
+		b.Fatalf("create table error: %v", err)
+	}
+	b.Cleanup(func() { DropSnapshotTable(context.Background(), pool, nameTable) })
+
+	return NewPostgresSnapshotRepository(pool, nameTable)
+}
+
+func benchData() map[string]storage.Entry {
+	data := make(map[string]storage.Entry, benchKeys)
+	for i := range benchKeys {
+		data[fmt.Sprintf("key_%d", i)] = storage.Entry{
+			Value: fmt.Appendf(nil, "value_%d", i),
+		}
+	}
+	return data
+}
+
+func BenchmarkPostgresSave1M(b *testing.B) {
+	repo := newBenchRepository(b)
+	data := benchData()
+
+	for b.Loop() {
+		if err := SaveMap(b.Context(), repo, data); err != nil {
+			b.Fatalf("snapshot save error: %v", err)
+		}
+	}
+}
+
+func BenchmarkPostgresLoad1M(b *testing.B) {
+	repo := newBenchRepository(b)
+	if err := SaveMap(b.Context(), repo, benchData()); err != nil {
+		b.Fatalf("snapshot save error: %v", err)
+	}
+
+	for b.Loop() {
+		store := storage.NewMemoryStorage(nil)
+		if err := repo.LoadInto(b.Context(), store.Restore); err != nil {
+			b.Fatalf("load snapshot error: %v", err)
+		}
+	}
+}
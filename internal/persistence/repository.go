@@ -1,8 +1,67 @@
 package persistence
 
-import "context"
+import (
+	"context"
+	"iter"
+	"maps"
+	"time"
 
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// SnapshotRepository stores the full snapshot of the storage. Entries are
+// streamed both ways, so that the snapshot is never held in memory next to
+// the storage.
 type SnapshotRepository interface {
-	Save(ctx context.Context, data map[string][]byte) error
-	Load(ctx context.Context) (map[string][]byte, error)
+	// Save stores entries as the snapshot, e.g. from a storage.View. It
+	// may read entries more than once if it retries.
+	Save(ctx context.Context, entries iter.Seq2[string, storage.Entry]) error
+	// LoadInto streams the stored entries to fn, e.g.
+	// MemoryStorage.Restore.
+	LoadInto(ctx context.Context, fn func(key string, entry storage.Entry) error) error
+}
+
+// SaveMap saves the entries of data to repo.
+func SaveMap(ctx context.Context, repo SnapshotRepository, data map[string]storage.Entry) error {
+	return repo.Save(ctx, maps.All(data))
+}
+
+// LoadMap loads the snapshot stored in repo into a map.
+func LoadMap(ctx context.Context, repo SnapshotRepository) (map[string]storage.Entry, error) {
+	data := make(map[string]storage.Entry)
+	err := repo.LoadInto(ctx, func(key string, entry storage.Entry) error {
+		data[key] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeltaRepository is implemented by repositories that can apply only the
+// changes since the previous save instead of rewriting the whole snapshot.
+type DeltaRepository interface {
+	SnapshotRepository
+	SaveDelta(ctx context.Context, delta storage.Delta) error
+}
+
+// SnapshotInfo describes one saved generation of the snapshot.
+type SnapshotInfo struct {
+	ID        int64
+	CreatedAt time.Time
+	Keys      int64
+	// Checksum does not depend on the order of the entries, see
+	// entryChecksum.
+	Checksum uint64
+}
+
+// HistoryRepository is implemented by repositories that keep previous
+// generations of the snapshot.
+type HistoryRepository interface {
+	SnapshotRepository
+	// ListSnapshots returns the kept generations, newest first.
+	ListSnapshots(ctx context.Context) ([]SnapshotInfo, error)
+	// LoadSnapshot streams the entries of generation id to fn.
+	LoadSnapshot(ctx context.Context, id int64, fn func(key string, entry storage.Entry) error) error
 }
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	retryAttempts       = 5
+	retryInitialBackoff = 200 * time.Millisecond
+	retryMaxBackoff     = 5 * time.Second
+)
+
+// withRetry runs op until it succeeds, fails with a non-transient error or
+// runs out of attempts, doubling the pause between attempts.
+func withRetry(ctx context.Context, name string, op func(ctx context.Context) error) error {
+	backoff := retryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil || attempt == retryAttempts || !isTransient(err) {
+			return err
+		}
+		log.Printf("%s failed (attempt %d/%d), retrying in %v: %v", name, attempt, retryAttempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
+
+// isTransient reports whether err is worth retrying: the connection was
+// lost or refused, or the server asked to try again.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08: connection exception.
+		return len(pgErr.Code) == 5 && pgErr.Code[:2] == "08"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || pgconn.SafeToRetry(err) || pgconn.Timeout(err)
+}
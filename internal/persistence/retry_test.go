@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: "57P01"}, true},
+		{&pgconn.PgError{Code: "08006"}, true},
+		{fmt.Errorf("query: %w", &pgconn.PgError{Code: "40001"}), true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{&pgconn.PgError{Code: "42P01"}, false},
+		{io.ErrUnexpectedEOF, true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Fatalf("%v: expected %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	attempts := 0
+	err := withRetry(t.Context(), "test", func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWithRetryPermanentError(t *testing.T) {
+	permanent := &pgconn.PgError{Code: "42P01"}
+	attempts := 0
+	err := withRetry(t.Context(), "test", func(ctx context.Context) error {
+		attempts++
+		return permanent
+	})
+	if !errors.Is(err, permanent) {
+		t.Fatalf("expected %v, got %v", permanent, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	attempts := 0
+	err := withRetry(ctx, "test", func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary protocol, all integers big-endian:
+//
+//	request: argument count uint32 | per argument: length uint32 | bytes
+//	reply:   kind byte | payload
+//
+// The reply payload depends on the kind: status, error and value are a
+// length uint32 followed by the bytes, an integer is an int64, null has no
+// payload, and an array is an item count uint32 followed by the items.
+//
+// The first byte of a request is the high byte of the argument count, so
+// it is zero for any realistic request. This is how the server tells a
+// binary connection from a text one.
+const (
+	// MaxArgs limits the number of arguments of a request.
+	MaxArgs = 1 << 20
+	// MaxArgSize limits the length of a single argument or value.
+	MaxArgSize = 512 << 20
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// WriteRequest encodes a command and its arguments.
+func WriteRequest(w *bufio.Writer, args [][]byte) error {
+	writeUint32(w, uint32(len(args)))
+	for _, arg := range args {
+		writeBytes(w, arg)
+	}
+	return w.Flush()
+}
+
+// ReadRequest decodes a command and its arguments. io.EOF is returned
+// only if the connection was closed between requests.
+func ReadRequest(r *bufio.Reader) ([][]byte, error) {
+	count, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > MaxArgs {
+		return nil, fmt.Errorf("%w: %d arguments", ErrProtocol, count)
+	}
+	args := make([][]byte, count)
+	for i := range args {
+		if args[i], err = readBytes(r); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	return args, nil
+}
+
+// WriteReply encodes r. The writer is not flushed, so that pipelined
+// replies can be sent together.
+func WriteReply(w *bufio.Writer, r Reply) error {
+	w.WriteByte(byte(r.Kind))
+	switch r.Kind {
+	case KindStatus, KindError:
+		writeBytes(w, []byte(r.Str))
+	case KindValue:
+		writeBytes(w, r.Value)
+	case KindInteger:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(r.Integer))
+		w.Write(buf[:])
+	case KindNull:
+	case KindArray:
+		writeUint32(w, uint32(len(r.Array)))
+		for _, item := range r.Array {
+			if err := WriteReply(w, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unknown reply kind %q", ErrProtocol, r.Kind)
+	}
+	return nil
+}
+
+// ReadReply decodes a reply written by WriteReply.
+func ReadReply(r *bufio.Reader) (Reply, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return Reply{}, err
+	}
+	reply := Reply{Kind: Kind(kind)}
+	switch reply.Kind {
+	case KindStatus, KindError:
+		str, err := readBytes(r)
+		if err != nil {
+			return Reply{}, unexpectedEOF(err)
+		}
+		reply.Str = string(str)
+	case KindValue:
+		if reply.Value, err = readBytes(r); err != nil {
+			return Reply{}, unexpectedEOF(err)
+		}
+	case KindInteger:
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return Reply{}, unexpectedEOF(err)
+		}
+		reply.Integer = int64(binary.BigEndian.Uint64(buf[:]))
+	case KindNull:
+	case KindArray:
+		count, err := readUint32(r)
+		if err != nil {
+			return Reply{}, unexpectedEOF(err)
+		}
+		if count > MaxArgs {
+			return Reply{}, fmt.Errorf("%w: array of %d items", ErrProtocol, count)
+		}
+		reply.Array = make([]Reply, count)
+		for i := range reply.Array {
+			if reply.Array[i], err = ReadReply(r); err != nil {
+				return Reply{}, unexpectedEOF(err)
+			}
+		}
+	default:
+		return Reply{}, fmt.Errorf("%w: unknown reply kind %q", ErrProtocol, kind)
+	}
+	return reply, nil
+}
+
+func writeUint32(w *bufio.Writer, n uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], n)
+	w.Write(buf[:])
+}
+
+// writeBytes ignores errors: bufio.Writer keeps the first one and returns
+// it from Flush.
+func writeBytes(w *bufio.Writer, b []byte) {
+	writeUint32(w, uint32(len(b)))
+	w.Write(b)
+}
+
+func readUint32(r *bufio.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxArgSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrProtocol, length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// unexpectedEOF reports a connection closed in the middle of a message
+// as io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
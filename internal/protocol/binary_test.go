@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	args := [][]byte{[]byte("SET"), []byte("key with spaces"), {0, '\n', 0xff}, {}}
+
+	var buf bytes.Buffer
+	if err := WriteRequest(bufio.NewWriter(&buf), args); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Fatalf("expected %q, got %q", args, got)
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	replies := []Reply{
+		OK,
+		Error("invalid arguments"),
+		Integer(-2),
+		Value([]byte("hello\nworld\x00")),
+		Null(),
+		Array([]Reply{Value([]byte("a")), Null(), Integer(7)}),
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, r := range replies {
+		if err := WriteReply(w, r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	w.Flush()
+
+	r := bufio.NewReader(&buf)
+	for _, want := range replies {
+		got, err := ReadReply(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+	if _, err := ReadReply(r); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	tests := []struct {
+		input []byte
+		err   error
+	}{
+		{[]byte{}, io.EOF},
+		{[]byte{0, 0}, io.ErrUnexpectedEOF},
+		{[]byte{0, 0, 0, 0}, ErrProtocol},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, ErrProtocol},
+		{[]byte{0, 0, 0, 1, 0, 0, 0, 5, 'a'}, io.ErrUnexpectedEOF},
+		{[]byte{0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff}, ErrProtocol},
+	}
+	for _, tt := range tests {
+		_, err := ReadRequest(bufio.NewReader(bytes.NewReader(tt.input)))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("input %v: expected %v, got %v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		reply Reply
+		text  string
+	}{
+		{OK, "OK"},
+		{Error("invalid arguments"), "ERROR invalid arguments"},
+		{Integer(5), "INTEGER 5"},
+		{Value([]byte("x")), "VALUE x"},
+		{Null(), "NULL"},
+		{Array([]Reply{Value([]byte("a")), Null()}), "ARRAY 2\nVALUE a\nNULL"},
+	}
+	for _, tt := range tests {
+		if got := FormatText(tt.reply); got != tt.text {
+			t.Fatalf("expected %q, got %q", tt.text, got)
+		}
+	}
+}
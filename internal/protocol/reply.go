@@ -0,0 +1,92 @@
+// Package protocol defines the replies of the server and their encodings.
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Kind identifies the type of a reply. The values are also the type
+// bytes of the binary encoding.
+type Kind byte
+
+const (
+	KindStatus  Kind = '+'
+	KindError   Kind = '-'
+	KindInteger Kind = ':'
+	KindValue   Kind = '$'
+	KindNull    Kind = '_'
+	KindArray   Kind = '*'
+)
+
+// Reply is the result of a command, independent of the wire protocol.
+type Reply struct {
+	Kind Kind
+	// Str is the text of a status or the message of an error.
+	Str     string
+	Value   []byte
+	Integer int64
+	Array   []Reply
+	// NullArray marks a null reply that stands for a missing array, which
+	// RESP2 encodes differently from a missing value.
+	NullArray bool
+}
+
+func Status(s string) Reply {
+	return Reply{Kind: KindStatus, Str: s}
+}
+
+func Error(msg string) Reply {
+	return Reply{Kind: KindError, Str: msg}
+}
+
+func Integer(n int64) Reply {
+	return Reply{Kind: KindInteger, Integer: n}
+}
+
+func Value(value []byte) Reply {
+	return Reply{Kind: KindValue, Value: value}
+}
+
+func Null() Reply {
+	return Reply{Kind: KindNull}
+}
+
+// NullArray is the null reply of a command that otherwise replies with an
+// array, such as an aborted EXEC.
+func NullArray() Reply {
+	return Reply{Kind: KindNull, NullArray: true}
+}
+
+func Array(items []Reply) Reply {
+	return Reply{Kind: KindArray, Array: items}
+}
+
+// OK is the status returned by commands that have nothing else to report.
+var OK = Status("OK")
+
+// FormatText encodes r for the text protocol. An array is a header line
+// "ARRAY n" followed by one line per item.
+func FormatText(r Reply) string {
+	switch r.Kind {
+	case KindStatus:
+		return r.Str
+	case KindError:
+		return "ERROR " + r.Str
+	case KindInteger:
+		return "INTEGER " + strconv.FormatInt(r.Integer, 10)
+	case KindValue:
+		return "VALUE " + string(r.Value)
+	case KindNull:
+		return "NULL"
+	case KindArray:
+		lines := make([]string, 0, len(r.Array)+1)
+		lines = append(lines, "ARRAY "+strconv.Itoa(len(r.Array)))
+		for _, item := range r.Array {
+			lines = append(lines, FormatText(item))
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return "ERROR unknown reply"
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+var (
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errNotFloat   = errors.New("value is not a valid float")
+	errOverflow   = errors.New("increment or decrement would overflow")
+	errNaN        = errors.New("increment would produce NaN or Infinity")
+)
+
+// incrBy adds delta to the integer stored at key, treating a missing key
+// as 0, and replies with the new value.
+func (s *Server) incrBy(store storage.Storage, key string, delta int64) protocol.Reply {
+	var result int64
+	_, err := store.Update(key, func(old []byte) ([]byte, error) {
+		var n int64
+		if old != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+				return nil, errNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, errOverflow
+		}
+		result = n + delta
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	if err != nil {
+		return counterError(err)
+	}
+	return protocol.Integer(result)
+}
+
+// incrByFloat adds delta to the number stored at key, treating a missing
+// key as 0, and replies with the new value as a string.
+func (s *Server) incrByFloat(store storage.Storage, key string, delta float64) protocol.Reply {
+	value, err := store.Update(key, func(old []byte) ([]byte, error) {
+		var n float64
+		if old != nil {
+			var err error
+			if n, err = parseFloat(old); err != nil {
+				return nil, err
+			}
+		}
+		result := n + delta
+		if math.IsInf(result, 0) || math.IsNaN(result) {
+			return nil, errNaN
+		}
+		return strconv.AppendFloat(nil, result, 'f', -1, 64), nil
+	})
+	if err != nil {
+		return counterError(err)
+	}
+	return protocol.Value(value)
+}
+
+// parseFloat accepts finite numbers only.
+func parseFloat(b []byte) (float64, error) {
+	n, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, errNotFloat
+	}
+	return n, nil
+}
+
+func counterError(err error) protocol.Reply {
+	switch err {
+	case errNotInteger, errNotFloat, errOverflow, errNaN:
+		return protocol.Error(err.Error())
+	default:
+		return storageError(err)
+	}
+}
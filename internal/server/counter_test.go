@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleCommandCounters(t *testing.T) {
+	s := newTestServer()
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"INCR n", "INTEGER 1"},
+		{"INCRBY n 41", "INTEGER 42"},
+		{"DECR n", "INTEGER 41"},
+		{"DECRBY n 50", "INTEGER -9"},
+		{"GET n", "VALUE -9"},
+		{"SET n 9223372036854775806", "OK"},
+		{"INCR n", "INTEGER 9223372036854775807"},
+		{"INCR n", "ERROR increment or decrement would overflow"},
+		{"GET n", "VALUE 9223372036854775807"},
+		{"DECRBY n -9223372036854775808", "ERROR increment or decrement would overflow"},
+		{"SET m -9223372036854775808", "OK"},
+		{"DECR m", "ERROR increment or decrement would overflow"},
+		{"INCRBY n x", "ERROR value is not an integer or out of range"},
+		{"SET s abc", "OK"},
+		{"INCR s", "ERROR value is not an integer or out of range"},
+		{"INCRBYFLOAT s 1", "ERROR value is not a valid float"},
+		{"GET s", "VALUE abc"},
+		{"SET f 1.5", "OK"},
+		{"INCR f", "ERROR value is not an integer or out of range"},
+		{"INCRBYFLOAT f 0.25", "VALUE 1.75"},
+		{"INCRBYFLOAT f -1.75", "VALUE 0"},
+		{"INCRBYFLOAT g 3", "VALUE 3"},
+		{"INCRBYFLOAT g inf", "ERROR value is not a valid float"},
+		{"SET h 1e308", "OK"},
+		{"INCRBYFLOAT h 1e308", "ERROR increment would produce NaN or Infinity"},
+		{"INCR", "ERROR invalid arguments"},
+		{"INCRBY n", "ERROR invalid arguments"},
+	}
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleCommandIncrKeepsTTL(t *testing.T) {
+	s := newTestServer()
+
+	for _, cmd := range []string{"SET n 1 EX 100", "INCR n"} {
+		if resp := s.handleCommand(cmd); strings.HasPrefix(resp, "ERROR") {
+			t.Fatalf("cmd %q: unexpected %q", cmd, resp)
+		}
+	}
+	if resp := s.handleCommand("TTL n"); resp != "INTEGER 100" {
+		t.Fatalf("expected ttl to be kept, got %q", resp)
+	}
+}
+
+func TestHandleCommandConcurrentIncr(t *testing.T) {
+	s := newTestServer()
+
+	workers, increments := 10, 200
+	wg := &sync.WaitGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				s.handleCommand("INCR counter")
+				s.handleCommand("INCRBYFLOAT float 0.5")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if resp, want := s.handleCommand("GET counter"), fmt.Sprintf("VALUE %d", workers*increments); resp != want {
+		t.Fatalf("expected %q, got %q", want, resp)
+	}
+	if resp, want := s.handleCommand("GET float"), fmt.Sprintf("VALUE %d", workers*increments/2); resp != want {
+		t.Fatalf("expected %q, got %q", want, resp)
+	}
+}
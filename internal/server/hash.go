@@ -0,0 +1,116 @@
+package server
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// hashCommand handles the commands on hashes:
+//
+//	HSET key field value [field value ...]  the number of fields added
+//	HGET key field                          the value of field
+//	HDEL key field [field ...]              the number of fields removed
+//	HGETALL key                             fields and values, by field
+func hashCommand(store storage.Storage, cmd string, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	key := string(args[1])
+	switch cmd {
+	case "HSET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errInvalidArguments
+		}
+		added := 0
+		err := modifyKind(store, key, storage.KindHash, func(old []byte) ([]byte, error) {
+			fields, err := decodeHash(old)
+			if err != nil {
+				return nil, err
+			}
+			for i := 2; i < len(args); i += 2 {
+				if _, ok := fields[string(args[i])]; !ok {
+					added++
+				}
+				fields[string(args[i])] = args[i+1]
+			}
+			return storage.EncodeHash(fields), nil
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(added))
+	case "HGET":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		fields, err := readHash(store, key)
+		if err != nil {
+			return storageError(err)
+		}
+		value, ok := fields[string(args[2])]
+		if !ok {
+			return protocol.Null()
+		}
+		return protocol.Value(value)
+	case "HDEL":
+		if len(args) < 3 {
+			return errInvalidArguments
+		}
+		removed := 0
+		err := modifyKind(store, key, storage.KindHash, func(old []byte) ([]byte, error) {
+			fields, err := decodeHash(old)
+			if err != nil {
+				return nil, err
+			}
+			for _, field := range args[2:] {
+				if _, ok := fields[string(field)]; ok {
+					delete(fields, string(field))
+					removed++
+				}
+			}
+			switch {
+			case removed == 0:
+				return nil, errUnchanged
+			case len(fields) == 0:
+				return nil, nil
+			}
+			return storage.EncodeHash(fields), nil
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(removed))
+	default: // HGETALL
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		fields, err := readHash(store, key)
+		if err != nil {
+			return storageError(err)
+		}
+		items := make([][]byte, 0, 2*len(fields))
+		for _, field := range slices.Sorted(maps.Keys(fields)) {
+			items = append(items, []byte(field), fields[field])
+		}
+		return valueArray(items)
+	}
+}
+
+func readHash(store storage.Storage, key string) (map[string][]byte, error) {
+	value, err := readKind(store, key, storage.KindHash)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHash(value)
+}
+
+// decodeHash decodes the value of a hash, nil being an empty one.
+func decodeHash(value []byte) (map[string][]byte, error) {
+	if value == nil {
+		return make(map[string][]byte), nil
+	}
+	return storage.DecodeHash(value)
+}
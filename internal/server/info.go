@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+var infoSections = []string{"memory", "stats", "keyspace"}
+
+// info replies to INFO [section] with one "name:value" line per field,
+// each section headed by a "# Section" line.
+func (s *Server) info(args [][]byte) protocol.Reply {
+	sections := infoSections
+	switch len(args) {
+	case 1:
+	case 2:
+		section := strings.ToLower(string(args[1]))
+		if section != "all" {
+			sections = []string{section}
+		}
+	default:
+		return errInvalidArguments
+	}
+	if s.memory == nil {
+		return errNoMemoryStats
+	}
+	stats := s.memory.MemoryStats()
+	var lines []protocol.Reply
+	field := func(name string, value any) {
+		lines = append(lines, protocol.Value(fmt.Appendf(nil, "%s:%v", name, value)))
+	}
+	for _, section := range sections {
+		switch section {
+		case "memory":
+			lines = append(lines, protocol.Value([]byte("# Memory")))
+			field("used_memory", stats.UsedBytes)
+			field("maxmemory", stats.MaxBytes)
+			field("maxmemory_policy", stats.Policy)
+		case "stats":
+			lines = append(lines, protocol.Value([]byte("# Stats")))
+			field("evicted_keys", stats.Evicted)
+		case "keyspace":
+			lines = append(lines, protocol.Value([]byte("# Keyspace")))
+			field("keys", stats.Keys)
+		default:
+			return protocol.Error("unknown info section")
+		}
+	}
+	return protocol.Array(lines)
+}
@@ -4,17 +4,20 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aptolon/kv-store/internal/protocol"
 	"github.com/aptolon/kv-store/internal/storage"
 )
 
 func TestTCPSetGet(t *testing.T) {
 	ctx := t.Context()
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -67,7 +70,7 @@ func TestTCPSetGet(t *testing.T) {
 func TestTCPGetMissingKey(t *testing.T) {
 	ctx := t.Context()
 
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -110,7 +113,7 @@ func TestTCPGetMissingKey(t *testing.T) {
 func TestTCPInvalidCommand(t *testing.T) {
 	ctx := t.Context()
 
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -162,7 +165,7 @@ func TestTCPInvalidCommand(t *testing.T) {
 func TestTCPMultiCommand(t *testing.T) {
 	ctx := t.Context()
 
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -238,7 +241,7 @@ func TestTCPGracefulShutdown(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
 	defer cancel()
 
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -290,3 +293,127 @@ func TestTCPGracefulShutdown(t *testing.T) {
 		t.Fatalf("expected connection отказ после shutdown")
 	}
 }
+
+func TestTCPBinaryProtocol(t *testing.T) {
+	ctx := t.Context()
+
+	data := make(map[string]storage.Entry)
+	store := storage.NewMemoryStorage(data)
+	srv := NewServer(":0", store)
+
+	go func() {
+		if err := srv.Start(ctx); err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+	var addr string
+	select {
+	case addr = <-srv.ready:
+	case <-time.After(time.Second):
+		t.Fatalf("server didn't started")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	key := []byte("key with spaces")
+	value := []byte("hello world\n\x00\xff")
+
+	tests := []struct {
+		args [][]byte
+		resp protocol.Reply
+	}{
+		{[][]byte{[]byte("GET"), key}, protocol.Null()},
+		{[][]byte{[]byte("SET"), key, value}, protocol.OK},
+		{[][]byte{[]byte("GET"), key}, protocol.Value(value)},
+		{[][]byte{[]byte("TTL"), key}, protocol.Integer(-1)},
+		{[][]byte{[]byte("GET")}, protocol.Error("invalid arguments")},
+	}
+	for _, tt := range tests {
+		if err := protocol.WriteRequest(writer, tt.args); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		resp, err := protocol.ReadReply(reader)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !reflect.DeepEqual(resp, tt.resp) {
+			t.Fatalf("cmd %q: expected %+v, got %+v", tt.args, tt.resp, resp)
+		}
+	}
+}
+
+func TestTCPRESPProtocol(t *testing.T) {
+	ctx := t.Context()
+
+	data := make(map[string]storage.Entry)
+	store := storage.NewMemoryStorage(data)
+	srv := NewServer(":0", store)
+
+	go func() {
+		if err := srv.Start(ctx); err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+	var addr string
+	select {
+	case addr = <-srv.ready:
+	case <-time.After(time.Second):
+		t.Fatalf("server didn't started")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "$-1\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\na\r\nb \r\n", "+OK\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "$5\r\na\r\nb \r\n"},
+		{"*1\r\n$3\r\nGET\r\n", "-ERR invalid arguments\r\n"},
+		{"*3\r\n$3\r\nDEL\r\n$1\r\nk\r\n$1\r\nx\r\n", ":1\r\n"},
+		{"*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n", "%5\r\n"},
+	}
+	for _, tt := range tests {
+		if _, err := conn.Write([]byte(tt.cmd)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		resp := make([]byte, len(tt.resp))
+		if _, err := io.ReadFull(reader, resp); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if string(resp) != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+
+	// Skip the rest of the HELLO reply: five bulk string keys, three bulk
+	// string values, an integer and an empty array. RESP3 uses a dedicated
+	// null.
+	for range 5*2 + 3*2 + 1 + 1 {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+	}
+	if _, err := conn.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	resp, _ := reader.ReadString('\n')
+	if resp != "_\r\n" {
+		t.Fatalf("expected RESP3 null, got %q", resp)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"slices"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// listCommand handles the commands on lists:
+//
+//	LPUSH key value [value ...]  prepends the values one by one, replies
+//	RPUSH key value [value ...]  or appends them, with the new length
+//	LPOP key                     removes and returns the first item
+//	RPOP key                     or the last one
+//	LRANGE key start stop        the items from start to stop, inclusive
+func listCommand(store storage.Storage, cmd string, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	key := string(args[1])
+	switch cmd {
+	case "LPUSH", "RPUSH":
+		if len(args) < 3 {
+			return errInvalidArguments
+		}
+		length := 0
+		err := modifyKind(store, key, storage.KindList, func(old []byte) ([]byte, error) {
+			pushed := args[2:]
+			if cmd == "LPUSH" {
+				pushed = slices.Clone(pushed)
+				slices.Reverse(pushed)
+			}
+			value, n, err := storage.PushList(old, pushed, cmd == "LPUSH")
+			length = n
+			return value, err
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(length))
+	case "LPOP", "RPOP":
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		var popped []byte
+		err := modifyKind(store, key, storage.KindList, func(old []byte) ([]byte, error) {
+			if old == nil {
+				return nil, errUnchanged
+			}
+			item, rest, err := storage.PopList(old, cmd == "LPOP")
+			popped = item
+			return rest, err
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		if popped == nil {
+			return protocol.Null()
+		}
+		return protocol.Value(popped)
+	default: // LRANGE
+		if len(args) != 4 {
+			return errInvalidArguments
+		}
+		value, err := readKind(store, key, storage.KindList)
+		if err != nil {
+			return storageError(err)
+		}
+		items, err := decodeList(value)
+		if err != nil {
+			return storageError(err)
+		}
+		lo, hi, ok := rankRange(args[2], args[3], len(items))
+		if !ok {
+			return protocol.Error(errNotInteger.Error())
+		}
+		return valueArray(items[lo:hi])
+	}
+}
+
+// decodeList decodes the value of a list, nil being an empty one.
+func decodeList(value []byte) ([][]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return storage.DecodeList(value)
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+// RESP (the Redis serialization protocol) lets Redis clients and tools
+// talk to the server. Commands are arrays of bulk strings; a connection
+// starts in RESP2 and switches to RESP3 with HELLO 3.
+// See https://redis.io/docs/latest/develop/reference/protocol-spec/.
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// readRESPCommand reads a command sent as an array of bulk strings.
+// io.EOF is returned only if the connection was closed between commands.
+func readRESPCommand(r *bufio.Reader) ([][]byte, error) {
+	count, err := readRESPHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 || count > protocol.MaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([][]byte, count)
+	for i := range args {
+		length, err := readRESPHeader(r, '$')
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if length < 0 || length > protocol.MaxArgSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: expected CRLF", errRESPProtocol)
+		}
+		args[i] = arg[:length:length]
+	}
+	return args, nil
+}
+
+// readRESPHeader reads a line consisting of prefix and an integer.
+func readRESPHeader(r *bufio.Reader, prefix byte) (int64, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("%w: too big header", errRESPProtocol)
+	}
+	if err != nil {
+		if len(line) > 0 {
+			return 0, unexpectedEOF(err)
+		}
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("%w: expected '%c'", errRESPProtocol, prefix)
+	}
+	n, err := strconv.ParseInt(string(line[1:len(line)-2]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid length", errRESPProtocol)
+	}
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// errorCodes are the Redis error codes the replies of the server may
+// start with. Other errors are sent with the generic ERR code.
+var errorCodes = []string{"OOM", "WRONGTYPE"}
+
+func hasErrorCode(msg string) bool {
+	code, _, _ := strings.Cut(msg, " ")
+	return slices.Contains(errorCodes, code)
+}
+
+// writeRESP encodes r for the given protocol version, 2 or 3. The writer
+// is not flushed.
+func writeRESP(w *bufio.Writer, r protocol.Reply, version int) {
+	switch r.Kind {
+	case protocol.KindStatus:
+		w.WriteString("+" + r.Str + "\r\n")
+	case protocol.KindError:
+		msg := strings.ReplaceAll(r.Str, "\r\n", " ")
+		if !hasErrorCode(msg) {
+			msg = "ERR " + msg
+		}
+		w.WriteString("-" + msg + "\r\n")
+	case protocol.KindInteger:
+		w.WriteString(":" + strconv.FormatInt(r.Integer, 10) + "\r\n")
+	case protocol.KindValue:
+		writeRESPBulk(w, r.Value)
+	case protocol.KindNull:
+		switch {
+		case version >= 3:
+			w.WriteString("_\r\n")
+		case r.NullArray:
+			w.WriteString("*-1\r\n")
+		default:
+			w.WriteString("$-1\r\n")
+		}
+	case protocol.KindArray:
+		w.WriteString("*" + strconv.Itoa(len(r.Array)) + "\r\n")
+		for _, item := range r.Array {
+			writeRESP(w, item, version)
+		}
+	}
+}
+
+func writeRESPBulk(w *bufio.Writer, b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// serveRESP serves a connection that speaks RESP. Replies are flushed
+// once no more commands are buffered, so pipelined commands are answered
+// together.
+func (s *Server) serveRESP(ctx context.Context, reader *bufio.Reader, writer *bufio.Writer) {
+	version := 2
+	sess := &session{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			args, err := readRESPCommand(reader)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// The framing is lost, so the connection cannot be used
+				// any further.
+				log.Println(err)
+				if errors.Is(err, errRESPProtocol) {
+					writeRESP(writer, protocol.Error(err.Error()), version)
+					writer.Flush()
+				}
+				return
+			}
+
+			quit := false
+			switch strings.ToUpper(string(args[0])) {
+			case "HELLO":
+				version = s.hello(writer, args, version)
+			case "QUIT":
+				writeRESP(writer, protocol.OK, version)
+				quit = true
+			case "DEL":
+				// Redis clients expect DEL to take several keys and to
+				// reply with the number of keys that existed.
+				args[0] = []byte("MDEL")
+				writeRESP(writer, s.dispatch(sess, args), version)
+			case "COMMAND":
+				// redis-cli asks for command docs on start; an empty
+				// reply makes it fall back to no hints.
+				writeRESP(writer, protocol.Array(nil), version)
+			default:
+				writeRESP(writer, s.dispatch(sess, args), version)
+			}
+
+			if quit || reader.Buffered() == 0 {
+				if err := writer.Flush(); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+			if quit {
+				return
+			}
+		}
+	}
+}
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME name]]
+// and returns the protocol version used from now on. Authentication and
+// client names are not supported.
+func (s *Server) hello(w *bufio.Writer, args [][]byte, version int) int {
+	if len(args) > 2 {
+		writeRESP(w, protocol.Error("HELLO options are not supported"), version)
+		return version
+	}
+	if len(args) == 2 {
+		requested, err := strconv.Atoi(string(args[1]))
+		if err != nil || requested < 2 || requested > 3 {
+			w.WriteString("-NOPROTO unsupported protocol version\r\n")
+			return version
+		}
+		version = requested
+	}
+
+	fields := []struct {
+		key   string
+		value protocol.Reply
+	}{
+		{"server", protocol.Value([]byte("kv-store"))},
+		{"proto", protocol.Integer(int64(version))},
+		{"mode", protocol.Value([]byte("standalone"))},
+		{"role", protocol.Value([]byte("master"))},
+		{"modules", protocol.Array(nil)},
+	}
+	if version >= 3 {
+		w.WriteString("%" + strconv.Itoa(len(fields)) + "\r\n")
+	} else {
+		w.WriteString("*" + strconv.Itoa(2*len(fields)) + "\r\n")
+	}
+	for _, field := range fields {
+		writeRESPBulk(w, []byte(field.key))
+		writeRESP(w, field.value, version)
+	}
+	return version
+}
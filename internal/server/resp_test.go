@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$5\r\nk e y\r\n$4\r\na\r\nb\r\n*1\r\n$4\r\nPING\r\n"
+	r := bufio.NewReader(strings.NewReader(input))
+
+	want := [][][]byte{
+		{[]byte("SET"), []byte("k e y"), []byte("a\r\nb")},
+		{[]byte("PING")},
+	}
+	for _, w := range want {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(args, w) {
+			t.Fatalf("expected %q, got %q", w, args)
+		}
+	}
+	if _, err := readRESPCommand(r); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestReadRESPCommandErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"*0\r\n", errRESPProtocol},
+		{"*x\r\n", errRESPProtocol},
+		{"*1\r\n+OK\r\n", errRESPProtocol},
+		{"*1\r\n$-1\r\n", errRESPProtocol},
+		{"*1\r\n$3\r\nGETX\r\n", errRESPProtocol},
+		{"*2\r\n$3\r\nGET\r\n", io.ErrUnexpectedEOF},
+		{"*1\r\n$3\r\nGE", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		_, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.input)))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("input %q: expected %v, got %v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestWriteRESP(t *testing.T) {
+	tests := []struct {
+		reply   protocol.Reply
+		version int
+		want    string
+	}{
+		{protocol.OK, 2, "+OK\r\n"},
+		{protocol.Error("invalid arguments"), 2, "-ERR invalid arguments\r\n"},
+		{errOutOfMemory, 2, "-OOM command not allowed when used memory > 'maxmemory'\r\n"},
+		{errWrongType, 2, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{protocol.Integer(-2), 2, ":-2\r\n"},
+		{protocol.Value([]byte("a b")), 2, "$3\r\na b\r\n"},
+		{protocol.Null(), 2, "$-1\r\n"},
+		{protocol.Null(), 3, "_\r\n"},
+		{protocol.NullArray(), 2, "*-1\r\n"},
+		{protocol.NullArray(), 3, "_\r\n"},
+		{protocol.Array([]protocol.Reply{protocol.Value([]byte("x")), protocol.Null()}), 2, "*2\r\n$1\r\nx\r\n$-1\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeRESP(w, tt.reply, tt.version)
+		w.Flush()
+		if buf.String() != tt.want {
+			t.Fatalf("expected %q, got %q", tt.want, buf.String())
+		}
+	}
+}
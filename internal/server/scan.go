@@ -0,0 +1,258 @@
+package server
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+const (
+	defaultScanCount  = 10
+	defaultRangeLimit = 100
+	// keysPageSize is the number of keys KEYS reads at a time, so that
+	// writers get a turn while a large key space is listed.
+	keysPageSize = 1000
+)
+
+// scanKeys handles SCAN cursor [MATCH pattern] [COUNT count]. Up to count
+// keys are examined per call, in order, and those matching pattern are
+// returned together with the cursor to continue from, "0" once the whole
+// key space has been walked. Keys that exist during the whole walk are
+// returned exactly once.
+func scanKeys(store storage.Storage, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	start, ok := decodeCursor(string(args[1]))
+	if !ok {
+		return protocol.Error("invalid cursor")
+	}
+	pattern := "*"
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errInvalidArguments
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				return protocol.Error("invalid count")
+			}
+			count = n
+		default:
+			return errInvalidArguments
+		}
+	}
+
+	prefix := literalPrefix(pattern)
+	start = max(start, prefix)
+	items, err := store.Scan(start, storage.PrefixEnd(prefix), count+1)
+	if err != nil {
+		return errInternal
+	}
+	next := "0"
+	if len(items) > count {
+		next = base64.RawURLEncoding.EncodeToString([]byte(items[count].Key))
+		items = items[:count]
+	}
+	keys := []protocol.Reply{}
+	for _, item := range items {
+		if matchGlob(pattern, item.Key) {
+			keys = append(keys, protocol.Value([]byte(item.Key)))
+		}
+	}
+	return protocol.Array([]protocol.Reply{protocol.Value([]byte(next)), protocol.Array(keys)})
+}
+
+// decodeCursor returns the key a SCAN cursor resumes at. The cursor is the
+// key encoded in base64, which is never "0", the cursor of a new walk.
+func decodeCursor(cursor string) (string, bool) {
+	if cursor == "0" {
+		return "", true
+	}
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) == 0 {
+		return "", false
+	}
+	return string(key), true
+}
+
+// rangeKeys handles RANGE start end [LIMIT limit], which returns the keys
+// from start up to but not including end, with their values, and the key
+// the next page starts at. "-" and "+" stand for the first and the last
+// key. Keys holding other kinds than strings come with a null value.
+func rangeKeys(store storage.Storage, args [][]byte) protocol.Reply {
+	if len(args) != 3 && len(args) != 5 {
+		return errInvalidArguments
+	}
+	start, end := string(args[1]), string(args[2])
+	if start == "-" {
+		start = ""
+	}
+	if end == "+" {
+		end = ""
+	}
+	limit := defaultRangeLimit
+	if len(args) == 5 {
+		if !strings.EqualFold(string(args[3]), "LIMIT") {
+			return errInvalidArguments
+		}
+		n, err := strconv.Atoi(string(args[4]))
+		if err != nil || n <= 0 {
+			return protocol.Error("invalid limit")
+		}
+		limit = n
+	}
+
+	items, err := store.Scan(start, end, limit+1)
+	if err != nil {
+		return errInternal
+	}
+	next := protocol.Null()
+	if len(items) > limit {
+		next = protocol.Value([]byte(items[limit].Key))
+		items = items[:limit]
+	}
+	pairs := make([]protocol.Reply, 0, 2*len(items))
+	for _, item := range items {
+		value := protocol.Value(item.Value)
+		if item.Kind != storage.KindString {
+			value = protocol.Null()
+		}
+		pairs = append(pairs, protocol.Value([]byte(item.Key)), value)
+	}
+	return protocol.Array([]protocol.Reply{next, protocol.Array(pairs)})
+}
+
+// matchingKeys handles KEYS pattern. The keys are read a page at a time,
+// so the reply is not a snapshot of a single point in time.
+func matchingKeys(store storage.Storage, args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return errInvalidArguments
+	}
+	pattern := string(args[1])
+	prefix := literalPrefix(pattern)
+	end := storage.PrefixEnd(prefix)
+	keys := []protocol.Reply{}
+	for start := prefix; ; {
+		items, err := store.Scan(start, end, keysPageSize)
+		if err != nil {
+			return errInternal
+		}
+		for _, item := range items {
+			if matchGlob(pattern, item.Key) {
+				keys = append(keys, protocol.Value([]byte(item.Key)))
+			}
+		}
+		if len(items) < keysPageSize {
+			return protocol.Array(keys)
+		}
+		start = items[len(items)-1].Key + "\x00"
+	}
+}
+
+// literalPrefix returns the part of pattern before its first special
+// character, which every matching key starts with.
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchGlob reports whether s matches pattern, in which * matches any
+// sequence of bytes, ? any single byte, [abc], [a-z] and [^a] a byte of a
+// class, and \ escapes the next character.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	// After a mismatch, the last * is retried with one more byte.
+	star, starS := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starS = p, i
+				p++
+				continue
+			}
+			if n, ok := matchOne(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starS++
+		p, i = star+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches c against the token pattern starts with, which is not
+// *, and returns the length of the token.
+func matchOne(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	case '[':
+		if end := classEnd(pattern); end > 0 {
+			return end + 1, matchClass(pattern[1:end], c)
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// classEnd returns the index of the ] closing the class pattern starts
+// with, or -1 if it is not closed.
+func classEnd(pattern string) int {
+	i := 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func matchClass(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		lo := class[i]
+		if lo == '\\' && i+1 < len(class) {
+			i++
+			lo = class[i]
+		}
+		hi := lo
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = class[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			return !negate
+		}
+	}
+	return negate
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"user:*", "user:42", true},
+		{"user:*", "order:1", false},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[llo", "h[llo", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Fatalf("matchGlob(%q, %q): expected %v, got %v", tt.pattern, tt.s, tt.want, got)
+		}
+	}
+}
+
+func TestHandleCommandScan(t *testing.T) {
+	s := newTestServer()
+	var want []string
+	for i := range 25 {
+		s.handleCommand(fmt.Sprintf("SET user:%02d x", i))
+		want = append(want, fmt.Sprintf("user:%02d", i))
+	}
+	s.handleCommand("SET order:1 x")
+
+	var got []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10 {
+			t.Fatalf("SCAN did not finish")
+		}
+		lines := strings.Split(s.handleCommand("SCAN "+cursor+" MATCH user:* COUNT 10"), "\n")
+		if lines[0] != "ARRAY 2" || !strings.HasPrefix(lines[1], "VALUE ") {
+			t.Fatalf("unexpected reply %q", lines)
+		}
+		cursor = strings.TrimPrefix(lines[1], "VALUE ")
+		for _, line := range lines[3:] {
+			got = append(got, strings.TrimPrefix(line, "VALUE "))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"SCAN 0 MATCH order:?", "ARRAY 2\nVALUE 0\nARRAY 1\nVALUE order:1"},
+		{"SCAN 0 MATCH none*", "ARRAY 2\nVALUE 0\nARRAY 0"},
+		{"SCAN !", "ERROR invalid cursor"},
+		{"SCAN 0 COUNT 0", "ERROR invalid count"},
+		{"SCAN 0 COUNT", "ERROR invalid arguments"},
+		{"KEYS user:1*", "ARRAY 10\nVALUE user:10\nVALUE user:11\nVALUE user:12\nVALUE user:13\nVALUE user:14\n" +
+			"VALUE user:15\nVALUE user:16\nVALUE user:17\nVALUE user:18\nVALUE user:19"},
+		{"KEYS *:1", "ARRAY 1\nVALUE order:1"},
+		{"KEYS", "ERROR invalid arguments"},
+		{"RANGE user:05 user:08", "ARRAY 2\nNULL\nARRAY 6\nVALUE user:05\nVALUE x\nVALUE user:06\nVALUE x\nVALUE user:07\nVALUE x"},
+		{"RANGE - user LIMIT 1", "ARRAY 2\nNULL\nARRAY 2\nVALUE order:1\nVALUE x"},
+		{"RANGE user:23 + LIMIT 1", "ARRAY 2\nVALUE user:24\nARRAY 2\nVALUE user:23\nVALUE x"},
+		{"RANGE - + LIMIT 0", "ERROR invalid limit"},
+		{"RANGE - + COUNT 1", "ERROR invalid arguments"},
+	}
+	for _, tt := range tests {
+		if resp := s.handleCommand(tt.cmd); resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
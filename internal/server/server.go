@@ -3,38 +3,98 @@ package server
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/aptolon/kv-store/internal/persistence"
+	"github.com/aptolon/kv-store/internal/protocol"
 	"github.com/aptolon/kv-store/internal/storage"
 )
 
 type Server struct {
-	addr     string
-	storage  storage.Storage
-	listener net.Listener
-	ready    chan string
-	wg       *sync.WaitGroup
+	addr        string
+	storage     storage.Storage
+	snapshotter Snapshotter
+	history     SnapshotHistory
+	memory      MemoryReporter
+	listener    net.Listener
+	ready       chan string
+	wg          *sync.WaitGroup
 }
 
-func NewServer(addr string, storage storage.Storage) *Server {
-	return &Server{
+// Snapshotter controls snapshots for the SAVE, BGSAVE and LASTSAVE commands.
+type Snapshotter interface {
+	Save(ctx context.Context, full bool) error
+	BackgroundSave(full bool) bool
+	LastSave() (time.Time, error)
+}
+
+// SnapshotHistory gives operators access to previous snapshot generations
+// for the SNAPSHOTS and RESTORESNAPSHOT commands. The latter is not called
+// RESTORE, as Redis clients send RESTORE with a different meaning.
+type SnapshotHistory interface {
+	ListSnapshots(ctx context.Context) ([]persistence.SnapshotInfo, error)
+	RestoreSnapshot(ctx context.Context, id int64) error
+}
+
+// MemoryReporter reports the memory use of the storage for the INFO
+// command.
+type MemoryReporter interface {
+	MemoryStats() storage.MemoryStats
+}
+
+type Option func(*Server)
+
+func WithSnapshotter(snapshotter Snapshotter) Option {
+	return func(s *Server) {
+		s.snapshotter = snapshotter
+	}
+}
+
+func WithSnapshotHistory(history SnapshotHistory) Option {
+	return func(s *Server) {
+		s.history = history
+	}
+}
+
+func WithMemoryReporter(memory MemoryReporter) Option {
+	return func(s *Server) {
+		s.memory = memory
+	}
+}
+
+func NewServer(addr string, storage storage.Storage, opts ...Option) *Server {
+	s := &Server{
 		addr:    addr,
 		storage: storage,
 		ready:   make(chan string, 1),
 		wg:      &sync.WaitGroup{},
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *Server) Start(ctx context.Context) error {
-	var err error
-	s.listener, err = net.Listen("tcp", s.addr)
+	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on listener until ctx is done.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.listener = listener
 	defer s.listener.Close()
 
 	s.ready <- s.listener.Addr().String()
@@ -62,6 +122,26 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 	log.Printf("client connected on port %s", s.addr)
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		if err != io.EOF {
+			log.Println(err)
+		}
+		return
+	}
+	switch first[0] {
+	case 0:
+		s.serveBinary(ctx, reader, writer)
+	case '*':
+		s.serveRESP(ctx, reader, writer)
+	default:
+		s.serveText(ctx, reader, writer)
+	}
+}
+
+func (s *Server) serveText(ctx context.Context, reader *bufio.Reader, writer *bufio.Writer) {
+	sess := &session{}
 	for {
 		select {
 		case <-ctx.Done():
@@ -76,56 +156,519 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 				log.Println(err)
 				return
 			}
-			line = strings.TrimSpace(line)
-			resp := s.handleCommand(line)
+			resp := protocol.FormatText(s.dispatch(sess, splitFields(line)))
 			writer.WriteString(resp + "\n")
 			writer.Flush()
 		}
 	}
 }
 
+// serveBinary serves a connection that uses the length-prefixed binary
+// protocol. Replies are flushed once no more requests are buffered, so
+// pipelined requests are answered together.
+func (s *Server) serveBinary(ctx context.Context, reader *bufio.Reader, writer *bufio.Writer) {
+	sess := &session{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			args, err := protocol.ReadRequest(reader)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// The framing is lost, so the connection cannot be used
+				// any further.
+				log.Println(err)
+				if errors.Is(err, protocol.ErrProtocol) {
+					protocol.WriteReply(writer, protocol.Error(err.Error()))
+					writer.Flush()
+				}
+				return
+			}
+			if err := protocol.WriteReply(writer, s.dispatch(sess, args)); err != nil {
+				log.Println(err)
+				return
+			}
+			if reader.Buffered() == 0 {
+				if err := writer.Flush(); err != nil {
+					log.Println(err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleCommand executes a line of the text protocol outside of any
+// connection, so transaction commands have nothing to act on.
 func (s *Server) handleCommand(line string) string {
-	parts := strings.Fields(line)
-	if len(parts) == 0 {
-		return "ERROR empty command"
+	return protocol.FormatText(s.execute(splitFields(line)))
+}
+
+// splitFields splits a line of the text protocol, whose arguments are
+// separated by whitespace.
+func splitFields(line string) [][]byte {
+	fields := strings.Fields(line)
+	args := make([][]byte, len(fields))
+	for i, field := range fields {
+		args[i] = []byte(field)
+	}
+	return args
+}
+
+var (
+	errInvalidArguments = protocol.Error("invalid arguments")
+	errInternal         = protocol.Error("internal error")
+	errNoSnapshots      = protocol.Error("snapshots not configured")
+	errNoHistory        = protocol.Error("snapshot history not configured")
+	errNoMemoryStats    = protocol.Error("memory stats not configured")
+	errOutOfMemory      = protocol.Error("OOM command not allowed when used memory > 'maxmemory'")
+	errWrongType        = protocol.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// storageError replies to an error returned by the storage.
+func storageError(err error) protocol.Reply {
+	switch {
+	case errors.Is(err, storage.ErrOutOfMemory):
+		return errOutOfMemory
+	case errors.Is(err, storage.ErrWrongType):
+		return errWrongType
+	}
+	return errInternal
+}
+
+// execute runs a command given as its name followed by its arguments.
+func (s *Server) execute(args [][]byte) protocol.Reply {
+	return s.exec(s.storage, args)
+}
+
+// exec runs a command against store, which is the storage of the server
+// or a transaction on it.
+func (s *Server) exec(store storage.Storage, args [][]byte) protocol.Reply {
+	if len(args) == 0 {
+		return protocol.Error("empty command")
 	}
-	cmd := strings.ToUpper(parts[0])
+	cmd := strings.ToUpper(string(args[0]))
 	switch cmd {
+	case "PING":
+		switch len(args) {
+		case 1:
+			return protocol.Status("PONG")
+		case 2:
+			return protocol.Value(args[1])
+		default:
+			return errInvalidArguments
+		}
 	case "SET":
-		if len(parts) != 3 {
-			return "ERROR invalid arguments"
+		if len(args) < 3 {
+			return errInvalidArguments
+		}
+		key := string(args[1])
+		value := args[2]
+		expireAt, cond, err := parseSetOptions(args[3:])
+		if err != nil {
+			return protocol.Error(err.Error())
+		}
+		if cond.Kind != storage.Always {
+			res, err := store.SetIf(key, value, expireAt, cond)
+			if err != nil {
+				return storageError(err)
+			}
+			if !res.Stored {
+				return protocol.Null()
+			}
+			return protocol.OK
+		}
+		if !expireAt.IsZero() {
+			err = store.SetWithExpiry(key, value, expireAt)
+		} else {
+			err = store.Set(key, value)
+		}
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.OK
+	case "SETNX":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		res, err := store.SetIf(string(args[1]), args[2], time.Time{}, storage.Condition{Kind: storage.IfAbsent})
+		if err != nil {
+			return storageError(err)
+		}
+		return formatBool(res.Stored)
+	case "GETSET":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		res, err := store.SetIf(string(args[1]), args[2], time.Time{}, storage.Condition{})
+		if err != nil {
+			return storageError(err)
+		}
+		if res.Previous == nil {
+			return protocol.Null()
 		}
-		key := parts[1]
-		value := parts[2]
-		err := s.storage.Set(key, []byte(value))
+		return protocol.Value(res.Previous)
+	case "CAS":
+		if len(args) != 4 && len(args) != 6 {
+			return errInvalidArguments
+		}
+		version, err := strconv.ParseUint(string(args[2]), 10, 64)
+		if err != nil {
+			return protocol.Error("invalid version")
+		}
+		var expireAt time.Time
+		if len(args) == 6 {
+			if expireAt, err = parseExpiry(string(args[4]), string(args[5])); err != nil {
+				return protocol.Error(err.Error())
+			}
+		}
+		cond := storage.Condition{Kind: storage.IfVersion, Version: version}
+		res, err := store.SetIf(string(args[1]), args[3], expireAt, cond)
 		if err != nil {
-			return "ERROR internal error"
+			return storageError(err)
+		}
+		if !res.Stored {
+			return protocol.Null()
 		}
-		return "OK"
+		return protocol.Integer(int64(res.Version))
 	case "GET":
-		if len(parts) != 2 {
-			return "ERROR invalid arguments"
+		if len(args) != 2 && len(args) != 3 {
+			return errInvalidArguments
 		}
-		key := parts[1]
-		value, err := s.storage.Get(key)
+		key := string(args[1])
+		if len(args) == 3 {
+			if !strings.EqualFold(string(args[2]), "WITHVERSION") {
+				return errInvalidArguments
+			}
+			value, version, err := store.GetVersion(key)
+			if err != nil {
+				return storageError(err)
+			}
+			if value == nil && version != 0 {
+				return errWrongType
+			}
+			if value == nil {
+				return protocol.Null()
+			}
+			return protocol.Array([]protocol.Reply{protocol.Value(value), protocol.Integer(int64(version))})
+		}
+		value, err := store.Get(key)
 		if err != nil {
-			return "ERROR internal error"
+			return storageError(err)
 		}
 		if value == nil {
-			return "NULL"
+			return protocol.Null()
 		}
-		return "VALUE " + string(value)
+		return protocol.Value(value)
 	case "DEL":
-		if len(parts) != 2 {
-			return "ERROR invalid arguments"
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		key := string(args[1])
+		err := store.Delete(key)
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.OK
+	case "MGET":
+		if len(args) < 2 {
+			return errInvalidArguments
+		}
+		values, err := store.GetMulti(stringArgs(args[1:]))
+		if err != nil {
+			return storageError(err)
+		}
+		items := make([]protocol.Reply, len(values))
+		for i, value := range values {
+			if value == nil {
+				items[i] = protocol.Null()
+			} else {
+				items[i] = protocol.Value(value)
+			}
+		}
+		return protocol.Array(items)
+	case "MSET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return errInvalidArguments
+		}
+		keys := make([]string, 0, len(args)/2)
+		entries := make([]storage.Entry, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, string(args[i]))
+			entries = append(entries, storage.Entry{Value: args[i+1]})
+		}
+		if err := store.SetMulti(keys, entries); err != nil {
+			return storageError(err)
+		}
+		return protocol.OK
+	case "MDEL":
+		if len(args) < 2 {
+			return errInvalidArguments
+		}
+		deleted, err := store.DeleteMulti(stringArgs(args[1:]))
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(deleted))
+	case "INCR", "DECR":
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		delta := int64(1)
+		if cmd == "DECR" {
+			delta = -1
+		}
+		return s.incrBy(store, string(args[1]), delta)
+	case "INCRBY", "DECRBY":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return protocol.Error(errNotInteger.Error())
+		}
+		if cmd == "DECRBY" {
+			if delta == math.MinInt64 {
+				return protocol.Error(errOverflow.Error())
+			}
+			delta = -delta
+		}
+		return s.incrBy(store, string(args[1]), delta)
+	case "INCRBYFLOAT":
+		if len(args) != 3 {
+			return errInvalidArguments
 		}
-		key := parts[1]
-		err := s.storage.Delete(key)
+		delta, err := parseFloat(args[2])
 		if err != nil {
-			return "ERROR internal error"
+			return protocol.Error(err.Error())
+		}
+		return s.incrByFloat(store, string(args[1]), delta)
+	case "SCAN":
+		return scanKeys(store, args)
+	case "RANGE":
+		return rangeKeys(store, args)
+	case "KEYS":
+		return matchingKeys(store, args)
+	case "TYPE":
+		return keyType(store, args)
+	case "HSET", "HGET", "HDEL", "HGETALL":
+		return hashCommand(store, cmd, args)
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE":
+		return listCommand(store, cmd, args)
+	case "SADD", "SREM", "SMEMBERS", "SISMEMBER":
+		return setCommand(store, cmd, args)
+	case "ZADD", "ZRANGE", "ZRANGEBYSCORE":
+		return zsetCommand(store, cmd, args)
+	case "EXPIRE":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		ttl, err := parseDuration(string(args[2]), time.Second)
+		if err != nil {
+			return protocol.Error(err.Error())
+		}
+		key := string(args[1])
+		ok, err := store.ExpireAt(key, time.Now().Add(ttl))
+		if err != nil {
+			return storageError(err)
+		}
+		return formatBool(ok)
+	case "TTL", "PTTL":
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		key := string(args[1])
+		expireAt, ok, err := store.ExpireTime(key)
+		if err != nil {
+			return storageError(err)
+		}
+		if !ok {
+			return protocol.Integer(-2)
+		}
+		if expireAt.IsZero() {
+			return protocol.Integer(-1)
+		}
+		unit := time.Second
+		if cmd == "PTTL" {
+			unit = time.Millisecond
+		}
+		ttl := time.Until(expireAt).Round(unit) / unit
+		return protocol.Integer(int64(max(ttl, 0)))
+	case "PERSIST":
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		key := string(args[1])
+		ok, err := store.Persist(key)
+		if err != nil {
+			return storageError(err)
+		}
+		return formatBool(ok)
+	case "INFO":
+		return s.info(args)
+	case "SAVE":
+		full, ok := parseSaveMode(args[1:])
+		if !ok {
+			return errInvalidArguments
+		}
+		if s.snapshotter == nil {
+			return errNoSnapshots
+		}
+		if err := s.snapshotter.Save(context.Background(), full); err != nil {
+			return protocol.Error("save failed: " + err.Error())
+		}
+		return protocol.OK
+	case "BGSAVE":
+		full, ok := parseSaveMode(args[1:])
+		if !ok {
+			return errInvalidArguments
+		}
+		if s.snapshotter == nil {
+			return errNoSnapshots
+		}
+		if !s.snapshotter.BackgroundSave(full) {
+			return protocol.Status("OK background save scheduled")
+		}
+		return protocol.Status("OK background save started")
+	case "LASTSAVE":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if s.snapshotter == nil {
+			return errNoSnapshots
 		}
-		return "OK"
+		lastSave, err := s.snapshotter.LastSave()
+		if err != nil {
+			return protocol.Error("last save failed: " + err.Error())
+		}
+		if lastSave.IsZero() {
+			return protocol.Integer(0)
+		}
+		return protocol.Integer(lastSave.Unix())
+	case "SNAPSHOTS":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if s.history == nil {
+			return errNoHistory
+		}
+		snapshots, err := s.history.ListSnapshots(context.Background())
+		if err != nil {
+			return protocol.Error("list snapshots failed: " + err.Error())
+		}
+		items := make([]protocol.Reply, 0, len(snapshots))
+		for _, info := range snapshots {
+			items = append(items, protocol.Value(fmt.Appendf(nil, "%d %d %d %016x",
+				info.ID, info.CreatedAt.Unix(), info.Keys, info.Checksum)))
+		}
+		return protocol.Array(items)
+	case "RESTORESNAPSHOT":
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		id, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.Error("invalid snapshot id")
+		}
+		if s.history == nil {
+			return errNoHistory
+		}
+		if err := s.history.RestoreSnapshot(context.Background(), id); err != nil {
+			return protocol.Error("restore failed: " + err.Error())
+		}
+		return protocol.OK
 	default:
-		return "ERROR invalid command"
+		return protocol.Error("invalid command")
+	}
+}
+
+// parseSetOptions parses the options of SET: an expiry given by EX or PX
+// and a condition given by NX (only if the key does not exist) or XX (only
+// if it exists).
+func parseSetOptions(args [][]byte) (expireAt time.Time, cond storage.Condition, err error) {
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); option {
+		case "EX", "PX":
+			if !expireAt.IsZero() || i+1 == len(args) {
+				return time.Time{}, cond, errors.New("invalid arguments")
+			}
+			i++
+			if expireAt, err = parseExpiry(option, string(args[i])); err != nil {
+				return time.Time{}, cond, err
+			}
+		case "NX", "XX":
+			if cond.Kind != storage.Always {
+				return time.Time{}, cond, errors.New("invalid arguments")
+			}
+			cond.Kind = storage.IfAbsent
+			if option == "XX" {
+				cond.Kind = storage.IfPresent
+			}
+		default:
+			return time.Time{}, cond, errors.New("invalid arguments")
+		}
+	}
+	return expireAt, cond, nil
+}
+
+// parseExpiry converts the EX/PX option of SET into an absolute expiry time.
+func parseExpiry(option, amount string) (time.Time, error) {
+	var unit time.Duration
+	switch strings.ToUpper(option) {
+	case "EX":
+		unit = time.Second
+	case "PX":
+		unit = time.Millisecond
+	default:
+		return time.Time{}, errors.New("invalid arguments")
+	}
+	ttl, err := parseDuration(amount, unit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ttl <= 0 {
+		return time.Time{}, errInvalidExpire
+	}
+	return time.Now().Add(ttl), nil
+}
+
+var errInvalidExpire = errors.New("invalid expire time")
+
+func parseDuration(amount string, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, errInvalidExpire
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// parseSaveMode parses the optional FULL argument of SAVE and BGSAVE,
+// which forces a full snapshot instead of an incremental one.
+func parseSaveMode(args [][]byte) (full bool, ok bool) {
+	switch {
+	case len(args) == 0:
+		return false, true
+	case len(args) == 1 && strings.EqualFold(string(args[0]), "FULL"):
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+func stringArgs(args [][]byte) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	return strs
+}
+
+func formatBool(ok bool) protocol.Reply {
+	if ok {
+		return protocol.Integer(1)
 	}
+	return protocol.Integer(0)
 }
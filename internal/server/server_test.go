@@ -1,15 +1,19 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/aptolon/kv-store/internal/persistence"
 	"github.com/aptolon/kv-store/internal/storage"
 )
 
 func newTestServer() *Server {
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	return NewServer(
 		":0",
 
@@ -103,3 +107,361 @@ func TestHandleInvalidCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleCommandSetWithExpiry(t *testing.T) {
+	s := newTestServer()
+
+	key := "123"
+
+	resp := s.handleCommand("SET " + key + " 456 EX 100")
+	expectedResp := "OK"
+	if resp != expectedResp {
+		t.Fatalf("expected %q, got %q", expectedResp, resp)
+	}
+
+	resp = s.handleCommand("TTL " + key)
+	expectedResp = "INTEGER 100"
+	if resp != expectedResp {
+		t.Fatalf("expected %q, got %q", expectedResp, resp)
+	}
+
+	resp = s.handleCommand("SET " + key + " 456 PX 100000")
+	if resp != "OK" {
+		t.Fatalf("expected %q, got %q", "OK", resp)
+	}
+
+	resp = s.handleCommand("PTTL " + key)
+	if !strings.HasPrefix(resp, "INTEGER 99") && resp != "INTEGER 100000" {
+		t.Fatalf("expected ttl close to 100000ms, got %q", resp)
+	}
+
+	resp = s.handleCommand("SET " + key + " 456")
+	if resp != "OK" {
+		t.Fatalf("expected %q, got %q", "OK", resp)
+	}
+
+	resp = s.handleCommand("TTL " + key)
+	expectedResp = "INTEGER -1"
+	if resp != expectedResp {
+		t.Fatalf("expected %q, got %q", expectedResp, resp)
+	}
+}
+
+func TestHandleCommandExpirePersist(t *testing.T) {
+	s := newTestServer()
+
+	key := "123"
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"TTL " + key, "INTEGER -2"},
+		{"EXPIRE " + key + " 10", "INTEGER 0"},
+		{"PERSIST " + key, "INTEGER 0"},
+		{"SET " + key + " 456", "OK"},
+		{"EXPIRE " + key + " 10", "INTEGER 1"},
+		{"TTL " + key, "INTEGER 10"},
+		{"PERSIST " + key, "INTEGER 1"},
+		{"TTL " + key, "INTEGER -1"},
+		{"EXPIRE " + key + " 0", "INTEGER 1"},
+		{"GET " + key, "NULL"},
+		{"TTL " + key, "INTEGER -2"},
+	}
+
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleInvalidExpiry(t *testing.T) {
+	s := newTestServer()
+
+	tests := []string{
+		"SET a 1 EX",
+		"SET a 1 EX 0",
+		"SET a 1 PX -5",
+		"SET a 1 EX abc",
+		"SET a 1 ZZ 10",
+		"SET a 1 EX 99999999999999999",
+		"EXPIRE a",
+		"EXPIRE a b",
+		"TTL",
+		"PTTL a b",
+		"PERSIST",
+	}
+
+	for _, cmd := range tests {
+		resp := s.handleCommand(cmd)
+		if !strings.HasPrefix(resp, "ERROR") {
+			t.Fatalf("cmd %q: expected ERROR, got %q", cmd, resp)
+		}
+	}
+}
+
+type fakeSnapshotter struct {
+	full     bool
+	saveErr  error
+	started  bool
+	lastSave time.Time
+	lastErr  error
+}
+
+func (f *fakeSnapshotter) Save(ctx context.Context, full bool) error {
+	f.full = full
+	return f.saveErr
+}
+
+func (f *fakeSnapshotter) BackgroundSave(full bool) bool {
+	f.full = full
+	return f.started
+}
+
+func (f *fakeSnapshotter) LastSave() (time.Time, error) {
+	return f.lastSave, f.lastErr
+}
+
+func TestHandleCommandSnapshots(t *testing.T) {
+	snapshotter := &fakeSnapshotter{
+		started:  true,
+		lastSave: time.Unix(1700000000, 0),
+	}
+	s := NewServer(
+		":0",
+		storage.NewMemoryStorage(make(map[string]storage.Entry)),
+		WithSnapshotter(snapshotter),
+	)
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"SAVE", "OK"},
+		{"BGSAVE", "OK background save started"},
+		{"LASTSAVE", "INTEGER 1700000000"},
+	}
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+
+	if s.handleCommand("SAVE"); snapshotter.full {
+		t.Fatalf("expected SAVE to request an incremental save")
+	}
+	if s.handleCommand("SAVE full"); !snapshotter.full {
+		t.Fatalf("expected SAVE FULL to request a full save")
+	}
+	if s.handleCommand("BGSAVE FULL"); !snapshotter.full {
+		t.Fatalf("expected BGSAVE FULL to request a full save")
+	}
+
+	snapshotter.saveErr = errors.New("boom")
+	snapshotter.lastErr = snapshotter.saveErr
+	snapshotter.started = false
+
+	tests = []struct {
+		cmd  string
+		resp string
+	}{
+		{"SAVE", "ERROR save failed: boom"},
+		{"BGSAVE", "OK background save scheduled"},
+		{"LASTSAVE", "ERROR last save failed: boom"},
+	}
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleCommandSnapshotsNotConfigured(t *testing.T) {
+	s := newTestServer()
+
+	for _, cmd := range []string{"SAVE", "BGSAVE", "LASTSAVE", "SAVE now", "BGSAVE FULL now", "LASTSAVE FULL"} {
+		resp := s.handleCommand(cmd)
+		if !strings.HasPrefix(resp, "ERROR") {
+			t.Fatalf("cmd %q: expected ERROR, got %q", cmd, resp)
+		}
+	}
+}
+
+type fakeHistory struct {
+	snapshots  []persistence.SnapshotInfo
+	restored   int64
+	restoreErr error
+}
+
+func (f *fakeHistory) ListSnapshots(ctx context.Context) ([]persistence.SnapshotInfo, error) {
+	return f.snapshots, nil
+}
+
+func (f *fakeHistory) RestoreSnapshot(ctx context.Context, id int64) error {
+	f.restored = id
+	return f.restoreErr
+}
+
+func TestHandleCommandSnapshotHistory(t *testing.T) {
+	history := &fakeHistory{
+		snapshots: []persistence.SnapshotInfo{
+			{ID: 2, CreatedAt: time.Unix(1700000100, 0), Keys: 10, Checksum: 0xabc},
+			{ID: 1, CreatedAt: time.Unix(1700000000, 0), Keys: 7, Checksum: 0x123},
+		},
+	}
+	s := NewServer(
+		":0",
+		storage.NewMemoryStorage(make(map[string]storage.Entry)),
+		WithSnapshotHistory(history),
+	)
+
+	want := "ARRAY 2\n" +
+		"VALUE 2 1700000100 10 0000000000000abc\n" +
+		"VALUE 1 1700000000 7 0000000000000123"
+	if resp := s.handleCommand("SNAPSHOTS"); resp != want {
+		t.Fatalf("expected %q, got %q", want, resp)
+	}
+
+	if resp := s.handleCommand("RESTORESNAPSHOT 1"); resp != "OK" {
+		t.Fatalf("expected OK, got %q", resp)
+	}
+	if history.restored != 1 {
+		t.Fatalf("expected generation 1 to be restored, got %d", history.restored)
+	}
+
+	history.restoreErr = persistence.ErrSnapshotNotFound
+	if resp := s.handleCommand("RESTORESNAPSHOT 5"); resp != "ERROR restore failed: snapshot not found" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+
+	for _, cmd := range []string{"RESTORESNAPSHOT", "RESTORESNAPSHOT x", "RESTORESNAPSHOT 1 2", "SNAPSHOTS 1"} {
+		if resp := s.handleCommand(cmd); !strings.HasPrefix(resp, "ERROR") {
+			t.Fatalf("cmd %q: expected ERROR, got %q", cmd, resp)
+		}
+	}
+
+	if resp := newTestServer().handleCommand("SNAPSHOTS"); resp != "ERROR snapshot history not configured" {
+		t.Fatalf("unexpected response %q", resp)
+	}
+}
+
+func TestHandleCommandMulti(t *testing.T) {
+	s := newTestServer()
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"MSET a 1 b 2 a 3", "OK"},
+		{"MGET a b c", "ARRAY 3\nVALUE 3\nVALUE 2\nNULL"},
+		{"MDEL a c", "INTEGER 1"},
+		{"MGET a b", "ARRAY 2\nNULL\nVALUE 2"},
+		{"MSET a", "ERROR invalid arguments"},
+		{"MSET a 1 b", "ERROR invalid arguments"},
+		{"MGET", "ERROR invalid arguments"},
+		{"MDEL", "ERROR invalid arguments"},
+	}
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleCommandConditionalSet(t *testing.T) {
+	s := newTestServer()
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"SET a 1 XX", "NULL"},
+		{"SET a 1 NX", "OK"},
+		{"SET a 2 NX", "NULL"},
+		{"SET a 2 XX EX 100", "OK"},
+		{"TTL a", "INTEGER 100"},
+		{"SET a 3 EX 10 PX 10", "ERROR invalid arguments"},
+		{"SET a 3 NX XX", "ERROR invalid arguments"},
+		{"SETNX a 3", "INTEGER 0"},
+		{"SETNX b 3", "INTEGER 1"},
+		{"GETSET a 4", "VALUE 2"},
+		{"TTL a", "INTEGER -1"},
+		{"GETSET c 5", "NULL"},
+		{"GET c", "VALUE 5"},
+		{"GET c VERSION", "ERROR invalid arguments"},
+		{"GET missing WITHVERSION", "NULL"},
+		{"CAS a x 1", "ERROR invalid version"},
+		{"CAS a 1 5 EX", "ERROR invalid arguments"},
+	}
+	for _, tt := range tests {
+		resp := s.handleCommand(tt.cmd)
+		if resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleCommandCAS(t *testing.T) {
+	s := newTestServer()
+
+	if resp := s.handleCommand("CAS lock 0 owner1 PX 10000"); !strings.HasPrefix(resp, "INTEGER ") {
+		t.Fatalf("expected CAS on a missing key to succeed, got %q", resp)
+	}
+	resp := s.handleCommand("GET lock withversion")
+	lines := strings.Split(resp, "\n")
+	if len(lines) != 3 || lines[0] != "ARRAY 2" || lines[1] != "VALUE owner1" {
+		t.Fatalf("unexpected GET WITHVERSION reply %q", resp)
+	}
+	version := strings.TrimPrefix(lines[2], "INTEGER ")
+
+	if resp := s.handleCommand("CAS lock 0 owner2"); resp != "NULL" {
+		t.Fatalf("expected CAS with a stale version to fail, got %q", resp)
+	}
+	resp = s.handleCommand("CAS lock " + version + " owner2")
+	if !strings.HasPrefix(resp, "INTEGER ") || resp == "INTEGER "+version {
+		t.Fatalf("expected CAS to return a new version, got %q", resp)
+	}
+	if resp := s.handleCommand("CAS lock " + version + " owner3"); resp != "NULL" {
+		t.Fatalf("expected CAS with a used version to fail, got %q", resp)
+	}
+	if resp := s.handleCommand("GET lock"); resp != "VALUE owner2" {
+		t.Fatalf("expected %q, got %q", "VALUE owner2", resp)
+	}
+}
+
+func TestHandleCommandMemoryLimit(t *testing.T) {
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	s := NewServer(":0", store, WithMemoryReporter(store))
+
+	if resp := s.handleCommand("INFO"); resp != "ARRAY 8\nVALUE # Memory\nVALUE used_memory:0\nVALUE maxmemory:0\n"+
+		"VALUE maxmemory_policy:noeviction\nVALUE # Stats\nVALUE evicted_keys:0\nVALUE # Keyspace\nVALUE keys:0" {
+		t.Fatalf("unexpected INFO reply %q", resp)
+	}
+
+	s.handleCommand("SET a 1")
+	store.SetMemoryLimit(200, storage.NoEviction)
+	for _, cmd := range []string{"SET b 2", "MSET b 2 c 3", "INCR b", "SETNX b 2"} {
+		if resp := s.handleCommand(cmd); resp != "ERROR OOM command not allowed when used memory > 'maxmemory'" {
+			t.Fatalf("cmd %q: expected an OOM error, got %q", cmd, resp)
+		}
+	}
+
+	store.SetMemoryLimit(200, storage.AllKeysLRU)
+	if resp := s.handleCommand("SET b 2"); resp != "OK" {
+		t.Fatalf("expected SET to evict a key, got %q", resp)
+	}
+	if resp := s.handleCommand("INFO stats"); resp != "ARRAY 2\nVALUE # Stats\nVALUE evicted_keys:1" {
+		t.Fatalf("unexpected INFO stats reply %q", resp)
+	}
+	if resp := s.handleCommand("INFO cpu"); resp != "ERROR unknown info section" {
+		t.Fatalf("unexpected reply %q", resp)
+	}
+	if resp := newTestServer().handleCommand("INFO"); resp != "ERROR memory stats not configured" {
+		t.Fatalf("unexpected reply %q", resp)
+	}
+}
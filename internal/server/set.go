@@ -0,0 +1,97 @@
+package server
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// setCommand handles the commands on sets:
+//
+//	SADD key member [member ...]  the number of members added
+//	SREM key member [member ...]  the number of members removed
+//	SMEMBERS key                  the members, sorted
+//	SISMEMBER key member          1 if member is in the set, 0 otherwise
+func setCommand(store storage.Storage, cmd string, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	key := string(args[1])
+	switch cmd {
+	case "SADD", "SREM":
+		if len(args) < 3 {
+			return errInvalidArguments
+		}
+		changed := 0
+		err := modifyKind(store, key, storage.KindSet, func(old []byte) ([]byte, error) {
+			members, err := decodeSet(old)
+			if err != nil {
+				return nil, err
+			}
+			for _, arg := range args[2:] {
+				member := string(arg)
+				_, ok := members[member]
+				switch {
+				case cmd == "SADD" && !ok:
+					members[member] = struct{}{}
+					changed++
+				case cmd == "SREM" && ok:
+					delete(members, member)
+					changed++
+				}
+			}
+			switch {
+			case changed == 0:
+				return nil, errUnchanged
+			case len(members) == 0:
+				return nil, nil
+			}
+			return storage.EncodeSet(members), nil
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(changed))
+	case "SISMEMBER":
+		if len(args) != 3 {
+			return errInvalidArguments
+		}
+		members, err := readSet(store, key)
+		if err != nil {
+			return storageError(err)
+		}
+		_, ok := members[string(args[2])]
+		return formatBool(ok)
+	default: // SMEMBERS
+		if len(args) != 2 {
+			return errInvalidArguments
+		}
+		members, err := readSet(store, key)
+		if err != nil {
+			return storageError(err)
+		}
+		items := make([][]byte, 0, len(members))
+		for _, member := range slices.Sorted(maps.Keys(members)) {
+			items = append(items, []byte(member))
+		}
+		return valueArray(items)
+	}
+}
+
+func readSet(store storage.Storage, key string) (map[string]struct{}, error) {
+	value, err := readKind(store, key, storage.KindSet)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSet(value)
+}
+
+// decodeSet decodes the value of a set, nil being an empty one.
+func decodeSet(value []byte) (map[string]struct{}, error) {
+	if value == nil {
+		return make(map[string]struct{}), nil
+	}
+	return storage.DecodeSet(value)
+}
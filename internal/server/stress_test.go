@@ -15,7 +15,7 @@ import (
 func TestTCPStressSingleConnection(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
 	defer cancel()
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -73,7 +73,7 @@ func TestTCPStressConcurrentClients(t *testing.T) {
 	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
 	defer cancel()
 
-	data := make(map[string][]byte)
+	data := make(map[string]storage.Entry)
 	store := storage.NewMemoryStorage(data)
 	srv := NewServer(":0", store)
 
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// session holds the transaction state of a connection. Between MULTI and
+// EXEC commands are queued instead of executed; EXEC then runs them all
+// at once, unless a key given to WATCH has changed in the meantime.
+type session struct {
+	inMulti bool
+	queue   [][][]byte
+	// watched maps the watched keys to their versions at the time of
+	// WATCH, 0 for a missing key.
+	watched map[string]uint64
+}
+
+func (sess *session) reset() {
+	sess.inMulti = false
+	sess.queue = nil
+	sess.watched = nil
+}
+
+var errWatchChanged = errors.New("watched key changed")
+
+// dispatch runs a command on behalf of the connection sess belongs to.
+func (s *Server) dispatch(sess *session, args [][]byte) protocol.Reply {
+	if len(args) == 0 {
+		return protocol.Error("empty command")
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "MULTI":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if sess.inMulti {
+			return protocol.Error("MULTI calls can not be nested")
+		}
+		sess.inMulti = true
+		return protocol.OK
+	case "EXEC":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if !sess.inMulti {
+			return protocol.Error("EXEC without MULTI")
+		}
+		defer sess.reset()
+		return s.execQueue(sess)
+	case "DISCARD":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if !sess.inMulti {
+			return protocol.Error("DISCARD without MULTI")
+		}
+		sess.reset()
+		return protocol.OK
+	case "WATCH":
+		if len(args) < 2 {
+			return errInvalidArguments
+		}
+		if sess.inMulti {
+			return protocol.Error("WATCH inside MULTI is not allowed")
+		}
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, key := range stringArgs(args[1:]) {
+			if _, ok := sess.watched[key]; ok {
+				continue
+			}
+			_, version, err := s.storage.GetVersion(key)
+			if err != nil {
+				return errInternal
+			}
+			sess.watched[key] = version
+		}
+		return protocol.OK
+	case "UNWATCH":
+		if len(args) != 1 {
+			return errInvalidArguments
+		}
+		if sess.inMulti {
+			return protocol.Error("UNWATCH inside MULTI is not allowed")
+		}
+		sess.watched = nil
+		return protocol.OK
+	case "SAVE", "BGSAVE", "LASTSAVE", "SNAPSHOTS", "RESTORESNAPSHOT", "INFO":
+		// These do not act on the keys, and SAVE, RESTORESNAPSHOT and INFO
+		// would wait for the storage that EXEC holds.
+		if sess.inMulti {
+			return protocol.Error("command not allowed inside MULTI")
+		}
+	}
+	if sess.inMulti {
+		sess.queue = append(sess.queue, args)
+		return protocol.Status("QUEUED")
+	}
+	return s.execute(args)
+}
+
+// execQueue runs the queued commands of sess in a single transaction and
+// replies with their replies, or with null if a watched key has changed.
+// A command that fails does not undo the others.
+func (s *Server) execQueue(sess *session) protocol.Reply {
+	var replies []protocol.Reply
+	err := s.storage.Atomic(func(tx storage.Storage) error {
+		for key, watched := range sess.watched {
+			_, version, err := tx.GetVersion(key)
+			if err != nil {
+				return err
+			}
+			if version != watched {
+				return errWatchChanged
+			}
+		}
+		replies = make([]protocol.Reply, len(sess.queue))
+		for i, args := range sess.queue {
+			replies[i] = s.exec(tx, args)
+		}
+		return nil
+	})
+	if errors.Is(err, errWatchChanged) {
+		return protocol.NullArray()
+	}
+	if err != nil {
+		return errInternal
+	}
+	return protocol.Array(replies)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+type testSession struct {
+	t    *testing.T
+	s    *Server
+	sess *session
+}
+
+func (c *testSession) run(cmd, want string) {
+	c.t.Helper()
+	if resp := protocol.FormatText(c.s.dispatch(c.sess, splitFields(cmd))); resp != want {
+		c.t.Fatalf("cmd %q: expected %q, got %q", cmd, want, resp)
+	}
+}
+
+func TestSessionMultiExec(t *testing.T) {
+	s := newTestServer()
+	c := &testSession{t: t, s: s, sess: &session{}}
+
+	c.run("EXEC", "ERROR EXEC without MULTI")
+	c.run("DISCARD", "ERROR DISCARD without MULTI")
+	c.run("MULTI", "OK")
+	c.run("MULTI", "ERROR MULTI calls can not be nested")
+	c.run("SET a 1", "QUEUED")
+	c.run("INCR a", "QUEUED")
+	c.run("INCR b x", "QUEUED")
+	c.run("GET a", "QUEUED")
+	c.run("SAVE", "ERROR command not allowed inside MULTI")
+	c.run("WATCH a", "ERROR WATCH inside MULTI is not allowed")
+	if resp := s.handleCommand("GET a"); resp != "NULL" {
+		t.Fatalf("expected queued commands not to run, got %q", resp)
+	}
+	c.run("EXEC", "ARRAY 4\nOK\nINTEGER 2\nERROR invalid arguments\nVALUE 2")
+	c.run("EXEC", "ERROR EXEC without MULTI")
+
+	c.run("MULTI", "OK")
+	c.run("SET a 3", "QUEUED")
+	c.run("DISCARD", "OK")
+	c.run("GET a", "VALUE 2")
+
+	c.run("MULTI", "OK")
+	c.run("EXEC", "ARRAY 0")
+}
+
+func TestSessionWatch(t *testing.T) {
+	s := newTestServer()
+	c := &testSession{t: t, s: s, sess: &session{}}
+
+	c.run("WATCH", "ERROR invalid arguments")
+	c.run("WATCH a missing", "OK")
+	c.run("MULTI", "OK")
+	c.run("SET a 1", "QUEUED")
+	s.handleCommand("SET missing 2")
+	c.run("EXEC", "NULL")
+	c.run("GET a", "NULL")
+
+	// EXEC clears the watches, whether it succeeds or not.
+	c.run("MULTI", "OK")
+	c.run("SET a 1", "QUEUED")
+	c.run("EXEC", "ARRAY 1\nOK")
+
+	c.run("WATCH a", "OK")
+	c.run("MULTI", "OK")
+	c.run("INCR a", "QUEUED")
+	c.run("EXEC", "ARRAY 1\nINTEGER 2")
+
+	c.run("WATCH a", "OK")
+	s.handleCommand("SET a 5")
+	c.run("UNWATCH", "OK")
+	c.run("MULTI", "OK")
+	c.run("INCR a", "QUEUED")
+	c.run("EXEC", "ARRAY 1\nINTEGER 6")
+
+	c.run("WATCH a", "OK")
+	c.run("MULTI", "OK")
+	c.run("DISCARD", "OK")
+	s.handleCommand("SET a 7")
+	c.run("MULTI", "OK")
+	c.run("INCR a", "QUEUED")
+	c.run("EXEC", "ARRAY 1\nINTEGER 8")
+}
+
+func TestSessionRejectsInfoInMulti(t *testing.T) {
+	store := storage.NewMemoryStorage(nil)
+	s := NewServer(":0", store, WithMemoryReporter(store))
+	c := &testSession{t: t, s: s, sess: &session{}}
+
+	// INFO reads the memory stats under the lock that EXEC holds.
+	c.run("MULTI", "OK")
+	c.run("SET a 1", "QUEUED")
+	c.run("INFO", "ERROR command not allowed inside MULTI")
+	c.run("EXEC", "ARRAY 1\nOK")
+	c.run("INFO stats", "ARRAY 2\nVALUE # Stats\nVALUE evicted_keys:0")
+}
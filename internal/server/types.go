@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// errUnchanged tells modifyKind that the value is left as it was.
+var errUnchanged = errors.New("unchanged")
+
+// keyType handles TYPE key.
+func keyType(store storage.Storage, args [][]byte) protocol.Reply {
+	if len(args) != 2 {
+		return errInvalidArguments
+	}
+	entry, ok, err := store.GetEntry(string(args[1]))
+	if err != nil {
+		return storageError(err)
+	}
+	if !ok {
+		return protocol.Status("none")
+	}
+	return protocol.Status(entry.Kind.String())
+}
+
+// readKind returns the value of key, which must hold kind, or nil if the
+// key does not exist.
+func readKind(store storage.Storage, key string, kind storage.Kind) ([]byte, error) {
+	entry, ok, err := store.GetEntry(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if entry.Kind != kind {
+		return nil, storage.ErrWrongType
+	}
+	return entry.Value, nil
+}
+
+// modifyKind atomically replaces the value of key, which must hold kind
+// or not exist, with fn(old). old is nil if the key does not exist. A nil
+// value from fn deletes the key, as collections are never left empty, and
+// errUnchanged leaves it as it is. The expiry of the key is kept.
+func modifyKind(store storage.Storage, key string, kind storage.Kind, fn func(old []byte) ([]byte, error)) error {
+	err := store.UpdateKind(key, kind, fn)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// rankRange resolves the start and stop indexes of LRANGE and ZRANGE,
+// which count from the end if negative, against a length of n. It returns
+// the half-open range of items, empty if the indexes select nothing.
+func rankRange(startArg, stopArg []byte, n int) (lo, hi int, ok bool) {
+	start, err := strconv.Atoi(string(startArg))
+	if err != nil {
+		return 0, 0, false
+	}
+	stop, err := strconv.Atoi(string(stopArg))
+	if err != nil {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	// stop is clamped before adding one, as it may be math.MaxInt.
+	lo, hi = max(start, 0), min(stop, n-1)+1
+	if lo >= hi {
+		return 0, 0, true
+	}
+	return lo, hi, true
+}
+
+func valueArray(items [][]byte) protocol.Reply {
+	replies := make([]protocol.Reply, len(items))
+	for i, item := range items {
+		replies[i] = protocol.Value(item)
+	}
+	return protocol.Array(replies)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/storage"
+	"github.com/aptolon/kv-store/internal/wal"
+)
+
+const wrongType = "ERROR WRONGTYPE Operation against a key holding the wrong kind of value"
+
+func TestHandleCommandTypes(t *testing.T) {
+	for name, s := range map[string]*Server{
+		"memory":  newTestServer(),
+		"sharded": NewServer(":0", storage.NewShardedStorage(4, nil)),
+	} {
+		t.Run(name, func(t *testing.T) { testTypeCommands(t, s) })
+	}
+}
+
+func testTypeCommands(t *testing.T, s *Server) {
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"TYPE h", "none"},
+		{"HSET h name alice age 30", "INTEGER 2"},
+		{"HSET h age 31 city paris", "INTEGER 1"},
+		{"HGET h age", "VALUE 31"},
+		{"HGET h missing", "NULL"},
+		{"HGETALL h", "ARRAY 6\nVALUE age\nVALUE 31\nVALUE city\nVALUE paris\nVALUE name\nVALUE alice"},
+		{"HDEL h age missing", "INTEGER 1"},
+		{"HDEL h name city", "INTEGER 2"},
+		{"TYPE h", "none"},
+		{"HGETALL h", "ARRAY 0"},
+		{"HSET h a", "ERROR invalid arguments"},
+
+		{"RPUSH l b c", "INTEGER 2"},
+		{"LPUSH l a z", "INTEGER 4"},
+		{"LRANGE l 0 -1", "ARRAY 4\nVALUE z\nVALUE a\nVALUE b\nVALUE c"},
+		{"LRANGE l -2 10", "ARRAY 2\nVALUE b\nVALUE c"},
+		{"LRANGE l 3 1", "ARRAY 0"},
+		{"LRANGE l 2 9223372036854775807", "ARRAY 2\nVALUE b\nVALUE c"},
+		{"LRANGE l -9223372036854775808 0", "ARRAY 1\nVALUE z"},
+		{"LRANGE l x 1", "ERROR value is not an integer or out of range"},
+		{"LPOP l", "VALUE z"},
+		{"RPOP l", "VALUE c"},
+		{"TYPE l", "list"},
+		{"LPOP l", "VALUE a"},
+		{"LPOP l", "VALUE b"},
+		{"LPOP l", "NULL"},
+		{"TYPE l", "none"},
+
+		{"SADD s b a b", "INTEGER 2"},
+		{"SADD s a", "INTEGER 0"},
+		{"SMEMBERS s", "ARRAY 2\nVALUE a\nVALUE b"},
+		{"SISMEMBER s a", "INTEGER 1"},
+		{"SISMEMBER s c", "INTEGER 0"},
+		{"SREM s a c", "INTEGER 1"},
+		{"TYPE s", "set"},
+		{"SREM s b", "INTEGER 1"},
+		{"SMEMBERS s", "ARRAY 0"},
+
+		{"ZADD z 2 b 1 a 2 c", "INTEGER 3"},
+		{"ZADD z 0 c -inf d", "INTEGER 1"},
+		{"ZADD z x a", "ERROR value is not a valid float"},
+		{"ZRANGE z 0 -1", "ARRAY 4\nVALUE d\nVALUE c\nVALUE a\nVALUE b"},
+		{"ZRANGE z 1 2 WITHSCORES", "ARRAY 4\nVALUE c\nVALUE 0\nVALUE a\nVALUE 1"},
+		{"ZRANGE z 0 9223372036854775807", "ARRAY 4\nVALUE d\nVALUE c\nVALUE a\nVALUE b"},
+		{"ZRANGEBYSCORE z 0 2", "ARRAY 3\nVALUE c\nVALUE a\nVALUE b"},
+		{"ZRANGEBYSCORE z (0 +inf WITHSCORES", "ARRAY 4\nVALUE a\nVALUE 1\nVALUE b\nVALUE 2"},
+		{"ZRANGEBYSCORE z -inf (1 WITHSCORES", "ARRAY 4\nVALUE d\nVALUE -inf\nVALUE c\nVALUE 0"},
+		{"ZRANGEBYSCORE z a 1", "ERROR min or max is not a float"},
+		{"TYPE z", "zset"},
+	}
+	for _, tt := range tests {
+		if resp := s.handleCommand(tt.cmd); resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestHandleCommandWrongType(t *testing.T) {
+	s := newTestServer()
+	s.handleCommand("SET str v")
+	s.handleCommand("HSET h f v")
+
+	for _, cmd := range []string{
+		"GET h", "GET h WITHVERSION", "INCR h", "INCRBYFLOAT h 1",
+		"HSET str f v", "HGET str f", "HGETALL str", "LPUSH h a", "LPOP h", "LRANGE h 0 1",
+		"SADD h a", "SISMEMBER h a", "ZADD h 1 a", "ZRANGE h 0 1", "ZRANGEBYSCORE h 0 1",
+	} {
+		if resp := s.handleCommand(cmd); resp != wrongType {
+			t.Fatalf("cmd %q: expected %q, got %q", cmd, wrongType, resp)
+		}
+	}
+
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"TYPE str", "string"},
+		{"TYPE h", "hash"},
+		{"MGET str h", "ARRAY 2\nVALUE v\nNULL"},
+		{"RANGE - +", "ARRAY 2\nNULL\nARRAY 4\nVALUE h\nNULL\nVALUE str\nVALUE v"},
+		{"EXPIRE h 100", "INTEGER 1"},
+		{"HSET h g w", "INTEGER 1"},
+		{"TTL h", "INTEGER 100"},
+		{"SET h v", "OK"},
+		{"GET h", "VALUE v"},
+		{"TYPE h", "string"},
+	}
+	for _, tt := range tests {
+		if resp := s.handleCommand(tt.cmd); resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
+
+func TestTypesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "kv.wal")
+	l, err := wal.Open(logPath, wal.SyncAlways)
+	if err != nil {
+		t.Fatalf("open wal error: %v", err)
+	}
+	s := NewServer(":0", wal.NewStorage(storage.NewMemoryStorage(nil), l))
+	for _, cmd := range []string{"HSET h f v", "RPUSH l a b", "SADD s m", "ZADD z 1.5 m", "LPOP l"} {
+		s.handleCommand(cmd)
+	}
+	l.Close()
+
+	store := storage.NewMemoryStorage(nil)
+	if err := wal.Replay(logPath, store); err != nil {
+		t.Fatalf("replay error: %v", err)
+	}
+	s = NewServer(":0", store)
+	tests := []struct {
+		cmd  string
+		resp string
+	}{
+		{"HGET h f", "VALUE v"},
+		{"LRANGE l 0 -1", "ARRAY 1\nVALUE b"},
+		{"SMEMBERS s", "ARRAY 1\nVALUE m"},
+		{"ZRANGE z 0 -1 WITHSCORES", "ARRAY 2\nVALUE m\nVALUE 1.5"},
+	}
+	for _, tt := range tests {
+		if resp := s.handleCommand(tt.cmd); resp != tt.resp {
+			t.Fatalf("cmd %q: expected %q, got %q", tt.cmd, tt.resp, resp)
+		}
+	}
+}
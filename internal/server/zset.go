@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aptolon/kv-store/internal/protocol"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+var errScoreRange = errors.New("min or max is not a float")
+
+// zsetCommand handles the commands on sorted sets, whose members are
+// ordered by score and then by member:
+//
+//	ZADD key score member [score member ...]  the number of members added
+//	ZRANGE key start stop [WITHSCORES]        the members by rank
+//	ZRANGEBYSCORE key min max [WITHSCORES]    the members by score
+//
+// The bounds of ZRANGEBYSCORE are inclusive unless prefixed with "(", and
+// may be -inf or +inf.
+func zsetCommand(store storage.Storage, cmd string, args [][]byte) protocol.Reply {
+	if len(args) < 2 {
+		return errInvalidArguments
+	}
+	key := string(args[1])
+	if cmd == "ZADD" {
+		if len(args) < 4 || len(args)%2 != 0 {
+			return errInvalidArguments
+		}
+		scores := make([]float64, 0, len(args)/2-1)
+		for i := 2; i < len(args); i += 2 {
+			score, err := parseScore(string(args[i]))
+			if err != nil {
+				return protocol.Error(errNotFloat.Error())
+			}
+			scores = append(scores, score)
+		}
+		added := 0
+		err := modifyKind(store, key, storage.KindZSet, func(old []byte) ([]byte, error) {
+			members, err := decodeZSet(old)
+			if err != nil {
+				return nil, err
+			}
+			index := make(map[string]int, len(members))
+			for i, m := range members {
+				index[m.Member] = i
+			}
+			for i, score := range scores {
+				member := string(args[3+2*i])
+				if j, ok := index[member]; ok {
+					members[j].Score = score
+					continue
+				}
+				index[member] = len(members)
+				members = append(members, storage.ZMember{Member: member, Score: score})
+				added++
+			}
+			return storage.EncodeZSet(members), nil
+		})
+		if err != nil {
+			return storageError(err)
+		}
+		return protocol.Integer(int64(added))
+	}
+
+	if len(args) != 4 && len(args) != 5 {
+		return errInvalidArguments
+	}
+	withScores := len(args) == 5
+	if withScores && !strings.EqualFold(string(args[4]), "WITHSCORES") {
+		return errInvalidArguments
+	}
+	value, err := readKind(store, key, storage.KindZSet)
+	if err != nil {
+		return storageError(err)
+	}
+	members, err := decodeZSet(value)
+	if err != nil {
+		return storageError(err)
+	}
+	if cmd == "ZRANGE" {
+		lo, hi, ok := rankRange(args[2], args[3], len(members))
+		if !ok {
+			return protocol.Error(errNotInteger.Error())
+		}
+		members = members[lo:hi]
+	} else { // ZRANGEBYSCORE
+		lower, lowerExcl, err := parseScoreBound(string(args[2]))
+		if err != nil {
+			return protocol.Error(err.Error())
+		}
+		upper, upperExcl, err := parseScoreBound(string(args[3]))
+		if err != nil {
+			return protocol.Error(err.Error())
+		}
+		members = slices.DeleteFunc(members, func(m storage.ZMember) bool {
+			return m.Score < lower || lowerExcl && m.Score == lower ||
+				m.Score > upper || upperExcl && m.Score == upper
+		})
+	}
+
+	items := make([][]byte, 0, 2*len(members))
+	for _, m := range members {
+		items = append(items, []byte(m.Member))
+		if withScores {
+			items = append(items, formatScore(m.Score))
+		}
+	}
+	return valueArray(items)
+}
+
+// decodeZSet decodes the value of a sorted set, nil being an empty one.
+func decodeZSet(value []byte) ([]storage.ZMember, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return storage.DecodeZSet(value)
+}
+
+// parseScore accepts any number but NaN, including -inf and +inf.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errNotFloat
+	}
+	return score, nil
+}
+
+// parseScoreBound parses a bound of ZRANGEBYSCORE, reporting whether it
+// is exclusive.
+func parseScoreBound(s string) (score float64, exclusive bool, err error) {
+	s, exclusive = strings.CutPrefix(s, "(")
+	score, err = parseScore(s)
+	if err != nil {
+		return 0, false, errScoreRange
+	}
+	return score, exclusive, nil
+}
+
+func formatScore(score float64) []byte {
+	switch {
+	case math.IsInf(score, 1):
+		return []byte("inf")
+	case math.IsInf(score, -1):
+		return []byte("-inf")
+	}
+	return strconv.AppendFloat(nil, score, 'f', -1, 64)
+}
@@ -0,0 +1,54 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aptolon/kv-store/internal/persistence"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// Replacer is the storage whose contents a restore replaces.
+type Replacer interface {
+	Replace(data map[string]storage.Entry)
+}
+
+// Restorer lists saved snapshot generations and restores a previous one.
+type Restorer struct {
+	history   persistence.HistoryRepository
+	target    Replacer
+	scheduler *Scheduler
+}
+
+func NewRestorer(history persistence.HistoryRepository, target Replacer, scheduler *Scheduler) *Restorer {
+	return &Restorer{
+		history:   history,
+		target:    target,
+		scheduler: scheduler,
+	}
+}
+
+func (r *Restorer) ListSnapshots(ctx context.Context) ([]persistence.SnapshotInfo, error) {
+	return r.history.ListSnapshots(ctx)
+}
+
+// RestoreSnapshot replaces the current state with generation id. The
+// generation is loaded and verified completely before anything is
+// replaced. The restored state is then saved as a new generation, so the
+// restore is durable once RestoreSnapshot returns without an error.
+func (r *Restorer) RestoreSnapshot(ctx context.Context, id int64) error {
+	data := make(map[string]storage.Entry)
+	err := r.history.LoadSnapshot(ctx, id, func(key string, entry storage.Entry) error {
+		data[key] = entry
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.target.Replace(data)
+	if err := r.scheduler.Save(ctx, true); err != nil {
+		return fmt.Errorf("save restored snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/persistence"
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+type fakeHistory struct {
+	persistence.HistoryRepository
+	entries map[string]storage.Entry
+	loadErr error
+}
+
+func (f *fakeHistory) LoadSnapshot(
+	ctx context.Context,
+	id int64,
+	fn func(key string, entry storage.Entry) error,
+) error {
+	for key, entry := range f.entries {
+		if err := fn(key, entry); err != nil {
+			return err
+		}
+	}
+	return f.loadErr
+}
+
+type fakeReplacer struct {
+	data map[string]storage.Entry
+}
+
+func (f *fakeReplacer) Replace(data map[string]storage.Entry) {
+	f.data = data
+}
+
+func TestRestorerRestoreSnapshot(t *testing.T) {
+	history := &fakeHistory{entries: map[string]storage.Entry{"a": {Value: []byte("1")}}}
+	target := &fakeReplacer{}
+	var modes []bool
+	scheduler := NewScheduler(
+		func(ctx context.Context, full bool) error {
+			if target.data == nil {
+				t.Fatalf("expected data to be replaced before the save")
+			}
+			modes = append(modes, full)
+			return nil
+		},
+		func() uint64 { return 0 },
+		Config{},
+	)
+	r := NewRestorer(history, target, scheduler)
+
+	if err := r.RestoreSnapshot(t.Context(), 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(target.data) != 1 || string(target.data["a"].Value) != "1" {
+		t.Fatalf("expected restored data, got %v", target.data)
+	}
+	if len(modes) != 1 || !modes[0] {
+		t.Fatalf("expected one full save, got %v", modes)
+	}
+}
+
+func TestRestorerRejectsCorruptSnapshot(t *testing.T) {
+	history := &fakeHistory{
+		entries: map[string]storage.Entry{"a": {Value: []byte("1")}},
+		loadErr: persistence.ErrSnapshotChecksum,
+	}
+	target := &fakeReplacer{}
+	scheduler := NewScheduler(
+		func(ctx context.Context, full bool) error { return nil },
+		func() uint64 { return 0 },
+		Config{},
+	)
+	r := NewRestorer(history, target, scheduler)
+
+	err := r.RestoreSnapshot(t.Context(), 1)
+	if !errors.Is(err, persistence.ErrSnapshotChecksum) {
+		t.Fatalf("expected %v, got %v", persistence.ErrSnapshotChecksum, err)
+	}
+	if target.data != nil {
+		t.Fatalf("expected data not to be replaced, got %v", target.data)
+	}
+}
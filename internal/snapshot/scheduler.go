@@ -0,0 +1,186 @@
+package snapshot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// SaveFunc writes a snapshot of the current state. When full is false it
+// may write only the changes since the previous successful save.
+type SaveFunc func(ctx context.Context, full bool) error
+
+type Config struct {
+	// Interval triggers a save when at least one write happened and
+	// Interval elapsed since the last successful save. Zero disables it.
+	Interval time.Duration
+	// Writes triggers a save once this many writes happened since the
+	// last successful save. Zero disables it.
+	Writes uint64
+}
+
+// checkInterval is how often Run evaluates the save triggers.
+const checkInterval = time.Second
+
+type run struct {
+	full bool
+	done chan struct{}
+	err  error
+}
+
+// Scheduler runs saves in the background and coalesces concurrent
+// requests: at most one save runs at a time, and every request made while
+// it runs is served by a single follow-up save, which is guaranteed to
+// observe all writes that happened before the request.
+//
+// The first save is always full; later ones are incremental unless a full
+// save is requested explicitly, e.g. to repair the stored snapshot.
+type Scheduler struct {
+	save    SaveFunc
+	changes func() uint64
+	cfg     Config
+
+	mu       sync.Mutex
+	running  *run
+	pending  *run
+	lastSave time.Time
+	lastErr  error
+	needFull bool
+	// saved is the changes counter observed at the start of the last
+	// successful save.
+	saved uint64
+}
+
+// NewScheduler creates a scheduler. changes must return a counter that
+// grows with every write to the storage.
+func NewScheduler(save SaveFunc, changes func() uint64, cfg Config) *Scheduler {
+	return &Scheduler{
+		save:     save,
+		changes:  changes,
+		cfg:      cfg,
+		needFull: true,
+		saved:    changes(),
+	}
+}
+
+// Run evaluates the interval and write-count triggers until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	if s.cfg.Interval <= 0 && s.cfg.Writes == 0 {
+		return
+	}
+	started := time.Now()
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if s.due(now, started) {
+				s.request(false)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) due(now, started time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running != nil {
+		return false
+	}
+	writes := s.changes() - s.saved
+	if writes == 0 {
+		return false
+	}
+	if s.cfg.Writes > 0 && writes >= s.cfg.Writes {
+		return true
+	}
+	last := s.lastSave
+	if last.IsZero() {
+		last = started
+	}
+	return s.cfg.Interval > 0 && now.Sub(last) >= s.cfg.Interval
+}
+
+// Save requests a snapshot and waits for it to complete.
+func (s *Scheduler) Save(ctx context.Context, full bool) error {
+	r, _ := s.request(full)
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BackgroundSave requests a snapshot without waiting for it. It reports
+// whether the save started immediately rather than being queued behind
+// one already in progress.
+func (s *Scheduler) BackgroundSave(full bool) bool {
+	_, started := s.request(full)
+	return started
+}
+
+// LastSave returns the time of the last successful save and the error of
+// the most recent save attempt, if it failed.
+func (s *Scheduler) LastSave() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSave, s.lastErr
+}
+
+func (s *Scheduler) request(full bool) (*run, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running == nil {
+		s.running = &run{full: full, done: make(chan struct{})}
+		go s.execute(s.running)
+		return s.running, true
+	}
+	if s.pending == nil {
+		s.pending = &run{done: make(chan struct{})}
+	}
+	s.pending.full = s.pending.full || full
+	return s.pending, false
+}
+
+func (s *Scheduler) execute(r *run) {
+	for r != nil {
+		s.mu.Lock()
+		full := r.full || s.needFull
+		s.mu.Unlock()
+
+		changes := s.changes()
+		start := time.Now()
+		r.err = s.save(context.Background(), full)
+		if r.err != nil {
+			log.Printf("snapshot save error: %v", r.err)
+		} else {
+			log.Printf("snapshot saved in %v", time.Since(start))
+		}
+
+		s.mu.Lock()
+		s.lastErr = r.err
+		if r.err == nil {
+			s.lastSave = start
+			s.saved = changes
+			if full {
+				s.needFull = false
+			}
+		} else if full {
+			// A failed full save may have discarded the tracked changes,
+			// so the next save cannot be incremental.
+			s.needFull = true
+		}
+		close(r.done)
+		s.running = s.pending
+		s.pending = nil
+		r = s.running
+		s.mu.Unlock()
+	}
+}
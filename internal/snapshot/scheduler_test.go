@@ -0,0 +1,181 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerSave(t *testing.T) {
+	var saves atomic.Int32
+	s := NewScheduler(
+		func(ctx context.Context, full bool) error {
+			saves.Add(1)
+			return nil
+		},
+		func() uint64 { return 0 },
+		Config{},
+	)
+
+	if err := s.Save(t.Context(), false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if saves.Load() != 1 {
+		t.Fatalf("expected 1 save, got %d", saves.Load())
+	}
+
+	lastSave, err := s.LastSave()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lastSave.IsZero() {
+		t.Fatalf("expected last save time to be set")
+	}
+}
+
+func TestSchedulerCoalescesConcurrentSaves(t *testing.T) {
+	var saves atomic.Int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	s := NewScheduler(
+		func(ctx context.Context, full bool) error {
+			saves.Add(1)
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+		func() uint64 { return 0 },
+		Config{},
+	)
+
+	if !s.BackgroundSave(false) {
+		t.Fatalf("expected first background save to start")
+	}
+	<-started
+
+	workers := 10
+	errCh := make(chan error, workers)
+	wg := &sync.WaitGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- s.Save(t.Context(), false)
+		}()
+	}
+	if s.BackgroundSave(false) {
+		t.Fatalf("expected background save to be queued")
+	}
+
+	// Let the first save finish; the queued requests share one more save.
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if saves.Load() != 2 {
+		t.Fatalf("expected 2 saves, got %d", saves.Load())
+	}
+}
+
+func TestSchedulerReportsFailure(t *testing.T) {
+	saveErr := errors.New("database is down")
+	fail := true
+	s := NewScheduler(
+		func(ctx context.Context, full bool) error {
+			if fail {
+				return saveErr
+			}
+			return nil
+		},
+		func() uint64 { return 0 },
+		Config{},
+	)
+
+	if err := s.Save(t.Context(), false); !errors.Is(err, saveErr) {
+		t.Fatalf("expected %v, got %v", saveErr, err)
+	}
+	lastSave, err := s.LastSave()
+	if !errors.Is(err, saveErr) {
+		t.Fatalf("expected %v, got %v", saveErr, err)
+	}
+	if !lastSave.IsZero() {
+		t.Fatalf("expected no successful save, got %v", lastSave)
+	}
+
+	fail = false
+	if err := s.Save(t.Context(), false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.LastSave(); err != nil {
+		t.Fatalf("expected error to be cleared, got %v", err)
+	}
+}
+
+func TestSchedulerDue(t *testing.T) {
+	var changes atomic.Uint64
+	s := NewScheduler(
+		func(ctx context.Context, full bool) error { return nil },
+		changes.Load,
+		Config{Interval: time.Minute, Writes: 100},
+	)
+	started := time.Now()
+
+	if s.due(started.Add(time.Hour), started) {
+		t.Fatalf("expected no save without writes")
+	}
+
+	changes.Add(1)
+	if s.due(started.Add(time.Second), started) {
+		t.Fatalf("expected no save before interval")
+	}
+	if !s.due(started.Add(time.Minute), started) {
+		t.Fatalf("expected save after interval")
+	}
+
+	changes.Add(99)
+	if !s.due(started.Add(time.Second), started) {
+		t.Fatalf("expected save after write threshold")
+	}
+
+	if err := s.Save(t.Context(), false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.due(time.Now().Add(time.Second), started) {
+		t.Fatalf("expected no save right after a successful save")
+	}
+}
+
+func TestSchedulerFullSaves(t *testing.T) {
+	var modes []bool
+	s := NewScheduler(
+		func(ctx context.Context, full bool) error {
+			modes = append(modes, full)
+			return nil
+		},
+		func() uint64 { return 0 },
+		Config{},
+	)
+
+	for _, full := range []bool{false, false, true, false} {
+		if err := s.Save(t.Context(), full); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := []bool{true, false, true, false}
+	if !slices.Equal(modes, want) {
+		t.Fatalf("expected save modes %v, got %v", want, modes)
+	}
+}
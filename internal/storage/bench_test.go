@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkStorageMix compares MemoryStorage with ShardedStorage under
+// parallel mixes of Get and Set over uniformly chosen keys. Run with
+// -cpu 1,4,16 to see how they scale.
+func BenchmarkStorageMix(b *testing.B) {
+	stores := []struct {
+		name string
+		new  func() Storage
+	}{
+		{"memory", func() Storage { return NewMemoryStorage(nil) }},
+		{"sharded-16", func() Storage { return NewShardedStorage(16, nil) }},
+		{"sharded-64", func() Storage { return NewShardedStorage(64, nil) }},
+	}
+	for _, writes := range []int{0, 10, 50, 100} {
+		for _, st := range stores {
+			b.Run(fmt.Sprintf("writes=%d%%/%s", writes, st.name), func(b *testing.B) {
+				benchmarkMix(b, st.new(), writes)
+			})
+		}
+	}
+}
+
+func benchmarkMix(b *testing.B, store Storage, writePercent int) {
+	const keyCount = 1 << 16
+	keys := make([]string, keyCount)
+	value := make([]byte, 64)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+		store.Set(keys[i], value)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+		for pb.Next() {
+			key := keys[rnd.IntN(keyCount)]
+			if rnd.IntN(100) < writePercent {
+				store.Set(key, value)
+			} else {
+				store.Get(key)
+			}
+		}
+	})
+}
+
+// BenchmarkStorageMultiMix measures MSET-style batches of 8 keys against
+// single-key reads, where ShardedStorage has to lock several shards.
+func BenchmarkStorageMultiMix(b *testing.B) {
+	stores := []struct {
+		name string
+		new  func() Storage
+	}{
+		{"memory", func() Storage { return NewMemoryStorage(nil) }},
+		{"sharded-16", func() Storage { return NewShardedStorage(16, nil) }},
+	}
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			store := st.new()
+			const keyCount = 1 << 16
+			value := make([]byte, 64)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				keys := make([]string, 8)
+				entries := make([]Entry, 8)
+				for pb.Next() {
+					if rnd.IntN(2) == 0 {
+						store.Get("key:" + strconv.Itoa(rnd.IntN(keyCount)))
+						continue
+					}
+					for i := range keys {
+						keys[i] = "key:" + strconv.Itoa(rnd.IntN(keyCount))
+						entries[i] = Entry{Value: value}
+					}
+					store.SetMulti(keys, entries)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrOutOfMemory is returned by writes that would take the storage over
+// its memory limit when no key can be evicted to make room.
+var ErrOutOfMemory = errors.New("storage: out of memory")
+
+// errShardFull is returned by a shard of a ShardedStorage that is over
+// the shared memory limit and has no key of its own left to evict. The
+// ShardedStorage then retries the write with every shard locked, so that
+// keys of the other shards can be evicted.
+var errShardFull = errors.New("storage: no key to evict in shard")
+
+// EvictionPolicy selects the keys evicted when the memory limit is
+// reached.
+type EvictionPolicy int
+
+const (
+	// NoEviction fails writes that need more memory.
+	NoEviction EvictionPolicy = iota
+	// AllKeysLRU evicts the least recently used key.
+	AllKeysLRU
+	// AllKeysLFU evicts the least frequently used key.
+	AllKeysLFU
+	// AllKeysRandom evicts a random key.
+	AllKeysRandom
+	// VolatileTTL evicts the key with an expiry that expires first. Writes
+	// fail if no key has an expiry.
+	VolatileTTL
+)
+
+var policyNames = []string{"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-ttl"}
+
+func (p EvictionPolicy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParseEvictionPolicy parses a policy name such as "allkeys-lru".
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for i, policyName := range policyNames {
+		if name == policyName {
+			return EvictionPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// Evictor is implemented by storages with a memory limit. A caller that
+// logs writes plans the evictions a write needs and logs them before the
+// write, so that replaying the log reproduces them.
+type Evictor interface {
+	// PlanEviction returns the keys to evict so that storing values under
+	// keys fits in the memory limit, or ErrOutOfMemory.
+	PlanEviction(keys []string, values [][]byte) ([]string, error)
+	// Evict deletes keys, counting them as evicted.
+	Evict(keys []string)
+}
+
+// MemoryStats describes the memory use of a storage.
+type MemoryStats struct {
+	// UsedBytes is the size of the keys and values plus a fixed overhead
+	// per key.
+	UsedBytes int64
+	// MaxBytes is the memory limit, 0 if there is none.
+	MaxBytes int64
+	Policy   EvictionPolicy
+	Keys     int
+	// Evicted counts the keys evicted so far.
+	Evicted uint64
+}
+
+const (
+	// entryOverhead approximates the memory a key takes besides its bytes
+	// and the bytes of its value: the entry, its map slot and its node in
+	// the index.
+	entryOverhead = 128
+	// evictionSamples is the number of keys compared to pick a key to
+	// evict, which approximates the policy without keeping keys ordered
+	// by use.
+	evictionSamples = 5
+	// lfuInitial is the use counter of a new key, so that it is not
+	// evicted right away under AllKeysLFU.
+	lfuInitial = 5
+)
+
+func entryCost(key string, valueLen int) int64 {
+	return int64(len(key)+valueLen) + entryOverhead
+}
+
+// recordAccess notes a use of e for the LRU and LFU policies. It may be
+// called with only the read lock held.
+func (e *entry) recordAccess(now time.Time) {
+	// The counter grows logarithmically, as in Redis: the higher it is,
+	// the less likely an access increments it.
+	if n := e.hits.Load(); n < 255 && rand.Uint32N((max(n, lfuInitial)-lfuInitial)*10+1) == 0 {
+		e.hits.Add(1)
+	}
+	e.lastAccess.Store(now.UnixNano())
+}
+
+// useCount returns the LFU counter of e, decayed by one for every minute
+// since its last access.
+func (e *entry) useCount(now time.Time) int64 {
+	idle := now.UnixNano() - e.lastAccess.Load()
+	return int64(e.hits.Load()) - idle/int64(time.Minute)
+}
+
+// SetMemoryLimit bounds the memory used by keys and values to maxBytes,
+// evicting keys by policy when a write would exceed it. 0 removes the
+// limit. Keys already stored are not evicted until the next write.
+func (s *MemoryStorage) SetMemoryLimit(maxBytes int64, policy EvictionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxMemory = maxBytes
+	s.policy = policy
+}
+
+func (s *MemoryStorage) MemoryStats() MemoryStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return MemoryStats{
+		UsedBytes: s.used,
+		MaxBytes:  s.maxMemory,
+		Policy:    s.policy,
+		Keys:      len(s.data),
+		Evicted:   s.evicted,
+	}
+}
+
+func (s *MemoryStorage) PlanEviction(keys []string, values [][]byte) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.planEviction(s.growth(keys, values), keys)
+}
+
+func (s *MemoryStorage) Evict(keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(keys)
+}
+
+// evict deletes keys, which may belong to other shards sharing the budget
+// of s if their locks are held.
+func (s *MemoryStorage) evict(keys []string) {
+	for _, key := range keys {
+		owner := s
+		if s.budget != nil {
+			owner = s.budget.owner(key)
+		}
+		if _, ok := owner.data[key]; ok {
+			owner.deleteEntry(key)
+			owner.evicted++
+		}
+	}
+}
+
+// growth returns how much more memory storing values under keys takes.
+func (s *MemoryStorage) growth(keys []string, values [][]byte) int64 {
+	var growth int64
+	for i, key := range keys {
+		growth += entryCost(key, len(values[i]))
+		if e, ok := s.data[key]; ok {
+			growth -= entryCost(key, len(e.value))
+		}
+	}
+	return growth
+}
+
+// makeRoom evicts keys other than keep until growth more bytes fit in the
+// memory limit, or returns ErrOutOfMemory without evicting any.
+func (s *MemoryStorage) makeRoom(growth int64, keep ...string) error {
+	victims, err := s.planEviction(growth, keep)
+	if err != nil {
+		return err
+	}
+	s.evict(victims)
+	return nil
+}
+
+// planEviction picks the keys other than keep that makeRoom would evict.
+// Each key is the best of a few sampled keys by the policy. A shard of a
+// ShardedStorage checks the memory used by all shards, and picks keys of
+// its own unless every shard is locked.
+func (s *MemoryStorage) planEviction(growth int64, keep []string) ([]string, error) {
+	used, shards := s.used, []*MemoryStorage{s}
+	if s.budget != nil {
+		used = s.budget.used.Load()
+		if s.budget.allLocked {
+			shards = s.budget.shards
+		}
+	}
+	if s.maxMemory <= 0 || used+growth <= s.maxMemory {
+		return nil, nil
+	}
+	if s.policy == NoEviction {
+		return nil, ErrOutOfMemory
+	}
+	skip := make(map[string]bool, len(keep))
+	for _, key := range keep {
+		skip[key] = true
+	}
+	now := s.now()
+	var victims []string
+	for freed := int64(0); used-freed+growth > s.maxMemory; {
+		victim, owner, ok := s.pickVictim(shards, skip, now)
+		if !ok {
+			if s.budget != nil && !s.budget.allLocked {
+				return nil, errShardFull
+			}
+			return nil, ErrOutOfMemory
+		}
+		skip[victim] = true
+		victims = append(victims, victim)
+		freed += entryCost(victim, len(owner.data[victim].value))
+	}
+	return victims, nil
+}
+
+// pickVictim samples a few keys of every shard in shards and returns the
+// best one to evict together with its shard.
+func (s *MemoryStorage) pickVictim(shards []*MemoryStorage, skip map[string]bool, now time.Time) (string, *MemoryStorage, bool) {
+	var best string
+	var bestEntry *entry
+	var owner *MemoryStorage
+	// Sampling starts at a random shard, so that AllKeysRandom, which
+	// takes the first key found, does not favour the first shard.
+	start := 0
+	if len(shards) > 1 {
+		start = rand.IntN(len(shards))
+	}
+	for i := range shards {
+		shard := shards[(start+i)%len(shards)]
+		sampled := 0
+		consider := func(key string) bool {
+			if skip[key] {
+				return true
+			}
+			e := shard.data[key]
+			if bestEntry == nil || s.worse(e, bestEntry, now) {
+				best, bestEntry, owner = key, e, shard
+			}
+			sampled++
+			return sampled < evictionSamples && s.policy != AllKeysRandom
+		}
+		if s.policy == VolatileTTL {
+			for key := range shard.volatile {
+				if !consider(key) {
+					break
+				}
+			}
+		} else {
+			for key := range shard.data {
+				if !consider(key) {
+					break
+				}
+			}
+		}
+		if bestEntry != nil && s.policy == AllKeysRandom {
+			break
+		}
+	}
+	return best, owner, bestEntry != nil
+}
+
+// worse reports whether a should be evicted rather than b.
+func (s *MemoryStorage) worse(a, b *entry, now time.Time) bool {
+	switch s.policy {
+	case AllKeysLRU:
+		return a.lastAccess.Load() < b.lastAccess.Load()
+	case AllKeysLFU:
+		ua, ub := a.useCount(now), b.useCount(now)
+		return ua < ub || ua == ub && a.lastAccess.Load() < b.lastAccess.Load()
+	case VolatileTTL:
+		return a.expireAt.Before(b.expireAt)
+	default:
+		return false
+	}
+}
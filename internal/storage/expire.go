@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// expireSampleSize is the number of volatile keys checked per round.
+	expireSampleSize = 20
+	// expireMaxRounds bounds the work done in a single cycle so that the
+	// write lock is never held for long.
+	expireMaxRounds = 16
+)
+
+// RunExpiry actively removes expired keys every interval until ctx is done.
+// Each cycle samples volatile keys and repeats while more than a quarter of
+// the sample turned out to be expired, so that keys nobody reads again do
+// not stay in memory forever.
+func (s *MemoryStorage) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expireCycle()
+		}
+	}
+}
+
+func (s *MemoryStorage) expireCycle() {
+	for range expireMaxRounds {
+		sampled, expired := s.expireSample()
+		if sampled == 0 || expired*4 <= sampled {
+			return
+		}
+	}
+}
+
+func (s *MemoryStorage) expireSample() (sampled, expired int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key := range s.volatile {
+		if sampled == expireSampleSize {
+			break
+		}
+		sampled++
+		if e, ok := s.data[key]; ok && e.expired(now) {
+			s.deleteEntry(key)
+			expired++
+		}
+	}
+	return sampled, expired
+}
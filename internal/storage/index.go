@@ -0,0 +1,83 @@
+package storage
+
+import "math/rand/v2"
+
+// indexMaxLevel allows for about 4^32 keys at the branching factor below.
+const indexMaxLevel = 32
+
+// index is a skip list that keeps the keys of a MemoryStorage in order, so
+// that ranges of keys can be read without sorting the whole key space.
+// Each node is promoted to the next level with probability 1/4.
+type index struct {
+	head  indexNode
+	level int
+	len   int
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newIndex() *index {
+	return &index{
+		head:  indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+	}
+}
+
+// path fills update with the last node before key on every level and
+// returns the first node at or after key.
+func (ix *index) path(key string, update *[indexMaxLevel]*indexNode) *indexNode {
+	n := &ix.head
+	for level := ix.level - 1; level >= 0; level-- {
+		for n.next[level] != nil && n.next[level].key < key {
+			n = n.next[level]
+		}
+		if update != nil {
+			update[level] = n
+		}
+	}
+	return n.next[0]
+}
+
+// insert adds key unless it is already there.
+func (ix *index) insert(key string) {
+	var update [indexMaxLevel]*indexNode
+	if n := ix.path(key, &update); n != nil && n.key == key {
+		return
+	}
+	level := 1
+	for level < indexMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	for ; ix.level < level; ix.level++ {
+		update[ix.level] = &ix.head
+	}
+	n := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := range level {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	ix.len++
+}
+
+func (ix *index) remove(key string) {
+	var update [indexMaxLevel]*indexNode
+	n := ix.path(key, &update)
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		update[i].next[i] = n.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.len--
+}
+
+// seek returns the first node whose key is at or after key, or nil.
+func (ix *index) seek(key string) *indexNode {
+	return ix.path(key, nil)
+}
@@ -1,63 +1,687 @@
 package storage
 
 import (
+	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+type entry struct {
+	value    []byte
+	expireAt time.Time
+	kind     Kind
+	// version changes on every write of the key.
+	version uint64
+	// lastAccess (in Unix nanoseconds) and hits track the use of the key
+	// for eviction. They change on reads, under the read lock.
+	lastAccess atomic.Int64
+	hits       atomic.Uint32
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// export returns the entry sharing its value.
+func (e *entry) export() Entry {
+	return Entry{Value: e.value, ExpireAt: e.expireAt, Kind: e.kind}
+}
+
 type MemoryStorage struct {
 	mu   sync.RWMutex
-	data map[string][]byte
+	data map[string]*entry
+	// index holds the keys of data in order, for scans.
+	index *index
+	// volatile holds the keys that have an expiry, so the active expiry
+	// cycle samples only them.
+	volatile map[string]struct{}
+	now      func() time.Time
+	// changes counts mutations, so that snapshots can be triggered after
+	// a number of writes.
+	changes atomic.Uint64
+	// dirty holds the keys set or deleted since the last TakeDelta.
+	dirty map[string]struct{}
+	// version is the last version given to an entry. It starts at the
+	// creation time in nanoseconds, so that versions seen before a restart
+	// are not given out again: versions are not part of snapshots.
+	version uint64
+	// used is the memory taken by the entries, as counted by entryCost.
+	used      int64
+	maxMemory int64
+	policy    EvictionPolicy
+	evicted   uint64
+	// budget is the memory limit shared with the other shards of a
+	// ShardedStorage, nil for a standalone storage.
+	budget *memoryBudget
+	// views are the open views, for which writes save the state they
+	// change.
+	views []*memoryView
 }
 
-func NewMemoryStorage(data map[string][]byte) *MemoryStorage {
-	res := make(map[string][]byte, len(data))
+func NewMemoryStorage(data map[string]Entry) *MemoryStorage {
+	s := &MemoryStorage{
+		data:     make(map[string]*entry, len(data)),
+		index:    newIndex(),
+		volatile: make(map[string]struct{}),
+		now:      time.Now,
+		dirty:    make(map[string]struct{}),
+	}
+	now := s.now()
+	s.version = uint64(now.UnixNano())
 	for k, v := range data {
-		cpy := make([]byte, len(v))
-		copy(cpy, v)
-		res[k] = cpy
+		e := &entry{
+			value:    copyBytes(v.Value),
+			expireAt: v.ExpireAt,
+			kind:     v.Kind,
+		}
+		if e.expired(now) {
+			continue
+		}
+		s.setEntry(k, e)
+	}
+	// The initial data is what is already saved.
+	s.dirty = make(map[string]struct{})
+	s.changes.Store(0)
+	return s
+}
+
+// Restore adds an entry loaded from a saved snapshot. Unlike Set it is
+// not tracked as a change, since the entry is already saved. The storage
+// takes ownership of loaded.Value.
+func (s *MemoryStorage) Restore(key string, loaded Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &entry{
+		value:    loaded.Value,
+		expireAt: loaded.ExpireAt,
+		kind:     loaded.Kind,
+	}
+	if e.expired(s.now()) {
+		return nil
 	}
-	return &MemoryStorage{
-		data: res,
+	s.preserve(key)
+	e.version = s.nextVersion()
+	e.hits.Store(lfuInitial)
+	e.lastAccess.Store(s.now().UnixNano())
+	if old, ok := s.data[key]; ok {
+		s.addUsed(-entryCost(key, len(old.value)))
+	} else {
+		s.index.insert(key)
 	}
+	s.addUsed(entryCost(key, len(e.value)))
+	s.data[key] = e
+	if e.expireAt.IsZero() {
+		delete(s.volatile, key)
+	} else {
+		s.volatile[key] = struct{}{}
+	}
+	return nil
 }
 
 func (s *MemoryStorage) Set(key string, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	result := make([]byte, len(value))
-	copy(result, value)
-	s.data[key] = result
+	return s.set(key, value)
+}
+
+func (s *MemoryStorage) set(key string, value []byte) error {
+	if err := s.makeRoom(s.growth([]string{key}, [][]byte{value}), key); err != nil {
+		return err
+	}
+	s.setEntry(key, &entry{value: copyBytes(value)})
+	return nil
+}
+
+func (s *MemoryStorage) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setWithExpiry(key, value, expireAt)
+}
+
+func (s *MemoryStorage) setWithExpiry(key string, value []byte, expireAt time.Time) error {
+	e := &entry{
+		value:    copyBytes(value),
+		expireAt: expireAt,
+	}
+	if e.expired(s.now()) {
+		s.deleteEntry(key)
+		return nil
+	}
+	if err := s.makeRoom(s.growth([]string{key}, [][]byte{value}), key); err != nil {
+		return err
+	}
+	s.setEntry(key, e)
 	return nil
 }
 
 func (s *MemoryStorage) Get(key string) ([]byte, error) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	value, ok := s.data[key]
+	e, ok := s.data[key]
 	if !ok {
+		s.mu.RUnlock()
 		return nil, nil
 	}
-	result := make([]byte, len(value))
-	copy(result, value)
+	now := s.now()
+	if e.expired(now) {
+		s.mu.RUnlock()
+		s.expireKey(key)
+		return nil, nil
+	}
+	if e.kind != KindString {
+		s.mu.RUnlock()
+		return nil, ErrWrongType
+	}
+	e.recordAccess(now)
+	result := copyBytes(e.value)
+	s.mu.RUnlock()
 	return result, nil
 }
 
+func (s *MemoryStorage) GetEntry(key string) (Entry, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getEntry(key)
+}
+
+func (s *MemoryStorage) getEntry(key string) (Entry, bool, error) {
+	now := s.now()
+	e, ok := s.data[key]
+	if !ok || e.expired(now) {
+		return Entry{}, false, nil
+	}
+	e.recordAccess(now)
+	res := e.export()
+	res.Value = copyBytes(e.value)
+	return res, true, nil
+}
+
 func (s *MemoryStorage) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.data, key)
+	return s.deleteKey(key)
+}
+
+func (s *MemoryStorage) deleteKey(key string) error {
+	s.deleteEntry(key)
+	return nil
+}
+
+func (s *MemoryStorage) GetMulti(keys []string) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getMulti(keys)
+}
+
+func (s *MemoryStorage) getMulti(keys []string) ([][]byte, error) {
+	now := s.now()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		// Expired entries are left for the expiry cycle, as a read lock
+		// is held.
+		if e, ok := s.data[key]; ok && !e.expired(now) && e.kind == KindString {
+			e.recordAccess(now)
+			values[i] = copyBytes(e.value)
+		}
+	}
+	return values, nil
+}
+
+func (s *MemoryStorage) SetMulti(keys []string, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setMulti(keys, entries)
+}
+
+func (s *MemoryStorage) setMulti(keys []string, entries []Entry) error {
+	if len(keys) != len(entries) {
+		return errors.New("storage: keys and entries differ in length")
+	}
+
+	values := make([][]byte, len(entries))
+	for i := range entries {
+		values[i] = entries[i].Value
+	}
+	if err := s.makeRoom(s.growth(keys, values), keys...); err != nil {
+		return err
+	}
+	now := s.now()
+	for i, key := range keys {
+		e := &entry{
+			value:    copyBytes(entries[i].Value),
+			expireAt: entries[i].ExpireAt,
+			kind:     entries[i].Kind,
+		}
+		if e.expired(now) {
+			s.deleteEntry(key)
+			continue
+		}
+		s.setEntry(key, e)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeleteMulti(keys []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deleteMulti(keys)
+}
+
+func (s *MemoryStorage) deleteMulti(keys []string) (int, error) {
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key); ok {
+			s.deleteEntry(key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStorage) GetVersion(key string) ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getVersion(key)
+}
+
+func (s *MemoryStorage) getVersion(key string) ([]byte, uint64, error) {
+	now := s.now()
+	e, ok := s.data[key]
+	if !ok || e.expired(now) {
+		return nil, 0, nil
+	}
+	e.recordAccess(now)
+	if e.kind != KindString {
+		return nil, e.version, nil
+	}
+	return copyBytes(e.value), e.version, nil
+}
+
+func (s *MemoryStorage) SetIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setIf(key, value, expireAt, cond)
+}
+
+func (s *MemoryStorage) setIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error) {
+	var res SetResult
+	if old, ok := s.lookup(key); ok {
+		if old.kind == KindString {
+			res.Previous = old.value
+		}
+		res.Version = old.version
+	}
+	if !cond.Holds(res.Version) {
+		return SetResult{Version: res.Version}, nil
+	}
+	res.Stored = true
+	e := &entry{
+		value:    copyBytes(value),
+		expireAt: expireAt,
+	}
+	if e.expired(s.now()) {
+		s.deleteEntry(key)
+		res.Version = 0
+		return res, nil
+	}
+	if err := s.makeRoom(s.growth([]string{key}, [][]byte{value}), key); err != nil {
+		return SetResult{}, err
+	}
+	s.setEntry(key, e)
+	res.Version = e.version
+	return res, nil
+}
+
+func (s *MemoryStorage) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(key, fn)
+}
+
+func (s *MemoryStorage) update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	var old []byte
+	var expireAt time.Time
+	if e, ok := s.lookup(key); ok {
+		if e.kind != KindString {
+			return nil, ErrWrongType
+		}
+		old = e.value
+		expireAt = e.expireAt
+	}
+	value, err := fn(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.makeRoom(s.growth([]string{key}, [][]byte{value}), key); err != nil {
+		return nil, err
+	}
+	s.setEntry(key, &entry{
+		value:    copyBytes(value),
+		expireAt: expireAt,
+	})
+	return value, nil
+}
+
+func (s *MemoryStorage) UpdateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateKind(key, kind, fn)
+}
+
+func (s *MemoryStorage) updateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error {
+	var old []byte
+	var expireAt time.Time
+	e, ok := s.lookup(key)
+	if ok {
+		if e.kind != kind {
+			return ErrWrongType
+		}
+		old = e.value
+		expireAt = e.expireAt
+	}
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if ok {
+			s.deleteEntry(key)
+		}
+		return nil
+	}
+	if err := s.makeRoom(s.growth([]string{key}, [][]byte{value}), key); err != nil {
+		return err
+	}
+	s.setEntry(key, &entry{
+		value:    copyBytes(value),
+		expireAt: expireAt,
+		kind:     kind,
+	})
 	return nil
 }
 
-func (s *MemoryStorage) Snapshot() map[string][]byte {
+func (s *MemoryStorage) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expireAt(key, expireAt)
+}
+
+func (s *MemoryStorage) expireAt(key string, expireAt time.Time) (bool, error) {
+	e, ok := s.lookup(key)
+	if !ok {
+		return false, nil
+	}
+	s.preserve(key)
+	e.expireAt = expireAt
+	if e.expired(s.now()) {
+		s.deleteEntry(key)
+		return true, nil
+	}
+	e.version = s.nextVersion()
+	s.volatile[key] = struct{}{}
+	s.touch(key)
+	return true, nil
+}
+
+func (s *MemoryStorage) Persist(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persist(key)
+}
+
+func (s *MemoryStorage) persist(key string) (bool, error) {
+	e, ok := s.lookup(key)
+	if !ok || e.expireAt.IsZero() {
+		return false, nil
+	}
+	s.preserve(key)
+	e.expireAt = time.Time{}
+	e.version = s.nextVersion()
+	delete(s.volatile, key)
+	s.touch(key)
+	return true, nil
+}
+
+func (s *MemoryStorage) ExpireTime(key string) (time.Time, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expireTime(key)
+}
+
+func (s *MemoryStorage) expireTime(key string) (time.Time, bool, error) {
+	e, ok := s.data[key]
+	if !ok || e.expired(s.now()) {
+		return time.Time{}, false, nil
+	}
+	return e.expireAt, true, nil
+}
+
+func (s *MemoryStorage) Keys(prefix string) ([]string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.keys(prefix)
+}
 
-	res := make(map[string][]byte, len(s.data))
-	for k, v := range s.data {
-		cpy := make([]byte, len(v))
-		copy(cpy, v)
-		res[k] = cpy
+func (s *MemoryStorage) keys(prefix string) ([]string, error) {
+	now := s.now()
+	var keys []string
+	for n := s.index.seek(prefix); n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+		if !s.data[n.key].expired(now) {
+			keys = append(keys, n.key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStorage) Scan(start, end string, limit int) ([]KeyValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scan(start, end, limit)
+}
+
+func (s *MemoryStorage) scan(start, end string, limit int) ([]KeyValue, error) {
+	now := s.now()
+	var items []KeyValue
+	for n := s.index.seek(start); n != nil && (end == "" || n.key < end); n = n.next[0] {
+		if limit > 0 && len(items) == limit {
+			break
+		}
+		// Expired entries are left for the expiry cycle, as a read lock
+		// may be held.
+		if e := s.data[n.key]; !e.expired(now) {
+			items = append(items, KeyValue{Key: n.key, Value: copyBytes(e.value), Kind: e.kind})
+		}
+	}
+	return items, nil
+}
+
+func (s *MemoryStorage) ScanPrefix(prefix string, limit int) ([]KeyValue, error) {
+	return s.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// Replace discards the contents of the storage and loads data instead,
+// taking ownership of the values. The tracked changes no longer describe
+// the difference to the saved state, so a full snapshot must follow.
+func (s *MemoryStorage) Replace(data map[string]Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(data)
+}
+
+func (s *MemoryStorage) replace(data map[string]Entry) {
+	if len(s.views) > 0 {
+		for key := range s.data {
+			s.preserve(key)
+		}
+		for key := range data {
+			s.preserve(key)
+		}
+	}
+	s.data = make(map[string]*entry, len(data))
+	s.index = newIndex()
+	s.volatile = make(map[string]struct{})
+	s.dirty = make(map[string]struct{})
+	s.addUsed(-s.used)
+	now := s.now()
+	for k, v := range data {
+		e := &entry{
+			value:    v.Value,
+			expireAt: v.ExpireAt,
+			kind:     v.Kind,
+		}
+		if e.expired(now) {
+			continue
+		}
+		e.version = s.nextVersion()
+		e.hits.Store(lfuInitial)
+		e.lastAccess.Store(now.UnixNano())
+		s.data[k] = e
+		s.index.insert(k)
+		s.addUsed(entryCost(k, len(e.value)))
+		if !e.expireAt.IsZero() {
+			s.volatile[k] = struct{}{}
+		}
 	}
-	return res
+	s.changes.Add(1)
+}
+
+// Changes returns the number of mutations applied so far.
+func (s *MemoryStorage) Changes() uint64 {
+	return s.changes.Load()
+}
+
+// Snapshot returns a copy of the live entries. It is read from a View, so
+// writes are not held up while the values are copied.
+func (s *MemoryStorage) Snapshot() map[string]Entry {
+	return collectView(s.View())
+}
+
+// TakeDelta returns the changes made since the previous call and starts
+// tracking anew. If the delta cannot be saved, hand it back with MarkDirty.
+func (s *MemoryStorage) TakeDelta() Delta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delta := Delta{Upserts: make(map[string]Entry)}
+	s.takeDeltaInto(&delta)
+	return delta
+}
+
+// takeDeltaInto adds the tracked changes to delta and starts tracking
+// anew.
+func (s *MemoryStorage) takeDeltaInto(delta *Delta) {
+	now := s.now()
+	for k := range s.dirty {
+		e, ok := s.data[k]
+		if !ok || e.expired(now) {
+			delta.Deletes = append(delta.Deletes, k)
+			continue
+		}
+		upsert := e.export()
+		upsert.Value = copyBytes(e.value)
+		delta.Upserts[k] = upsert
+	}
+	s.dirty = make(map[string]struct{})
+}
+
+// MarkDirty marks the keys of an unsaved delta as changed again, so that
+// their current state is part of the next delta.
+func (s *MemoryStorage) MarkDirty(delta Delta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k := range delta.Upserts {
+		s.dirty[k] = struct{}{}
+	}
+	for _, k := range delta.Deletes {
+		s.dirty[k] = struct{}{}
+	}
+}
+
+// ResetDirty forgets the tracked changes, typically right before a full
+// snapshot that covers them.
+func (s *MemoryStorage) ResetDirty() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = make(map[string]struct{})
+}
+
+// lookup returns the live entry for key, removing it if it has expired.
+// The caller must hold the write lock.
+func (s *MemoryStorage) lookup(key string) (*entry, bool) {
+	e, ok := s.data[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(s.now()) {
+		s.deleteEntry(key)
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *MemoryStorage) expireKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lookup(key)
+}
+
+func (s *MemoryStorage) setEntry(key string, e *entry) {
+	s.preserve(key)
+	e.version = s.nextVersion()
+	if old, ok := s.data[key]; ok {
+		s.addUsed(-entryCost(key, len(old.value)))
+		e.hits.Store(old.hits.Load())
+		e.recordAccess(s.now())
+	} else {
+		s.index.insert(key)
+		e.hits.Store(lfuInitial)
+		e.lastAccess.Store(s.now().UnixNano())
+	}
+	s.addUsed(entryCost(key, len(e.value)))
+	s.data[key] = e
+	s.touch(key)
+	if e.expireAt.IsZero() {
+		delete(s.volatile, key)
+	} else {
+		s.volatile[key] = struct{}{}
+	}
+}
+
+func (s *MemoryStorage) deleteEntry(key string) {
+	e, ok := s.data[key]
+	if !ok {
+		return
+	}
+	s.preserve(key)
+	s.addUsed(-entryCost(key, len(e.value)))
+	delete(s.data, key)
+	s.index.remove(key)
+	delete(s.volatile, key)
+	s.touch(key)
+}
+
+// addUsed adds n to the memory taken by the entries, and to the budget
+// shared with the other shards if any.
+func (s *MemoryStorage) addUsed(n int64) {
+	s.used += n
+	if s.budget != nil {
+		s.budget.used.Add(n)
+	}
+}
+
+func (s *MemoryStorage) nextVersion() uint64 {
+	s.version++
+	return s.version
+}
+
+func (s *MemoryStorage) touch(key string) {
+	s.changes.Add(1)
+	s.dirty[key] = struct{}{}
+}
+
+func copyBytes(b []byte) []byte {
+	cpy := make([]byte, len(b))
+	copy(cpy, b)
+	return cpy
 }
@@ -0,0 +1,569 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"iter"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ShardedStorage spreads keys over independently locked MemoryStorage
+// shards chosen by key hash, so that writes of different keys rarely wait
+// for each other. Calls involving several keys lock all the shards they
+// touch, in index order, and therefore see a single point in time just
+// like MemoryStorage.
+//
+// The memory limit applies to all shards together. A write over the limit
+// evicts keys of its own shard, and only if there are none left locks
+// every shard and evicts keys of the others, calling the function passed
+// to Update or UpdateKind again.
+type ShardedStorage struct {
+	shards []*MemoryStorage
+	seed   maphash.Seed
+	budget *memoryBudget
+}
+
+// memoryBudget is the memory used by the shards of a ShardedStorage,
+// which share its limit.
+type memoryBudget struct {
+	used   atomic.Int64
+	shards []*MemoryStorage
+	owner  func(key string) *MemoryStorage
+	// allLocked is set while every shard is write locked, so that a shard
+	// may evict keys of the others.
+	allLocked bool
+}
+
+func NewShardedStorage(shards int, data map[string]Entry) *ShardedStorage {
+	s := &ShardedStorage{
+		shards: make([]*MemoryStorage, max(shards, 1)),
+		seed:   maphash.MakeSeed(),
+	}
+	s.budget = &memoryBudget{shards: s.shards, owner: s.shard}
+	for i, part := range s.split(data) {
+		s.shards[i] = NewMemoryStorage(part)
+		s.shards[i].budget = s.budget
+		s.budget.used.Add(s.shards[i].used)
+	}
+	return s
+}
+
+func (s *ShardedStorage) Restore(key string, loaded Entry) error {
+	return s.shard(key).Restore(key, loaded)
+}
+
+func (s *ShardedStorage) Set(key string, value []byte) error {
+	return s.write(key, func(shard *MemoryStorage) error {
+		return shard.set(key, value)
+	})
+}
+
+func (s *ShardedStorage) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	return s.write(key, func(shard *MemoryStorage) error {
+		return shard.setWithExpiry(key, value, expireAt)
+	})
+}
+
+func (s *ShardedStorage) Get(key string) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedStorage) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+func (s *ShardedStorage) GetEntry(key string) (Entry, bool, error) {
+	return s.shard(key).GetEntry(key)
+}
+
+func (s *ShardedStorage) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	return s.shard(key).ExpireAt(key, expireAt)
+}
+
+func (s *ShardedStorage) Persist(key string) (bool, error) {
+	return s.shard(key).Persist(key)
+}
+
+func (s *ShardedStorage) ExpireTime(key string) (time.Time, bool, error) {
+	return s.shard(key).ExpireTime(key)
+}
+
+func (s *ShardedStorage) GetVersion(key string) ([]byte, uint64, error) {
+	return s.shard(key).GetVersion(key)
+}
+
+func (s *ShardedStorage) SetIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error) {
+	var res SetResult
+	err := s.write(key, func(shard *MemoryStorage) error {
+		var err error
+		res, err = shard.setIf(key, value, expireAt, cond)
+		return err
+	})
+	return res, err
+}
+
+func (s *ShardedStorage) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	var value []byte
+	err := s.write(key, func(shard *MemoryStorage) error {
+		var err error
+		value, err = shard.update(key, fn)
+		return err
+	})
+	return value, err
+}
+
+func (s *ShardedStorage) UpdateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error {
+	return s.write(key, func(shard *MemoryStorage) error {
+		return shard.updateKind(key, kind, fn)
+	})
+}
+
+// write runs fn with the shard of key locked, and again with every shard
+// locked if the shard has no key left to evict.
+func (s *ShardedStorage) write(key string, fn func(shard *MemoryStorage) error) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	err := fn(shard)
+	shard.mu.Unlock()
+	if !errors.Is(err, errShardFull) {
+		return err
+	}
+	defer s.lock(nil, true)()
+	return fn(shard)
+}
+
+func (s *ShardedStorage) Keys(prefix string) ([]string, error) {
+	defer s.lock(nil, false)()
+	return s.keys(prefix)
+}
+
+func (s *ShardedStorage) keys(prefix string) ([]string, error) {
+	var keys []string
+	for _, shard := range s.shards {
+		part, err := shard.keys(prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, part...)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (s *ShardedStorage) Scan(start, end string, limit int) ([]KeyValue, error) {
+	defer s.lock(nil, false)()
+	return s.scan(start, end, limit)
+}
+
+func (s *ShardedStorage) scan(start, end string, limit int) ([]KeyValue, error) {
+	var items []KeyValue
+	for _, shard := range s.shards {
+		part, err := shard.scan(start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, part...)
+	}
+	slices.SortFunc(items, func(a, b KeyValue) int { return strings.Compare(a.Key, b.Key) })
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (s *ShardedStorage) ScanPrefix(prefix string, limit int) ([]KeyValue, error) {
+	return s.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+func (s *ShardedStorage) GetMulti(keys []string) ([][]byte, error) {
+	defer s.lock(keys, false)()
+	return s.getMulti(keys)
+}
+
+func (s *ShardedStorage) getMulti(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		// getVersion leaves expired entries alone, as a read lock may be
+		// held.
+		values[i], _, _ = s.shard(key).getVersion(key)
+	}
+	return values, nil
+}
+
+func (s *ShardedStorage) SetMulti(keys []string, entries []Entry) error {
+	unlock := s.lock(keys, true)
+	err := s.setMulti(keys, entries)
+	unlock()
+	if !errors.Is(err, errShardFull) {
+		return err
+	}
+	defer s.lock(nil, true)()
+	return s.setMulti(keys, entries)
+}
+
+func (s *ShardedStorage) setMulti(keys []string, entries []Entry) error {
+	if len(keys) != len(entries) {
+		return errors.New("storage: keys and entries differ in length")
+	}
+	// Room is made on every shard first, so that the keys are stored
+	// either all or none.
+	values := make([][]byte, len(entries))
+	for i := range entries {
+		values[i] = entries[i].Value
+	}
+	victims, err := s.planEviction(keys, values)
+	if err != nil {
+		return err
+	}
+	s.evict(victims)
+	for i, key := range keys {
+		if err := s.shard(key).setMulti(keys[i:i+1], entries[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStorage) DeleteMulti(keys []string) (int, error) {
+	defer s.lock(keys, true)()
+	return s.deleteMulti(keys)
+}
+
+func (s *ShardedStorage) deleteMulti(keys []string) (int, error) {
+	deleted := 0
+	for i, key := range keys {
+		n, err := s.shard(key).deleteMulti(keys[i : i+1])
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+func (s *ShardedStorage) Atomic(fn func(tx Storage) error) error {
+	defer s.lock(nil, true)()
+	return fn(shardedTx{s})
+}
+
+// Replace discards the contents of the storage and loads data instead,
+// like MemoryStorage.Replace.
+func (s *ShardedStorage) Replace(data map[string]Entry) {
+	defer s.lock(nil, true)()
+	for i, part := range s.split(data) {
+		s.shards[i].replace(part)
+	}
+}
+
+// Changes returns the number of mutations applied so far.
+func (s *ShardedStorage) Changes() uint64 {
+	var changes uint64
+	for _, shard := range s.shards {
+		changes += shard.Changes()
+	}
+	return changes
+}
+
+// Snapshot returns the live entries of all shards as of a single point in
+// time.
+func (s *ShardedStorage) Snapshot() map[string]Entry {
+	return collectView(s.View())
+}
+
+// View takes a view of all shards at the same point in time.
+func (s *ShardedStorage) View() View {
+	defer s.lock(nil, true)()
+	v := make(shardedView, len(s.shards))
+	for i, shard := range s.shards {
+		v[i] = shard.view()
+	}
+	return v
+}
+
+// shardedView yields the views of the shards one after another.
+type shardedView []*memoryView
+
+func (v shardedView) All() iter.Seq2[string, Entry] {
+	return func(yield func(string, Entry) bool) {
+		for _, shard := range v {
+			for key, entry := range shard.All() {
+				if !yield(key, entry) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v shardedView) Close() {
+	for _, shard := range v {
+		shard.Close()
+	}
+}
+
+// TakeDelta returns the changes made since the previous call and starts
+// tracking anew, like MemoryStorage.TakeDelta.
+func (s *ShardedStorage) TakeDelta() Delta {
+	defer s.lock(nil, true)()
+	delta := Delta{Upserts: make(map[string]Entry)}
+	for _, shard := range s.shards {
+		shard.takeDeltaInto(&delta)
+	}
+	return delta
+}
+
+// MarkDirty marks the keys of an unsaved delta as changed again.
+func (s *ShardedStorage) MarkDirty(delta Delta) {
+	defer s.lock(nil, true)()
+	for k := range delta.Upserts {
+		s.shard(k).dirty[k] = struct{}{}
+	}
+	for _, k := range delta.Deletes {
+		s.shard(k).dirty[k] = struct{}{}
+	}
+}
+
+// ResetDirty forgets the tracked changes of all shards.
+func (s *ShardedStorage) ResetDirty() {
+	defer s.lock(nil, true)()
+	for _, shard := range s.shards {
+		shard.dirty = make(map[string]struct{})
+	}
+}
+
+// SetMemoryLimit bounds the memory used by the keys and values of all
+// shards together, like MemoryStorage.SetMemoryLimit.
+func (s *ShardedStorage) SetMemoryLimit(maxBytes int64, policy EvictionPolicy) {
+	for _, shard := range s.shards {
+		shard.SetMemoryLimit(maxBytes, policy)
+	}
+}
+
+func (s *ShardedStorage) MemoryStats() MemoryStats {
+	var stats MemoryStats
+	for _, shard := range s.shards {
+		shardStats := shard.MemoryStats()
+		stats.UsedBytes += shardStats.UsedBytes
+		stats.MaxBytes = shardStats.MaxBytes
+		stats.Policy = shardStats.Policy
+		stats.Keys += shardStats.Keys
+		stats.Evicted += shardStats.Evicted
+	}
+	return stats
+}
+
+func (s *ShardedStorage) PlanEviction(keys []string, values [][]byte) ([]string, error) {
+	unlock := s.lock(keys, false)
+	victims, err := s.planEviction(keys, values)
+	unlock()
+	if !errors.Is(err, errShardFull) {
+		return victims, err
+	}
+	defer s.lock(nil, true)()
+	return s.planEviction(keys, values)
+}
+
+// planEviction plans the evictions needed to store values under keys,
+// whose shards must be locked, from the shard of the first key or, if
+// every shard is locked, from all of them.
+func (s *ShardedStorage) planEviction(keys []string, values [][]byte) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	var growth int64
+	for i, key := range keys {
+		growth += s.shard(key).growth(keys[i:i+1], values[i:i+1])
+	}
+	return s.shard(keys[0]).planEviction(growth, keys)
+}
+
+func (s *ShardedStorage) Evict(keys []string) {
+	for _, key := range keys {
+		s.shard(key).Evict([]string{key})
+	}
+}
+
+// evict deletes victims planned with the shards they belong to locked.
+func (s *ShardedStorage) evict(victims []string) {
+	for _, victim := range victims {
+		s.shard(victim).evict([]string{victim})
+	}
+}
+
+// RunExpiry actively removes expired keys from every shard each interval
+// until ctx is done, like MemoryStorage.RunExpiry.
+func (s *ShardedStorage) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, shard := range s.shards {
+				shard.expireCycle()
+			}
+		}
+	}
+}
+
+func (s *ShardedStorage) shardIndex(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+func (s *ShardedStorage) shard(key string) *MemoryStorage {
+	return s.shards[s.shardIndex(key)]
+}
+
+// split divides data by shard.
+func (s *ShardedStorage) split(data map[string]Entry) []map[string]Entry {
+	parts := make([]map[string]Entry, len(s.shards))
+	for i := range parts {
+		parts[i] = make(map[string]Entry, len(data)/len(parts))
+	}
+	for k, v := range data {
+		parts[s.shardIndex(k)][k] = v
+	}
+	return parts
+}
+
+// lock locks the shards holding keys, or all shards if keys is nil, and
+// returns a function that unlocks them. Shards are locked in index order,
+// so that calls locking several shards cannot deadlock.
+func (s *ShardedStorage) lock(keys []string, write bool) func() {
+	var used []bool
+	if keys != nil {
+		used = make([]bool, len(s.shards))
+		for _, key := range keys {
+			used[s.shardIndex(key)] = true
+		}
+	}
+	locked := make([]*MemoryStorage, 0, len(s.shards))
+	for i, shard := range s.shards {
+		if used != nil && !used[i] {
+			continue
+		}
+		if write {
+			shard.mu.Lock()
+		} else {
+			shard.mu.RLock()
+		}
+		locked = append(locked, shard)
+	}
+	all := used == nil && write
+	if all {
+		s.budget.allLocked = true
+	}
+	return func() {
+		if all {
+			s.budget.allLocked = false
+		}
+		for _, shard := range locked {
+			if write {
+				shard.mu.Unlock()
+			} else {
+				shard.mu.RUnlock()
+			}
+		}
+	}
+}
+
+// shardedTx gives access to a ShardedStorage whose shards are all write
+// locked.
+type shardedTx struct {
+	s *ShardedStorage
+}
+
+func (tx shardedTx) on(key string) memoryTx {
+	return memoryTx{tx.s.shard(key)}
+}
+
+func (tx shardedTx) Set(key string, value []byte) error {
+	return tx.on(key).Set(key, value)
+}
+
+func (tx shardedTx) Get(key string) ([]byte, error) {
+	return tx.on(key).Get(key)
+}
+
+func (tx shardedTx) Delete(key string) error {
+	return tx.on(key).Delete(key)
+}
+
+func (tx shardedTx) GetEntry(key string) (Entry, bool, error) {
+	return tx.on(key).GetEntry(key)
+}
+
+func (tx shardedTx) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	return tx.on(key).SetWithExpiry(key, value, expireAt)
+}
+
+func (tx shardedTx) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	return tx.on(key).ExpireAt(key, expireAt)
+}
+
+func (tx shardedTx) Persist(key string) (bool, error) {
+	return tx.on(key).Persist(key)
+}
+
+func (tx shardedTx) ExpireTime(key string) (time.Time, bool, error) {
+	return tx.on(key).ExpireTime(key)
+}
+
+func (tx shardedTx) Keys(prefix string) ([]string, error) {
+	return tx.s.keys(prefix)
+}
+
+func (tx shardedTx) Scan(start, end string, limit int) ([]KeyValue, error) {
+	return tx.s.scan(start, end, limit)
+}
+
+func (tx shardedTx) ScanPrefix(prefix string, limit int) ([]KeyValue, error) {
+	return tx.s.scan(prefix, PrefixEnd(prefix), limit)
+}
+
+func (tx shardedTx) GetMulti(keys []string) ([][]byte, error) {
+	return tx.s.getMulti(keys)
+}
+
+func (tx shardedTx) SetMulti(keys []string, entries []Entry) error {
+	return tx.s.setMulti(keys, entries)
+}
+
+func (tx shardedTx) DeleteMulti(keys []string) (int, error) {
+	return tx.s.deleteMulti(keys)
+}
+
+func (tx shardedTx) GetVersion(key string) ([]byte, uint64, error) {
+	return tx.on(key).GetVersion(key)
+}
+
+func (tx shardedTx) SetIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error) {
+	return tx.on(key).SetIf(key, value, expireAt, cond)
+}
+
+func (tx shardedTx) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	return tx.on(key).Update(key, fn)
+}
+
+func (tx shardedTx) UpdateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error {
+	return tx.on(key).UpdateKind(key, kind, fn)
+}
+
+func (tx shardedTx) PlanEviction(keys []string, values [][]byte) ([]string, error) {
+	return tx.s.planEviction(keys, values)
+}
+
+func (tx shardedTx) Evict(keys []string) {
+	tx.s.evict(keys)
+}
+
+// Atomic runs fn right away, as the storage is already held.
+func (tx shardedTx) Atomic(fn func(tx Storage) error) error {
+	return fn(tx)
+}
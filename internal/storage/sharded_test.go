@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedStorage(t *testing.T) {
+	store := NewShardedStorage(8, map[string]Entry{"loaded": {Value: []byte("1")}})
+
+	if got, _ := store.Get("loaded"); string(got) != "1" {
+		t.Fatalf("expected initial data, got %q", got)
+	}
+	for i := range 100 {
+		store.Set(fmt.Sprintf("key:%03d", i), []byte(fmt.Sprint(i)))
+	}
+	store.SetWithExpiry("gone", []byte("x"), time.Now().Add(-time.Second))
+
+	keys, _ := store.Keys("key:")
+	if len(keys) != 100 || !slices.IsSorted(keys) {
+		t.Fatalf("expected 100 sorted keys, got %d", len(keys))
+	}
+	items, _ := store.Scan("key:050", "", 3)
+	if len(items) != 3 || items[0].Key != "key:050" || items[2].Key != "key:052" || string(items[2].Value) != "52" {
+		t.Fatalf("unexpected scan %v", items)
+	}
+
+	values, _ := store.GetMulti([]string{"key:001", "missing", "key:099"})
+	if string(values[0]) != "1" || values[1] != nil || string(values[2]) != "99" {
+		t.Fatalf("unexpected values %q", values)
+	}
+	deleted, _ := store.DeleteMulti([]string{"key:001", "key:001", "missing"})
+	if deleted != 1 {
+		t.Fatalf("expected 1 deleted key, got %d", deleted)
+	}
+
+	res, _ := store.SetIf("key:002", []byte("x"), time.Time{}, Condition{Kind: IfAbsent})
+	if res.Stored {
+		t.Fatalf("expected SetIf NX on an existing key to fail")
+	}
+
+	delta := store.TakeDelta()
+	if len(delta.Upserts) != 99 || !slices.Equal(delta.Deletes, []string{"key:001"}) {
+		t.Fatalf("unexpected delta with %d upserts and deletes %v", len(delta.Upserts), delta.Deletes)
+	}
+	if delta = store.TakeDelta(); len(delta.Upserts) != 0 || len(delta.Deletes) != 0 {
+		t.Fatalf("expected an empty delta, got %v", delta)
+	}
+
+	store.Replace(map[string]Entry{"a": {Value: []byte("1")}, "b": {Value: []byte("2")}})
+	if snapshot := store.Snapshot(); len(snapshot) != 2 || string(snapshot["b"].Value) != "2" {
+		t.Fatalf("unexpected snapshot after replace %v", snapshot)
+	}
+}
+
+func TestShardedStorageAtomicAcrossShards(t *testing.T) {
+	store := NewShardedStorage(16, nil)
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+	}
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		entries := make([]Entry, len(keys))
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for j := range entries {
+				entries[j] = Entry{Value: []byte(fmt.Sprint(i))}
+			}
+			store.SetMulti(keys, entries)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			store.Atomic(func(tx Storage) error {
+				for _, key := range keys {
+					tx.Delete(key)
+				}
+				return nil
+			})
+		}
+	}()
+
+	consistent := func(values [][]byte) bool {
+		for _, value := range values {
+			if string(value) != string(values[0]) {
+				return false
+			}
+		}
+		return true
+	}
+	for range 500 {
+		values, _ := store.GetMulti(keys)
+		if !consistent(values) {
+			close(done)
+			t.Fatalf("partial write observed by GetMulti: %q", values)
+		}
+		snapshot := store.Snapshot()
+		values = values[:0]
+		for _, key := range keys {
+			values = append(values, snapshot[key].Value)
+		}
+		if !consistent(values) {
+			close(done)
+			t.Fatalf("partial write observed by Snapshot: %q", values)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestShardedStorageMemoryLimit(t *testing.T) {
+	store := NewShardedStorage(4, nil)
+	store.SetMemoryLimit(4*10*entryCost("key:000", 1), AllKeysLRU)
+	for i := range 200 {
+		if err := store.Set(fmt.Sprintf("key:%03d", i), []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	stats := store.MemoryStats()
+	if stats.UsedBytes > stats.MaxBytes || stats.Keys+int(stats.Evicted) != 200 || stats.Policy != AllKeysLRU {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	store.SetMemoryLimit(stats.UsedBytes, NoEviction)
+	keys := []string{"new:1", "new:2", "new:3", "new:4"}
+	entries := make([]Entry, len(keys))
+	for i := range entries {
+		entries[i].Value = []byte("x")
+	}
+	if err := store.SetMulti(keys, entries); err != ErrOutOfMemory {
+		t.Fatalf("expected %v, got %v", ErrOutOfMemory, err)
+	}
+	if values, _ := store.GetMulti(keys); slices.ContainsFunc(values, func(v []byte) bool { return v != nil }) {
+		t.Fatalf("expected a refused SetMulti to store no key, got %q", values)
+	}
+}
+
+func TestShardedStorageMemoryLimitIsGlobal(t *testing.T) {
+	store := NewShardedStorage(8, nil)
+	cost := entryCost("key:000", 1)
+	store.SetMemoryLimit(10*cost, AllKeysLRU)
+	if stats := store.MemoryStats(); stats.MaxBytes != 10*cost {
+		t.Fatalf("expected the limit to be reported whole, got %+v", stats)
+	}
+
+	// A value larger than an even share of a shard fits the whole limit.
+	big := make([]byte, 5*cost)
+	if err := store.Set("big", big); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Delete("big"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Keys of one shard are kept while the total is below the limit.
+	// The other keys go to distinct shards, so that neither can make room
+	// by evicting the other.
+	var own, other []string
+	for i := 0; len(own) < 10 || len(other) < 2; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		switch index := store.shardIndex(key); {
+		case index == 0:
+			own = append(own, key)
+		case len(other) == 0 || len(other) == 1 && index != store.shardIndex(other[0]):
+			other = append(other, key)
+		}
+	}
+	for _, key := range own[:10] {
+		if err := store.Set(key, []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := store.MemoryStats(); stats.Evicted != 0 || stats.Keys != 10 {
+		t.Fatalf("expected no eviction below the limit, got %+v", stats)
+	}
+
+	// A shard without keys makes room by evicting keys of the others.
+	victims, err := store.PlanEviction(other[:1], [][]byte{[]byte("x")})
+	if err != nil || len(victims) != 1 || store.shardIndex(victims[0]) != 0 {
+		t.Fatalf("expected to plan the eviction of a key of shard 0, got %q, %v", victims, err)
+	}
+	if err := store.Set(other[0], []byte("x")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.SetMulti(other[1:2], []Entry{{Value: []byte("x")}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats := store.MemoryStats()
+	if stats.Evicted != 2 || stats.Keys != 10 || stats.UsedBytes > stats.MaxBytes {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if values, _ := store.GetMulti(other[:2]); values[0] == nil || values[1] == nil {
+		t.Fatalf("expected the new keys to be stored, got %q", values)
+	}
+}
+
+func TestShardedStorageTypedEntries(t *testing.T) {
+	store := NewShardedStorage(8, map[string]Entry{"loaded": {Value: EncodeList(nil), Kind: KindList}})
+	hash := EncodeHash(map[string][]byte{"f": []byte("v")})
+	keys := []string{"h", "s"}
+	if err := store.SetMulti(keys, []Entry{{Value: hash, Kind: KindHash}, {Value: EncodeSet(nil), Kind: KindSet}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err := store.Atomic(func(tx Storage) error {
+		return tx.SetMulti([]string{"z"}, []Entry{{Value: EncodeZSet(nil), Kind: KindZSet}})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for key, want := range map[string]Kind{"loaded": KindList, "h": KindHash, "s": KindSet, "z": KindZSet} {
+		entry, ok, _ := store.GetEntry(key)
+		if !ok || entry.Kind != want {
+			t.Fatalf("key %q: expected kind %v, got %v", key, want, entry.Kind)
+		}
+		if _, err := store.Get(key); err != ErrWrongType {
+			t.Fatalf("key %q: expected %v, got %v", key, ErrWrongType, err)
+		}
+	}
+	if got := store.Snapshot()["h"]; got.Kind != KindHash || string(got.Value) != string(hash) {
+		t.Fatalf("expected the hash in the snapshot, got %v", got)
+	}
+}
+
+func TestShardedStorageUpdateKindLocksOneShard(t *testing.T) {
+	store := NewShardedStorage(8, nil)
+	busy, key := "busy", "key:0"
+	for i := 1; store.shardIndex(key) == store.shardIndex(busy); i++ {
+		key = fmt.Sprintf("key:%d", i)
+	}
+	if err := store.SetMulti([]string{busy}, []Entry{{Value: EncodeList([][]byte{[]byte("x")}), Kind: KindList}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A write to another shard goes ahead while the shard of busy is held.
+	shard := store.shards[store.shardIndex(busy)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- store.UpdateKind(key, KindList, func(old []byte) ([]byte, error) {
+			value, _, err := PushList(old, [][]byte{[]byte("a")}, true)
+			return value, err
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected UpdateKind not to wait for another shard")
+	}
+	if _, err := store.Get(key); err != ErrWrongType {
+		t.Fatalf("expected %v, got %v", ErrWrongType, err)
+	}
+	err := store.UpdateKind(key, KindHash, func([]byte) ([]byte, error) { return nil, nil })
+	if err != ErrWrongType {
+		t.Fatalf("expected %v, got %v", ErrWrongType, err)
+	}
+}
@@ -1,7 +1,155 @@
 package storage
 
+import "time"
+
+// Storage holds string values and, in encoded form, the other kinds of
+// values. Set and the other writes of plain values store strings and
+// replace a key of any kind; Get and Update fail with ErrWrongType on a
+// key of another kind. Typed values are read with GetEntry and written
+// with SetMulti or UpdateKind.
 type Storage interface {
 	Set(key string, value []byte) error
 	Get(key string) ([]byte, error)
 	Delete(key string) error
+
+	// GetEntry returns the entry of key, of any kind, and ok == false if
+	// the key does not exist.
+	GetEntry(key string) (entry Entry, ok bool, err error)
+
+	// SetWithExpiry stores value and schedules the key to expire at expireAt.
+	SetWithExpiry(key string, value []byte, expireAt time.Time) error
+	// ExpireAt sets the expiry of an existing key. A time in the past deletes
+	// the key. It reports whether the key existed.
+	ExpireAt(key string, expireAt time.Time) (bool, error)
+	// Persist removes the expiry of a key. It reports whether an expiry was removed.
+	Persist(key string) (bool, error)
+	// ExpireTime returns the expiry of a key, the zero time if the key never
+	// expires, and ok == false if the key does not exist.
+	ExpireTime(key string) (expireAt time.Time, ok bool, err error)
+
+	// Keys returns the existing keys that start with prefix, sorted.
+	Keys(prefix string) ([]string, error)
+	// Scan returns the existing keys k with start <= k < end in order,
+	// together with their values, at most limit of them. An empty end means
+	// no upper bound and a limit <= 0 means no limit. The next page starts
+	// right after the last key returned, i.e. at that key followed by a
+	// zero byte.
+	Scan(start, end string, limit int) ([]KeyValue, error)
+	// ScanPrefix is Scan over the keys that start with prefix.
+	ScanPrefix(prefix string, limit int) ([]KeyValue, error)
+
+	// GetMulti returns the values of keys, nil for missing keys and keys
+	// of other kinds, all read at the same point in time.
+	GetMulti(keys []string) ([][]byte, error)
+	// SetMulti stores entries[i] under keys[i] atomically: readers see
+	// either none or all of them. If a key is repeated, the last entry wins.
+	SetMulti(keys []string, entries []Entry) error
+	// DeleteMulti deletes keys atomically and returns how many of them
+	// existed.
+	DeleteMulti(keys []string) (int, error)
+
+	// GetVersion returns the value of key together with its version, or a
+	// nil value and version 0 if the key does not exist. The value is nil
+	// for a key of another kind.
+	GetVersion(key string) ([]byte, uint64, error)
+	// SetIf stores value with the given expiry (zero for none) if cond holds
+	// for the current version of key, atomically.
+	SetIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error)
+
+	// Update atomically replaces the value of key with fn(old) and returns
+	// the new value. old is nil if the key does not exist and must not be
+	// modified. The expiry of the key is kept. If fn fails, the key is left
+	// unchanged and the error is returned. fn must not call the storage.
+	Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error)
+	// UpdateKind is Update for a key that holds kind or does not exist,
+	// failing with ErrWrongType on a key of another kind. A nil value from
+	// fn deletes the key. Unlike Atomic, it holds only the key.
+	UpdateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error
+
+	// Atomic calls fn with exclusive access to the storage: no other call
+	// interleaves with the calls fn makes on tx. Changes made before fn
+	// fails are kept. tx must not be used after fn returns, and fn must not
+	// call the storage other than through tx.
+	Atomic(fn func(tx Storage) error) error
+}
+
+// ConditionKind selects what a Condition checks.
+type ConditionKind int
+
+const (
+	// Always holds for any state of the key.
+	Always ConditionKind = iota
+	// IfAbsent holds if the key does not exist.
+	IfAbsent
+	// IfPresent holds if the key exists.
+	IfPresent
+	// IfVersion holds if the key is at Condition.Version; version 0 means
+	// that the key does not exist.
+	IfVersion
+)
+
+// Condition restricts SetIf to a state of the key.
+type Condition struct {
+	Kind    ConditionKind
+	Version uint64
+}
+
+// Holds reports whether the condition holds for a key at version, which
+// is 0 if the key does not exist.
+func (c Condition) Holds(version uint64) bool {
+	switch c.Kind {
+	case IfAbsent:
+		return version == 0
+	case IfPresent:
+		return version != 0
+	case IfVersion:
+		return version == c.Version
+	default:
+		return true
+	}
+}
+
+// SetResult describes the outcome of SetIf. If the value was not stored,
+// Version is the current version of the key and Previous is nil.
+type SetResult struct {
+	Stored bool
+	// Previous is the value replaced by the write, nil if the key did not
+	// exist or held another kind.
+	Previous []byte
+	Version  uint64
+}
+
+// KeyValue is a key together with its value, as returned by scans.
+type KeyValue struct {
+	Key   string
+	Value []byte
+	Kind  Kind
+}
+
+// PrefixEnd returns the smallest key after all the keys that start with
+// prefix, or "" if there is none, for use as the end of a Scan.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Entry is a value together with its absolute expiry time and kind.
+// A zero ExpireAt means the key never expires.
+type Entry struct {
+	Value    []byte
+	ExpireAt time.Time
+	Kind     Kind
+}
+
+// Delta describes the changes made since the last saved snapshot:
+// keys whose current entry must be written and keys that no longer exist.
+type Delta struct {
+	Upserts map[string]Entry
+	Deletes []string
 }
@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func newTestStorage() Storage {
-	data := make(map[string][]byte)
+	data := make(map[string]Entry)
 	return NewMemoryStorage(data)
 }
 
@@ -263,3 +270,892 @@ func TestStorageConcurrentSetGetNoRace(t *testing.T) {
 		}
 	}
 }
+
+func newTestClockStorage() (*MemoryStorage, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStorage(make(map[string]Entry))
+	store.now = func() time.Time { return now }
+	return store, &now
+}
+
+func TestStorageSetWithExpiry(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	key := "123"
+	value := []byte("456")
+
+	err := store.SetWithExpiry(key, value, now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(value) {
+		t.Fatalf("expected %q, got %q", value, got)
+	}
+
+	*now = now.Add(time.Second)
+
+	got, err = store.Get(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("expected nil, got %q", got)
+	}
+	if _, ok := store.data[key]; ok {
+		t.Fatalf("expected expired key to be removed on access")
+	}
+}
+
+func TestStorageExpireAtAndPersist(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	key := "123"
+
+	ok, err := store.ExpireAt(key, now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected missing key not to be expired")
+	}
+
+	if err := store.Set(key, []byte("456")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expireAt := now.Add(time.Minute)
+	ok, err = store.ExpireAt(key, expireAt)
+	if err != nil || !ok {
+		t.Fatalf("expected expiry to be set, got %v, %v", ok, err)
+	}
+
+	got, ok, err := store.ExpireTime(key)
+	if err != nil || !ok {
+		t.Fatalf("expected key to exist, got %v, %v", ok, err)
+	}
+	if !got.Equal(expireAt) {
+		t.Fatalf("expected %v, got %v", expireAt, got)
+	}
+
+	ok, err = store.Persist(key)
+	if err != nil || !ok {
+		t.Fatalf("expected expiry to be removed, got %v, %v", ok, err)
+	}
+
+	got, ok, err = store.ExpireTime(key)
+	if err != nil || !ok {
+		t.Fatalf("expected key to exist, got %v, %v", ok, err)
+	}
+	if !got.IsZero() {
+		t.Fatalf("expected no expiry, got %v", got)
+	}
+
+	ok, err = store.Persist(key)
+	if err != nil || ok {
+		t.Fatalf("expected persist of persistent key to report false, got %v, %v", ok, err)
+	}
+}
+
+func TestStorageExpireAtPastDeletes(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	key := "123"
+	if err := store.Set(key, []byte("456")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ok, err := store.ExpireAt(key, now.Add(-time.Second))
+	if err != nil || !ok {
+		t.Fatalf("expected expiry to be set, got %v, %v", ok, err)
+	}
+
+	_, ok, err = store.ExpireTime(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected key to be deleted")
+	}
+}
+
+func TestStorageExpireCycle(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	for i := range 100 {
+		key := fmt.Sprintf("key_%d", i)
+		if err := store.SetWithExpiry(key, []byte("v"), now.Add(time.Second)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := store.Set("persistent", []byte("v")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	*now = now.Add(time.Second)
+	store.expireCycle()
+
+	if len(store.data) != 1 {
+		t.Fatalf("expected 1 key after expire cycle, got %d", len(store.data))
+	}
+	if len(store.volatile) != 0 {
+		t.Fatalf("expected no volatile keys, got %d", len(store.volatile))
+	}
+}
+
+func TestStorageSnapshotExpiry(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	expireAt := now.Add(time.Minute)
+	if err := store.SetWithExpiry("live", []byte("1"), expireAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.SetWithExpiry("dead", []byte("2"), now.Add(time.Second)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	*now = now.Add(time.Second)
+
+	snap := store.Snapshot()
+	if len(snap) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(snap))
+	}
+	if !snap["live"].ExpireAt.Equal(expireAt) {
+		t.Fatalf("expected %v, got %v", expireAt, snap["live"].ExpireAt)
+	}
+}
+
+func TestStorageTakeDelta(t *testing.T) {
+	store := NewMemoryStorage(map[string]Entry{
+		"loaded":  {Value: []byte("1")},
+		"removed": {Value: []byte("2")},
+	})
+
+	delta := store.TakeDelta()
+	if len(delta.Upserts) != 0 || len(delta.Deletes) != 0 {
+		t.Fatalf("expected empty delta for loaded data, got %v", delta)
+	}
+
+	if err := store.Set("new", []byte("3")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Delete("removed"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Set("temp", []byte("4")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Delete("temp"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delta = store.TakeDelta()
+	if len(delta.Upserts) != 1 || string(delta.Upserts["new"].Value) != "3" {
+		t.Fatalf("expected upsert of key new, got %v", delta.Upserts)
+	}
+	slices.Sort(delta.Deletes)
+	if !slices.Equal(delta.Deletes, []string{"removed", "temp"}) {
+		t.Fatalf("expected deletes of removed and temp, got %v", delta.Deletes)
+	}
+
+	again := store.TakeDelta()
+	if len(again.Upserts) != 0 || len(again.Deletes) != 0 {
+		t.Fatalf("expected empty delta after take, got %v", again)
+	}
+
+	store.MarkDirty(delta)
+	if err := store.Set("new", []byte("5")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	again = store.TakeDelta()
+	if len(again.Upserts) != 1 || string(again.Upserts["new"].Value) != "5" {
+		t.Fatalf("expected current value of key new, got %v", again.Upserts)
+	}
+	if len(again.Deletes) != 2 {
+		t.Fatalf("expected 2 deletes, got %v", again.Deletes)
+	}
+
+	if err := store.Set("other", []byte("6")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.ResetDirty()
+	again = store.TakeDelta()
+	if len(again.Upserts) != 0 || len(again.Deletes) != 0 {
+		t.Fatalf("expected empty delta after reset, got %v", again)
+	}
+}
+
+func TestStorageRestore(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	if err := store.Restore("a", Entry{Value: []byte("1")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Restore("b", Entry{Value: []byte("2"), ExpireAt: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Restore("c", Entry{Value: []byte("3"), ExpireAt: now.Add(-time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	snap := store.Snapshot()
+	if len(snap) != 2 || string(snap["a"].Value) != "1" || string(snap["b"].Value) != "2" {
+		t.Fatalf("expected keys a and b, got %v", snap)
+	}
+
+	delta := store.TakeDelta()
+	if len(delta.Upserts) != 0 || len(delta.Deletes) != 0 {
+		t.Fatalf("expected restored entries not to be tracked, got %v", delta)
+	}
+	if store.Changes() != 0 {
+		t.Fatalf("expected no changes, got %d", store.Changes())
+	}
+}
+
+func TestStorageReplace(t *testing.T) {
+	store, now := newTestClockStorage()
+	store.Set("a", []byte("1"))
+	store.SetWithExpiry("b", []byte("2"), now.Add(time.Minute))
+
+	store.Replace(map[string]Entry{
+		"b": {Value: []byte("3")},
+		"c": {Value: []byte("4"), ExpireAt: now.Add(time.Minute)},
+		"d": {Value: []byte("5"), ExpireAt: now.Add(-time.Minute)},
+	})
+
+	snap := store.Snapshot()
+	if len(snap) != 2 || string(snap["b"].Value) != "3" || string(snap["c"].Value) != "4" {
+		t.Fatalf("expected keys b and c, got %v", snap)
+	}
+	if !snap["b"].ExpireAt.IsZero() {
+		t.Fatalf("expected b to have no expiry, got %v", snap["b"].ExpireAt)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	store.expireCycle()
+	if _, ok := store.data["c"]; ok {
+		t.Fatalf("expected expiry cycle to remove c")
+	}
+}
+
+func TestStorageKeys(t *testing.T) {
+	store, now := newTestClockStorage()
+	store.Set("user:2", []byte("1"))
+	store.Set("user:1", []byte("1"))
+	store.Set("order:1", []byte("1"))
+	store.SetWithExpiry("user:3", []byte("1"), now.Add(time.Second))
+	store.SetWithExpiry("user:4", []byte("1"), now.Add(time.Minute))
+
+	*now = now.Add(2 * time.Second)
+	keys, err := store.Keys("user:")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(keys, []string{"user:1", "user:2", "user:4"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	keys, _ = store.Keys("")
+	if len(keys) != 4 {
+		t.Fatalf("expected 4 keys, got %v", keys)
+	}
+}
+
+func TestStorageScan(t *testing.T) {
+	store, now := newTestClockStorage()
+	for _, key := range []string{"b", "a", "c", "ab", "d"} {
+		store.Set(key, []byte("v"+key))
+	}
+	store.SetWithExpiry("aa", []byte("x"), now.Add(time.Second))
+	store.Delete("d")
+	*now = now.Add(2 * time.Second)
+
+	keysOf := func(items []KeyValue) []string {
+		var keys []string
+		for _, item := range items {
+			keys = append(keys, item.Key)
+		}
+		return keys
+	}
+	tests := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{"a", "ab", "b", "c"}},
+		{"", "", 2, []string{"a", "ab"}},
+		{"ab\x00", "", 2, []string{"b", "c"}},
+		{"a", "b", 0, []string{"a", "ab"}},
+		{"aa", "c", 0, []string{"ab", "b"}},
+		{"e", "", 0, nil},
+	}
+	for _, tt := range tests {
+		items, err := store.Scan(tt.start, tt.end, tt.limit)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := keysOf(items); !slices.Equal(got, tt.want) {
+			t.Fatalf("Scan(%q, %q, %d): expected %v, got %v", tt.start, tt.end, tt.limit, tt.want, got)
+		}
+	}
+
+	items, _ := store.ScanPrefix("a", 0)
+	if got := keysOf(items); !slices.Equal(got, []string{"a", "ab"}) || string(items[1].Value) != "vab" {
+		t.Fatalf("unexpected prefix scan %v", items)
+	}
+
+	for prefix, want := range map[string]string{"": "", "a": "b", "a\xff": "b", "\xff\xff": ""} {
+		if got := PrefixEnd(prefix); got != want {
+			t.Fatalf("PrefixEnd(%q): expected %q, got %q", prefix, want, got)
+		}
+	}
+}
+
+func TestIndexOrder(t *testing.T) {
+	ix := newIndex()
+	want := make(map[string]bool)
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for range 5000 {
+		key := strconv.Itoa(rnd.IntN(2000))
+		if rnd.IntN(3) == 0 {
+			ix.remove(key)
+			delete(want, key)
+		} else {
+			ix.insert(key)
+			want[key] = true
+		}
+	}
+
+	var got []string
+	for n := ix.seek(""); n != nil; n = n.next[0] {
+		got = append(got, n.key)
+	}
+	if !slices.Equal(got, slices.Sorted(maps.Keys(want))) || ix.len != len(want) {
+		t.Fatalf("index holds %d keys out of order or wrong, expected %d", len(got), len(want))
+	}
+	if n := ix.seek("1000\x00"); n == nil || n.key != got[slices.Index(got, "1000")+1] {
+		t.Fatalf("unexpected seek result")
+	}
+}
+
+func TestStorageMulti(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	keys := []string{"a", "b", "c", "a"}
+	entries := []Entry{
+		{Value: []byte("1")},
+		{Value: []byte("2"), ExpireAt: now.Add(time.Second)},
+		{Value: []byte("3"), ExpireAt: now.Add(-time.Second)},
+		{Value: []byte("4")},
+	}
+	if err := store.SetMulti(keys, entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.SetMulti([]string{"a"}, nil); err == nil {
+		t.Fatal("expected error for mismatched lengths")
+	}
+
+	values, err := store.GetMulti([]string{"a", "b", "c", "missing"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]byte{[]byte("4"), []byte("2"), nil, nil}
+	for i := range want {
+		if string(values[i]) != string(want[i]) || (values[i] == nil) != (want[i] == nil) {
+			t.Fatalf("value %d: expected %q, got %q", i, want[i], values[i])
+		}
+	}
+
+	*now = now.Add(2 * time.Second)
+	deleted, err := store.DeleteMulti([]string{"a", "b", "missing", "a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected 1 deleted key, got %d", deleted)
+	}
+	if len(store.Snapshot()) != 0 {
+		t.Fatalf("expected empty storage, got %v", store.Snapshot())
+	}
+}
+
+func TestStorageSetMultiAtomic(t *testing.T) {
+	store := NewMemoryStorage(make(map[string]Entry))
+	keys := []string{"x", "y", "z"}
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			value := []byte(fmt.Sprint(i))
+			store.SetMulti(keys, []Entry{{Value: value}, {Value: value}, {Value: value}})
+		}
+	}()
+
+	for range 1000 {
+		values, _ := store.GetMulti(keys)
+		if string(values[0]) != string(values[1]) || string(values[1]) != string(values[2]) {
+			close(done)
+			t.Fatalf("partial MSET observed: %q", values)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStorageVersions(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	if value, version, _ := store.GetVersion("a"); value != nil || version != 0 {
+		t.Fatalf("expected missing key, got %q at version %d", value, version)
+	}
+	store.Set("a", []byte("1"))
+	_, v1, _ := store.GetVersion("a")
+	store.Set("a", []byte("1"))
+	_, v2, _ := store.GetVersion("a")
+	store.ExpireAt("a", now.Add(time.Second))
+	value, v3, _ := store.GetVersion("a")
+	if v1 == 0 || v2 <= v1 || v3 <= v2 || string(value) != "1" {
+		t.Fatalf("expected increasing versions, got %d %d %d", v1, v2, v3)
+	}
+
+	*now = now.Add(2 * time.Second)
+	store.Set("a", []byte("2"))
+	if _, v4, _ := store.GetVersion("a"); v4 <= v3 {
+		t.Fatalf("version %d of a recreated key is not above %d", v4, v3)
+	}
+
+	restarted := NewMemoryStorage(store.Snapshot())
+	if _, v5, _ := restarted.GetVersion("a"); v5 <= v3 {
+		t.Fatalf("version %d after a restart is not above %d", v5, v3)
+	}
+}
+
+func TestStorageSetIf(t *testing.T) {
+	store, now := newTestClockStorage()
+
+	res, err := store.SetIf("a", []byte("1"), time.Time{}, Condition{Kind: IfPresent})
+	if err != nil || res.Stored {
+		t.Fatalf("expected XX on a missing key to fail, got %+v, %v", res, err)
+	}
+	res, _ = store.SetIf("a", []byte("1"), time.Time{}, Condition{Kind: IfAbsent})
+	if !res.Stored || res.Previous != nil || res.Version == 0 {
+		t.Fatalf("expected NX on a missing key to succeed, got %+v", res)
+	}
+	v1 := res.Version
+
+	res, _ = store.SetIf("a", []byte("2"), time.Time{}, Condition{Kind: IfAbsent})
+	if res.Stored || res.Version != v1 {
+		t.Fatalf("expected NX on an existing key to fail at version %d, got %+v", v1, res)
+	}
+	res, _ = store.SetIf("a", []byte("2"), time.Time{}, Condition{Kind: IfVersion, Version: v1 + 1})
+	if res.Stored {
+		t.Fatalf("expected CAS with a wrong version to fail, got %+v", res)
+	}
+	res, _ = store.SetIf("a", []byte("2"), now.Add(time.Second), Condition{Kind: IfVersion, Version: v1})
+	if !res.Stored || string(res.Previous) != "1" || res.Version <= v1 {
+		t.Fatalf("expected CAS to succeed, got %+v", res)
+	}
+	if expireAt, _, _ := store.ExpireTime("a"); !expireAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected expiry to be set, got %v", expireAt)
+	}
+
+	res, _ = store.SetIf("a", []byte("3"), time.Time{}, Condition{})
+	if !res.Stored || string(res.Previous) != "2" {
+		t.Fatalf("expected unconditional set to return the previous value, got %+v", res)
+	}
+
+	*now = now.Add(time.Hour)
+	res, _ = store.SetIf("b", []byte("1"), time.Time{}, Condition{Kind: IfVersion})
+	if !res.Stored {
+		t.Fatalf("expected CAS with version 0 on a missing key to succeed, got %+v", res)
+	}
+}
+
+func TestStorageUpdate(t *testing.T) {
+	store, now := newTestClockStorage()
+	store.SetWithExpiry("a", []byte("1"), now.Add(time.Minute))
+	_, before, _ := store.GetVersion("a")
+
+	value, err := store.Update("a", func(old []byte) ([]byte, error) {
+		return append(slices.Clone(old), '2'), nil
+	})
+	if err != nil || string(value) != "12" {
+		t.Fatalf("unexpected update result %q, %v", value, err)
+	}
+	got, after, _ := store.GetVersion("a")
+	expireAt, _, _ := store.ExpireTime("a")
+	if string(got) != "12" || after <= before || !expireAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected state %q at version %d, expiring at %v", got, after, expireAt)
+	}
+
+	errFail := fmt.Errorf("fail")
+	if _, err := store.Update("a", func([]byte) ([]byte, error) { return nil, errFail }); err != errFail {
+		t.Fatalf("expected %v, got %v", errFail, err)
+	}
+	if got, _ := store.Get("a"); string(got) != "12" {
+		t.Fatalf("expected failed update to leave the value, got %q", got)
+	}
+
+	var seen []byte
+	store.Update("missing", func(old []byte) ([]byte, error) {
+		seen = old
+		return []byte("x"), nil
+	})
+	if seen != nil {
+		t.Fatalf("expected nil for a missing key, got %q", seen)
+	}
+}
+
+func TestStorageAtomic(t *testing.T) {
+	store := newTestStorage()
+	store.Set("a", []byte("1"))
+
+	errFail := fmt.Errorf("fail")
+	err := store.Atomic(func(tx Storage) error {
+		if err := tx.Set("b", []byte("2")); err != nil {
+			return err
+		}
+		if got, _ := tx.Get("b"); string(got) != "2" {
+			t.Fatalf("expected the transaction to see its write, got %q", got)
+		}
+		if _, err := tx.DeleteMulti([]string{"a"}); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if err != errFail {
+		t.Fatalf("expected %v, got %v", errFail, err)
+	}
+	if got, _ := store.Get("b"); string(got) != "2" {
+		t.Fatalf("expected writes before the failure to be kept, got %q", got)
+	}
+	if got, _ := store.Get("a"); got != nil {
+		t.Fatalf("expected key a to be deleted, got %q", got)
+	}
+
+	workers := 10
+	wg := &sync.WaitGroup{}
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Atomic(func(tx Storage) error {
+				value, _ := tx.Get("n")
+				return tx.Set("n", append(slices.Clone(value), 'x'))
+			})
+		}()
+	}
+	wg.Wait()
+	if got, _ := store.Get("n"); len(got) != workers {
+		t.Fatalf("expected %d appends, got %q", workers, got)
+	}
+}
+
+func TestStorageMemoryAccounting(t *testing.T) {
+	store := NewMemoryStorage(map[string]Entry{"loaded": {Value: []byte("12345")}})
+	want := entryCost("loaded", 5)
+	check := func() {
+		t.Helper()
+		if stats := store.MemoryStats(); stats.UsedBytes != want {
+			t.Fatalf("expected %d used bytes, got %d", want, stats.UsedBytes)
+		}
+	}
+	check()
+
+	store.Set("a", []byte("1"))
+	want += entryCost("a", 1)
+	check()
+	store.Set("a", []byte("123"))
+	want += 2
+	check()
+	store.SetMulti([]string{"b", "c"}, []Entry{{Value: []byte("xy")}, {Value: nil}})
+	want += entryCost("b", 2) + entryCost("c", 0)
+	check()
+	store.Update("c", func(old []byte) ([]byte, error) { return []byte("9"), nil })
+	want++
+	check()
+	store.DeleteMulti([]string{"a", "loaded"})
+	want -= entryCost("a", 3) + entryCost("loaded", 5)
+	check()
+	store.Replace(map[string]Entry{"z": {Value: []byte("1")}})
+	want = entryCost("z", 1)
+	check()
+}
+
+func TestStorageEviction(t *testing.T) {
+	value := []byte("0123456789")
+	tests := []struct {
+		policy EvictionPolicy
+		// prepare fills the storage with k0..k4 and uses some of them.
+		prepare func(store *MemoryStorage, now *time.Time)
+		want    string
+	}{
+		{AllKeysLRU, func(store *MemoryStorage, now *time.Time) {
+			for i := range 5 {
+				store.Set(fmt.Sprint("k", i), value)
+				*now = now.Add(time.Second)
+			}
+			store.Get("k0")
+		}, "k1"},
+		{AllKeysLFU, func(store *MemoryStorage, now *time.Time) {
+			for i := range 5 {
+				store.Set(fmt.Sprint("k", i), value)
+			}
+			// The first access of a new key always counts.
+			store.GetMulti([]string{"k0", "k1", "k3", "k4"})
+		}, "k2"},
+		{VolatileTTL, func(store *MemoryStorage, now *time.Time) {
+			for i := range 5 {
+				store.SetWithExpiry(fmt.Sprint("k", i), value, now.Add(time.Duration(10-i)*time.Minute))
+			}
+			store.Persist("k4")
+		}, "k3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			store, now := newTestClockStorage()
+			store.SetMemoryLimit(5*entryCost("k0", len(value)), tt.policy)
+			tt.prepare(store, now)
+
+			if err := store.Set("k5", value); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, _ := store.Get(tt.want); got != nil {
+				t.Fatalf("expected %s to be evicted", tt.want)
+			}
+			if stats := store.MemoryStats(); stats.Keys != 5 || stats.Evicted != 1 {
+				t.Fatalf("expected 5 keys and 1 eviction, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestStorageEvictionRandom(t *testing.T) {
+	store, _ := newTestClockStorage()
+	store.SetMemoryLimit(10*entryCost("k00", 1), AllKeysRandom)
+	for i := range 100 {
+		if err := store.Set(fmt.Sprintf("k%02d", i), []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if stats := store.MemoryStats(); stats.Keys != 10 || stats.Evicted != 90 || stats.UsedBytes > stats.MaxBytes {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if got, _ := store.Get("k99"); got == nil {
+		t.Fatalf("expected the last written key to be kept")
+	}
+}
+
+func TestStorageOutOfMemory(t *testing.T) {
+	store, _ := newTestClockStorage()
+	limit := 2 * entryCost("a", 1)
+	store.SetMemoryLimit(limit, NoEviction)
+
+	store.Set("a", []byte("1"))
+	store.Set("b", []byte("2"))
+	if err := store.Set("c", []byte("3")); err != ErrOutOfMemory {
+		t.Fatalf("expected %v, got %v", ErrOutOfMemory, err)
+	}
+	if err := store.SetMulti([]string{"a", "c"}, []Entry{{Value: []byte("1")}, {Value: []byte("3")}}); err != ErrOutOfMemory {
+		t.Fatalf("expected %v from SetMulti, got %v", ErrOutOfMemory, err)
+	}
+	if got, _ := store.Get("c"); got != nil {
+		t.Fatalf("expected refused writes not to be stored, got %q", got)
+	}
+	if err := store.Set("a", []byte("x")); err != nil {
+		t.Fatalf("expected an overwrite of the same size to fit, got %v", err)
+	}
+	store.Delete("b")
+	if err := store.Set("c", []byte("3")); err != nil {
+		t.Fatalf("expected a write to fit after a delete, got %v", err)
+	}
+
+	// Keys without expiry are never evicted under VolatileTTL, and a value
+	// larger than the limit never fits.
+	store.SetMemoryLimit(limit, VolatileTTL)
+	if err := store.Set("d", []byte("4")); err != ErrOutOfMemory {
+		t.Fatalf("expected %v under volatile-ttl, got %v", ErrOutOfMemory, err)
+	}
+	store.SetMemoryLimit(limit, AllKeysLRU)
+	if err := store.Set("big", make([]byte, limit)); err != ErrOutOfMemory {
+		t.Fatalf("expected %v for a value over the limit, got %v", ErrOutOfMemory, err)
+	}
+	if stats := store.MemoryStats(); stats.Keys != 2 || stats.Evicted != 0 {
+		t.Fatalf("expected no evictions for a refused write, got %+v", stats)
+	}
+}
+
+func TestStorageView(t *testing.T) {
+	store, now := newTestClockStorage()
+	want := make(map[string]string)
+	for i := range 3000 {
+		key := fmt.Sprintf("key:%04d", i)
+		store.SetWithExpiry(key, []byte(strconv.Itoa(i)), now.Add(time.Hour))
+		want[key] = strconv.Itoa(i)
+	}
+	store.SetWithExpiry("expired", []byte("x"), now.Add(time.Second))
+	*now = now.Add(time.Second)
+
+	view := store.View()
+	defer view.Close()
+
+	// Every key is changed while the view is read, some of them before
+	// they are read and some after.
+	rng := rand.New(rand.NewPCG(1, 2))
+	write := func() {
+		key := fmt.Sprintf("key:%04d", rng.IntN(3500))
+		switch rng.IntN(4) {
+		case 0:
+			store.Set(key, []byte("changed"))
+		case 1:
+			store.Delete(key)
+		case 2:
+			store.ExpireAt(key, now.Add(time.Minute))
+		default:
+			store.Persist(key)
+		}
+	}
+	for pass := range 2 {
+		got := make(map[string]string)
+		for key, entry := range view.All() {
+			if _, ok := got[key]; ok {
+				t.Fatalf("pass %d: key %s yielded twice", pass, key)
+			}
+			if !entry.ExpireAt.Equal(now.Add(time.Hour - time.Second)) {
+				t.Fatalf("pass %d: unexpected expiry of %s: %v", pass, key, entry.ExpireAt)
+			}
+			got[key] = string(entry.Value)
+			for range 3 {
+				write()
+			}
+		}
+		if !maps.Equal(got, want) {
+			t.Fatalf("pass %d: expected the state at the time of the view, got %d keys", pass, len(got))
+		}
+	}
+
+	view.Close()
+	if len(store.views) != 0 {
+		t.Fatalf("expected the view to be released")
+	}
+	store.Set("after", []byte("1"))
+	if snapshot := store.Snapshot(); string(snapshot["after"].Value) != "1" {
+		t.Fatalf("expected a new snapshot to see later writes")
+	}
+}
+
+func TestStorageTypedEntries(t *testing.T) {
+	s := NewMemoryStorage(nil)
+	hash := EncodeHash(map[string][]byte{"f": []byte("v")})
+	if err := s.SetMulti([]string{"h", "s"}, []Entry{{Value: hash, Kind: KindHash}, {Value: []byte("1")}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entry, ok, err := s.GetEntry("h")
+	if err != nil || !ok || entry.Kind != KindHash || string(entry.Value) != string(hash) {
+		t.Fatalf("unexpected entry: %v, %v, %v", entry, ok, err)
+	}
+	if _, ok, _ := s.GetEntry("missing"); ok {
+		t.Fatalf("expected missing key")
+	}
+	if _, err := s.Get("h"); err != ErrWrongType {
+		t.Fatalf("expected %v, got %v", ErrWrongType, err)
+	}
+	if _, err := s.Update("h", func(old []byte) ([]byte, error) { return old, nil }); err != ErrWrongType {
+		t.Fatalf("expected %v, got %v", ErrWrongType, err)
+	}
+	if values, _ := s.GetMulti([]string{"h", "s"}); values[0] != nil || string(values[1]) != "1" {
+		t.Fatalf("unexpected values: %q", values)
+	}
+	if value, version, _ := s.GetVersion("h"); value != nil || version == 0 {
+		t.Fatalf("expected no value and a version, got %q, %d", value, version)
+	}
+	if items, _ := s.Scan("", "", 0); items[0].Kind != KindHash || items[1].Kind != KindString {
+		t.Fatalf("unexpected scan: %v", items)
+	}
+	if got := s.Snapshot()["h"]; got.Kind != KindHash {
+		t.Fatalf("expected the kind in the snapshot, got %v", got)
+	}
+	if delta := s.TakeDelta(); delta.Upserts["h"].Kind != KindHash {
+		t.Fatalf("expected the kind in the delta, got %v", delta.Upserts["h"])
+	}
+
+	// Set replaces a key of any kind with a string.
+	if err := s.Set("h", []byte("x")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, err := s.Get("h"); err != nil || string(got) != "x" {
+		t.Fatalf("expected x, got %q, %v", got, err)
+	}
+}
+
+func TestTypeEncodings(t *testing.T) {
+	fields := map[string][]byte{"a": []byte("1"), "b": {}, "": []byte("empty")}
+	gotFields, err := DecodeHash(EncodeHash(fields))
+	if err != nil || len(gotFields) != 3 || string(gotFields["a"]) != "1" || string(gotFields[""]) != "empty" {
+		t.Fatalf("unexpected hash: %q, %v", gotFields, err)
+	}
+
+	items := [][]byte{[]byte("x"), {}, []byte("x")}
+	gotItems, err := DecodeList(EncodeList(items))
+	if err != nil || len(gotItems) != 3 || string(gotItems[2]) != "x" {
+		t.Fatalf("unexpected list: %q, %v", gotItems, err)
+	}
+
+	members := map[string]struct{}{"a": {}, "b": {}}
+	gotMembers, err := DecodeSet(EncodeSet(members))
+	if err != nil || !maps.Equal(gotMembers, members) {
+		t.Fatalf("unexpected set: %v, %v", gotMembers, err)
+	}
+
+	zset := []ZMember{{"c", 2}, {"b", 1}, {"a", 2}, {"d", math.Inf(-1)}}
+	gotZSet, err := DecodeZSet(EncodeZSet(zset))
+	want := []ZMember{{"d", math.Inf(-1)}, {"b", 1}, {"a", 2}, {"c", 2}}
+	if err != nil || !slices.Equal(gotZSet, want) {
+		t.Fatalf("expected %v, got %v, %v", want, gotZSet, err)
+	}
+
+	list, n, err := PushList(nil, [][]byte{[]byte("b"), []byte("c")}, false)
+	if err == nil {
+		list, n, err = PushList(list, [][]byte{[]byte("a")}, true)
+	}
+	if gotItems, _ := DecodeList(list); err != nil || n != 3 || len(gotItems) != 3 || string(gotItems[0]) != "a" || string(gotItems[2]) != "c" {
+		t.Fatalf("unexpected pushed list: %q, %d, %v", gotItems, n, err)
+	}
+	last, rest, err := PopList(list, false)
+	if err != nil || string(last) != "c" || string(rest) != string(EncodeList([][]byte{[]byte("a"), []byte("b")})) {
+		t.Fatalf("unexpected pop from the back: %q, %q, %v", last, rest, err)
+	}
+	first, rest, err := PopList(rest, true)
+	if err != nil || string(first) != "a" || string(rest) != string(EncodeList([][]byte{[]byte("b")})) {
+		t.Fatalf("unexpected pop from the front: %q, %q, %v", first, rest, err)
+	}
+	if _, rest, err := PopList(rest, true); err != nil || rest != nil {
+		t.Fatalf("expected the list to be left empty, got %q, %v", rest, err)
+	}
+
+	if string(EncodeHash(fields)) != string(EncodeHash(maps.Clone(fields))) {
+		t.Fatalf("expected equal hashes to encode equally")
+	}
+	for _, b := range [][]byte{nil, {5}, {1, 3, 'a'}, append(EncodeList(items), 0)} {
+		if _, err := DecodeList(b); err == nil {
+			t.Fatalf("expected an error for %q", b)
+		}
+		if _, _, err := PopList(b, false); err == nil {
+			t.Fatalf("expected an error popping from %q", b)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package storage
+
+import "time"
+
+func (s *MemoryStorage) Atomic(fn func(tx Storage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(memoryTx{s})
+}
+
+// memoryTx gives access to a MemoryStorage whose write lock is held.
+type memoryTx struct {
+	s *MemoryStorage
+}
+
+func (tx memoryTx) Set(key string, value []byte) error {
+	return tx.s.set(key, value)
+}
+
+func (tx memoryTx) Get(key string) ([]byte, error) {
+	e, ok := tx.s.lookup(key)
+	if !ok {
+		return nil, nil
+	}
+	if e.kind != KindString {
+		return nil, ErrWrongType
+	}
+	return copyBytes(e.value), nil
+}
+
+func (tx memoryTx) GetEntry(key string) (Entry, bool, error) {
+	return tx.s.getEntry(key)
+}
+
+func (tx memoryTx) Delete(key string) error {
+	return tx.s.deleteKey(key)
+}
+
+func (tx memoryTx) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	return tx.s.setWithExpiry(key, value, expireAt)
+}
+
+func (tx memoryTx) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	return tx.s.expireAt(key, expireAt)
+}
+
+func (tx memoryTx) Persist(key string) (bool, error) {
+	return tx.s.persist(key)
+}
+
+func (tx memoryTx) ExpireTime(key string) (time.Time, bool, error) {
+	return tx.s.expireTime(key)
+}
+
+func (tx memoryTx) Keys(prefix string) ([]string, error) {
+	return tx.s.keys(prefix)
+}
+
+func (tx memoryTx) Scan(start, end string, limit int) ([]KeyValue, error) {
+	return tx.s.scan(start, end, limit)
+}
+
+func (tx memoryTx) ScanPrefix(prefix string, limit int) ([]KeyValue, error) {
+	return tx.s.scan(prefix, PrefixEnd(prefix), limit)
+}
+
+func (tx memoryTx) GetMulti(keys []string) ([][]byte, error) {
+	return tx.s.getMulti(keys)
+}
+
+func (tx memoryTx) SetMulti(keys []string, entries []Entry) error {
+	return tx.s.setMulti(keys, entries)
+}
+
+func (tx memoryTx) DeleteMulti(keys []string) (int, error) {
+	return tx.s.deleteMulti(keys)
+}
+
+func (tx memoryTx) GetVersion(key string) ([]byte, uint64, error) {
+	return tx.s.getVersion(key)
+}
+
+func (tx memoryTx) SetIf(key string, value []byte, expireAt time.Time, cond Condition) (SetResult, error) {
+	return tx.s.setIf(key, value, expireAt, cond)
+}
+
+func (tx memoryTx) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	return tx.s.update(key, fn)
+}
+
+func (tx memoryTx) UpdateKind(key string, kind Kind, fn func(old []byte) ([]byte, error)) error {
+	return tx.s.updateKind(key, kind, fn)
+}
+
+func (tx memoryTx) PlanEviction(keys []string, values [][]byte) ([]string, error) {
+	return tx.s.planEviction(tx.s.growth(keys, values), keys)
+}
+
+func (tx memoryTx) Evict(keys []string) {
+	tx.s.evict(keys)
+}
+
+// Atomic runs fn right away, as the storage is already held.
+func (tx memoryTx) Atomic(fn func(tx Storage) error) error {
+	return fn(tx)
+}
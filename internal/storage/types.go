@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+)
+
+// ErrWrongType is returned when a key is read or changed as a value of a
+// type other than the one it holds.
+var ErrWrongType = errors.New("storage: wrong type")
+
+// Kind is the type of the value held by a key. Values other than strings
+// are stored encoded, see the Encode and Decode functions.
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindHash
+	KindList
+	KindSet
+	KindZSet
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindHash:
+		return "hash"
+	case KindList:
+		return "list"
+	case KindSet:
+		return "set"
+	case KindZSet:
+		return "zset"
+	default:
+		return "unknown"
+	}
+}
+
+// Valid reports whether k is a known kind.
+func (k Kind) Valid() bool {
+	return k <= KindZSet
+}
+
+var errBadEncoding = errors.New("storage: malformed typed value")
+
+// The encodings are a uvarint count followed by the items, each a
+// uvarint length and the bytes. Hashes and sets are sorted, so that equal
+// contents encode equally.
+
+// EncodeHash encodes the fields of a hash.
+func EncodeHash(fields map[string][]byte) []byte {
+	keys := make([]string, 0, len(fields))
+	for field := range fields {
+		keys = append(keys, field)
+	}
+	slices.Sort(keys)
+	buf := binary.AppendUvarint(nil, uint64(len(keys)))
+	for _, field := range keys {
+		buf = appendItem(buf, []byte(field))
+		buf = appendItem(buf, fields[field])
+	}
+	return buf
+}
+
+// DecodeHash decodes a value encoded by EncodeHash.
+func DecodeHash(b []byte) (map[string][]byte, error) {
+	n, b, err := readCount(b, 2)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte, n)
+	for range n {
+		var field, value []byte
+		if field, b, err = readItem(b); err != nil {
+			return nil, err
+		}
+		if value, b, err = readItem(b); err != nil {
+			return nil, err
+		}
+		fields[string(field)] = value
+	}
+	return fields, checkEnd(b)
+}
+
+// EncodeList encodes the items of a list in order.
+func EncodeList(items [][]byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(items)))
+	for _, item := range items {
+		buf = appendItem(buf, item)
+	}
+	return buf
+}
+
+// DecodeList decodes a value encoded by EncodeList.
+func DecodeList(b []byte) ([][]byte, error) {
+	n, b, err := readCount(b, 1)
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, n)
+	for range n {
+		var item []byte
+		if item, b, err = readItem(b); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, checkEnd(b)
+}
+
+// PushList adds items, in order, to the front or the back of the list
+// encoded in b, nil being an empty list, without decoding the items
+// already there. It returns the new encoding and length.
+func PushList(b []byte, items [][]byte, front bool) ([]byte, int, error) {
+	var n int
+	if b != nil {
+		var err error
+		if n, b, err = readCount(b, 1); err != nil {
+			return nil, 0, err
+		}
+	}
+	size := binary.MaxVarintLen64 + len(b)
+	for _, item := range items {
+		size += binary.MaxVarintLen64 + len(item)
+	}
+	buf := binary.AppendUvarint(make([]byte, 0, size), uint64(n+len(items)))
+	if !front {
+		buf = append(buf, b...)
+	}
+	for _, item := range items {
+		buf = appendItem(buf, item)
+	}
+	if front {
+		buf = append(buf, b...)
+	}
+	return buf, n + len(items), nil
+}
+
+// PopList removes the first or the last item of the list encoded in b and
+// returns it together with the encoding of the rest, nil if the list is
+// left empty. The item is nil if the list is empty.
+func PopList(b []byte, front bool) (item, rest []byte, err error) {
+	n, b, err := readCount(b, 1)
+	if err != nil || n == 0 {
+		return nil, nil, err
+	}
+	if front {
+		item, b, err = readItem(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n == 1 {
+			return item, nil, checkEnd(b)
+		}
+		rest = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(b)), uint64(n-1))
+		return item, append(rest, b...), nil
+	}
+	last := b
+	for range n - 1 {
+		if _, last, err = readItem(last); err != nil {
+			return nil, nil, err
+		}
+	}
+	item, end, err := readItem(last)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkEnd(end); err != nil {
+		return nil, nil, err
+	}
+	if n == 1 {
+		return item, nil, nil
+	}
+	kept := b[:len(b)-len(last)]
+	rest = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(kept)), uint64(n-1))
+	return item, append(rest, kept...), nil
+}
+
+// EncodeSet encodes the members of a set.
+func EncodeSet(members map[string]struct{}) []byte {
+	sorted := make([]string, 0, len(members))
+	for member := range members {
+		sorted = append(sorted, member)
+	}
+	slices.Sort(sorted)
+	buf := binary.AppendUvarint(nil, uint64(len(sorted)))
+	for _, member := range sorted {
+		buf = appendItem(buf, []byte(member))
+	}
+	return buf
+}
+
+// DecodeSet decodes a value encoded by EncodeSet.
+func DecodeSet(b []byte) (map[string]struct{}, error) {
+	n, b, err := readCount(b, 1)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]struct{}, n)
+	for range n {
+		var member []byte
+		if member, b, err = readItem(b); err != nil {
+			return nil, err
+		}
+		members[string(member)] = struct{}{}
+	}
+	return members, checkEnd(b)
+}
+
+// ZMember is a member of a sorted set together with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// CompareZMembers orders members by score, then by member.
+func CompareZMembers(a, b ZMember) int {
+	switch {
+	case a.Score < b.Score:
+		return -1
+	case a.Score > b.Score:
+		return 1
+	}
+	switch {
+	case a.Member < b.Member:
+		return -1
+	case a.Member > b.Member:
+		return 1
+	}
+	return 0
+}
+
+// EncodeZSet encodes the members of a sorted set, which must be distinct,
+// in score order. Each score follows its member as 8 bytes.
+func EncodeZSet(members []ZMember) []byte {
+	sorted := slices.SortedFunc(slices.Values(members), CompareZMembers)
+	buf := binary.AppendUvarint(nil, uint64(len(sorted)))
+	for _, m := range sorted {
+		buf = appendItem(buf, []byte(m.Member))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(m.Score))
+	}
+	return buf
+}
+
+// DecodeZSet decodes a value encoded by EncodeZSet. The members come in
+// score order.
+func DecodeZSet(b []byte) ([]ZMember, error) {
+	n, b, err := readCount(b, 9)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ZMember, 0, n)
+	for range n {
+		var member []byte
+		if member, b, err = readItem(b); err != nil {
+			return nil, err
+		}
+		if len(b) < 8 {
+			return nil, errBadEncoding
+		}
+		score := math.Float64frombits(binary.BigEndian.Uint64(b))
+		b = b[8:]
+		members = append(members, ZMember{Member: string(member), Score: score})
+	}
+	return members, checkEnd(b)
+}
+
+func appendItem(buf, item []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(item)))
+	return append(buf, item...)
+}
+
+// readCount reads the number of items, each of which takes at least
+// minSize bytes, which bounds the count before allocating.
+func readCount(b []byte, minSize int) (int, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size)/uint64(minSize) {
+		return 0, nil, errBadEncoding
+	}
+	return int(n), b[size:], nil
+}
+
+func readItem(b []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, errBadEncoding
+	}
+	b = b[size:]
+	return b[:n:n], b[n:], nil
+}
+
+func checkEnd(b []byte) error {
+	if len(b) != 0 {
+		return errBadEncoding
+	}
+	return nil
+}
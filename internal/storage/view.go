@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"iter"
+	"slices"
+	"time"
+)
+
+// A View is a point-in-time view of a storage. Taking a view is cheap:
+// instead of copying the data, writes save the previous state of the keys
+// they change for as long as the view is open.
+type View interface {
+	// All yields the entries that were live when the view was taken, in
+	// no particular order. It reads the storage a chunk at a time, so
+	// writes are not held up while the entries are consumed. The values
+	// are shared with the storage and must not be modified. All may be
+	// called again, e.g. to retry a save, but not concurrently.
+	All() iter.Seq2[string, Entry]
+	// Close releases the state saved for the view.
+	Close()
+}
+
+// viewChunk is the number of keys All reads under one lock.
+const viewChunk = 1024
+
+// memoryView is a View of a MemoryStorage. Keys written since the view
+// was taken keep their previous state in saved. All walks the live keys
+// in order, skipping the saved ones, and then yields the saved ones.
+type memoryView struct {
+	s   *MemoryStorage
+	now time.Time
+
+	// The fields below are guarded by s.mu: they change under the write
+	// lock, or under the read lock while no writer can run.
+	saved map[string]savedState
+	// pass counts the calls to All, and cursor is the last key the
+	// current one has read, if read is set. A key written after the
+	// current pass has read it was already yielded, which visited records.
+	pass   int
+	cursor string
+	read   bool
+	ended  bool
+}
+
+type savedState struct {
+	entry Entry
+	// live is false if the key did not exist when the view was taken.
+	live bool
+	// visited is the pass that had read the key before it was saved.
+	visited int
+}
+
+// View takes a point-in-time view of the storage in constant time.
+func (s *MemoryStorage) View() View {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.view()
+}
+
+func (s *MemoryStorage) view() *memoryView {
+	v := &memoryView{
+		s:     s,
+		now:   s.now(),
+		saved: make(map[string]savedState),
+	}
+	s.views = append(s.views, v)
+	return v
+}
+
+// preserve saves the state of key for the open views before it changes.
+// The caller must hold the write lock.
+func (s *MemoryStorage) preserve(key string) {
+	for _, v := range s.views {
+		if _, ok := v.saved[key]; ok {
+			continue
+		}
+		state := savedState{}
+		if v.ended || v.read && key <= v.cursor {
+			state.visited = v.pass
+		}
+		if e, ok := s.data[key]; ok && !e.expired(v.now) {
+			state.entry = e.export()
+			state.live = true
+		}
+		v.saved[key] = state
+	}
+}
+
+func (v *memoryView) All() iter.Seq2[string, Entry] {
+	return func(yield func(string, Entry) bool) {
+		v.s.mu.Lock()
+		v.pass++
+		v.cursor, v.read, v.ended = "", false, false
+		pass := v.pass
+		v.s.mu.Unlock()
+
+		for start, more := "", true; more; {
+			var chunk []viewItem
+			chunk, start, more = v.readChunk(start)
+			for _, item := range chunk {
+				if !yield(item.key, item.entry) {
+					return
+				}
+			}
+		}
+
+		// Keys saved from now on were read by this pass.
+		v.s.mu.Lock()
+		v.ended = true
+		var saved []viewItem
+		for key, state := range v.saved {
+			if state.live && state.visited != pass {
+				saved = append(saved, viewItem{key, state.entry})
+			}
+		}
+		v.s.mu.Unlock()
+		for _, item := range saved {
+			if !yield(item.key, item.entry) {
+				return
+			}
+		}
+	}
+}
+
+func (v *memoryView) Close() {
+	s := v.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.views = slices.DeleteFunc(s.views, func(open *memoryView) bool { return open == v })
+	v.saved = nil
+}
+
+// collectView copies the entries of v into a map and closes v.
+func collectView(v View) map[string]Entry {
+	defer v.Close()
+	res := make(map[string]Entry)
+	for key, entry := range v.All() {
+		entry.Value = copyBytes(entry.Value)
+		res[key] = entry
+	}
+	return res
+}
+
+type viewItem struct {
+	key   string
+	entry Entry
+}
+
+// readChunk reads up to viewChunk unsaved keys from start on, returning
+// where the next chunk starts and whether there is one.
+func (v *memoryView) readChunk(start string) ([]viewItem, string, bool) {
+	s := v.s
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var chunk []viewItem
+	n := s.index.seek(start)
+	for read := 0; n != nil && read < viewChunk; n, read = n.next[0], read+1 {
+		v.cursor, v.read = n.key, true
+		if _, ok := v.saved[n.key]; ok {
+			continue
+		}
+		if e := s.data[n.key]; !e.expired(v.now) {
+			chunk = append(chunk, viewItem{n.key, e.export()})
+		}
+	}
+	if n == nil {
+		return chunk, "", false
+	}
+	return chunk, n.key, true
+}
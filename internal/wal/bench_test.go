@@ -0,0 +1,59 @@
+package wal
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// BenchmarkStorageWrites measures parallel Set calls of uniformly chosen
+// keys through Storage, whose log is written by all of them, over both
+// backends and fsync policies. Run with -cpu 1,4,16 to see how they scale.
+func BenchmarkStorageWrites(b *testing.B) {
+	backends := []struct {
+		name string
+		new  func() Backend
+	}{
+		{"memory", func() Backend { return storage.NewMemoryStorage(nil) }},
+		{"sharded-16", func() Backend { return storage.NewShardedStorage(16, nil) }},
+	}
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"everysec", SyncEverySecond},
+		{"always", SyncAlways},
+	}
+	for _, p := range policies {
+		for _, backend := range backends {
+			b.Run(fmt.Sprintf("fsync=%s/%s", p.name, backend.name), func(b *testing.B) {
+				l, err := Open(filepath.Join(b.TempDir(), "kv.wal"), p.policy)
+				if err != nil {
+					b.Fatalf("open wal error: %v", err)
+				}
+				defer l.Close()
+				benchmarkWrites(b, NewStorage(backend.new(), l))
+			})
+		}
+	}
+}
+
+func benchmarkWrites(b *testing.B, store *Storage) {
+	const keyCount = 1 << 16
+	value := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+		for pb.Next() {
+			if err := store.Set("key:"+strconv.Itoa(rnd.IntN(keyCount)), value); err != nil {
+				b.Errorf("unexpected error: %v", err)
+				return
+			}
+		}
+	})
+}
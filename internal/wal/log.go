@@ -0,0 +1,281 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log before every write is acknowledged.
+	SyncAlways SyncPolicy = iota
+	// SyncEverySecond fsyncs the log once per second in the background.
+	SyncEverySecond
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "", "everysec":
+		return SyncEverySecond, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+// headerSize is the size of the record header: CRC32 of the payload
+// followed by the payload length.
+const headerSize = 8
+
+// Log is an append-only file of storage mutations.
+//
+// Offsets returned by Size and accepted by TruncateBefore are logical: they
+// keep growing across truncations, so a stale offset is never applied to
+// the wrong position of a rewritten file.
+type Log struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	policy SyncPolicy
+	// base is the logical offset of the first byte of the file.
+	base int64
+	size int64
+	// unsynced reports whether there are writes not yet fsynced.
+	unsynced bool
+	// synced is the logical offset up to which the log is fsynced.
+	synced int64
+	// failed is set if part of a record was written and could not be cut
+	// off again. Appends are refused from then on, as replay stops at the
+	// torn record and would drop everything after it.
+	failed error
+	// syncMu is held by the fsyncs of Sync and SyncAlways appends, which
+	// run outside mu so that other appends can be written meanwhile, and
+	// by everything that replaces or closes the file.
+	syncMu sync.Mutex
+}
+
+func Open(path string, policy SyncPolicy) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Log{
+		path:   path,
+		file:   file,
+		policy: policy,
+		size:   info.Size(),
+		synced: info.Size(),
+	}, nil
+}
+
+func (l *Log) append(rec record) error {
+	payload := rec.encode()
+	buf := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	l.mu.Lock()
+	if l.failed != nil {
+		l.mu.Unlock()
+		return l.failed
+	}
+	n, err := l.file.Write(buf)
+	if err != nil {
+		if n > 0 {
+			l.cutTorn()
+		}
+		l.mu.Unlock()
+		return err
+	}
+	l.size += int64(n)
+	l.unsynced = true
+	end := l.base + l.size
+	l.mu.Unlock()
+
+	if l.policy == SyncAlways {
+		return l.syncTo(end)
+	}
+	return nil
+}
+
+// cutTorn removes the part of a record left by a failed write. The file is
+// in append mode, so the next write lands right after the cut.
+func (l *Log) cutTorn() {
+	if err := l.file.Truncate(l.size); err != nil {
+		l.failed = fmt.Errorf("wal: cannot remove torn record: %w", err)
+	}
+}
+
+// syncTo fsyncs the log up to the logical offset end, unless an fsync
+// started after end was written has covered it already. Appends waiting
+// for each other thus share a single fsync.
+func (l *Log) syncTo(end int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	l.mu.Lock()
+	if l.synced >= end {
+		l.mu.Unlock()
+		return nil
+	}
+	file, target := l.file, l.base+l.size
+	l.mu.Unlock()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.synced = max(l.synced, target)
+	if l.synced == l.base+l.size {
+		l.unsynced = false
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Size returns the logical offset of the end of the log.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.base + l.size
+}
+
+// Sync fsyncs everything appended so far. Like the fsync of SyncAlways
+// appends, it runs outside mu, so appends are not held up meanwhile.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	end := l.base + l.size
+	l.mu.Unlock()
+	return l.syncTo(end)
+}
+
+func (l *Log) sync() error {
+	if !l.unsynced {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = false
+	l.synced = l.base + l.size
+	return nil
+}
+
+// Run fsyncs the log every second when the policy is SyncEverySecond.
+// It returns when ctx is done.
+func (l *Log) Run(ctx context.Context) {
+	if l.policy != SyncEverySecond {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Printf("wal fsync error: %v", err)
+			}
+		}
+	}
+}
+
+// TruncateBefore drops the part of the log before offset, typically
+// because everything up to it is already covered by a saved snapshot.
+// Records written after offset are kept.
+func (l *Log) TruncateBefore(offset int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset <= l.base {
+		return nil
+	}
+	skip := offset - l.base
+	if skip > l.size {
+		return fmt.Errorf("truncate offset %d beyond end of log %d", offset, l.base+l.size)
+	}
+
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmp, io.NewSectionReader(l.file, skip, l.size-skip))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.base = offset
+	l.size -= skip
+	l.unsynced = false
+	l.synced = l.base + l.size
+	// The new file holds whole records only.
+	l.failed = nil
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
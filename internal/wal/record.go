@@ -0,0 +1,266 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+type op byte
+
+const (
+	opSet op = iota + 1
+	opDelete
+	// opExpire changes the expiry of a key; a zero time removes it.
+	opExpire
+	// opBatch groups records that are applied atomically, so that a torn
+	// write never replays part of a multi-key command.
+	opBatch
+	// opSetTyped is an opSet of a value other than a string, followed by
+	// its kind.
+	opSetTyped
+)
+
+var errCorrupt = errors.New("corrupt wal record")
+
+// maxRecordSize guards replay against allocating huge buffers for a
+// corrupted length field.
+const maxRecordSize = 1 << 30
+
+// record describes a single mutation. Expiry is stored as an absolute
+// time so that replaying the log later does not extend the key's life.
+type record struct {
+	op       op
+	key      string
+	value    []byte
+	expireAt time.Time
+	kind     storage.Kind
+	// batch holds the records of an opBatch record.
+	batch []record
+}
+
+func (r record) encode() []byte {
+	if r.op == opBatch {
+		buf := []byte{byte(r.op)}
+		buf = binary.AppendUvarint(buf, uint64(len(r.batch)))
+		for _, rec := range r.batch {
+			payload := rec.encode()
+			buf = binary.AppendUvarint(buf, uint64(len(payload)))
+			buf = append(buf, payload...)
+		}
+		return buf
+	}
+	buf := make([]byte, 0, 2+3*binary.MaxVarintLen64+len(r.key)+len(r.value))
+	if r.op == opSet && r.kind != storage.KindString {
+		buf = append(buf, byte(opSetTyped))
+	} else {
+		buf = append(buf, byte(r.op))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(r.key)))
+	buf = append(buf, r.key...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.value)))
+	buf = append(buf, r.value...)
+	var expireAt int64
+	if !r.expireAt.IsZero() {
+		expireAt = r.expireAt.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, expireAt)
+	if r.op == opSet && r.kind != storage.KindString {
+		buf = append(buf, byte(r.kind))
+	}
+	return buf
+}
+
+func decodeRecord(buf []byte) (record, error) {
+	if len(buf) == 0 {
+		return record{}, errCorrupt
+	}
+	rec := record{op: op(buf[0])}
+	buf = buf[1:]
+	if rec.op == opBatch {
+		return decodeBatch(buf)
+	}
+
+	key, buf, err := readBytes(buf)
+	if err != nil {
+		return record{}, err
+	}
+	rec.key = string(key)
+
+	rec.value, buf, err = readBytes(buf)
+	if err != nil {
+		return record{}, err
+	}
+
+	expireAt, n := binary.Varint(buf)
+	if n <= 0 {
+		return record{}, errCorrupt
+	}
+	buf = buf[n:]
+	if rec.op == opSetTyped {
+		if len(buf) == 0 {
+			return record{}, errCorrupt
+		}
+		rec.op, rec.kind = opSet, storage.Kind(buf[0])
+		buf = buf[1:]
+	}
+	if len(buf) != 0 {
+		return record{}, errCorrupt
+	}
+	if expireAt != 0 {
+		rec.expireAt = time.Unix(0, expireAt)
+	}
+	return rec, nil
+}
+
+func decodeBatch(buf []byte) (record, error) {
+	n, size := binary.Uvarint(buf)
+	// Every record takes at least two bytes, which bounds n before
+	// allocating.
+	if size <= 0 || n > uint64(len(buf)) {
+		return record{}, errCorrupt
+	}
+	buf = buf[size:]
+	rec := record{op: opBatch, batch: make([]record, 0, n)}
+	for range n {
+		var payload []byte
+		var err error
+		payload, buf, err = readBytes(buf)
+		if err != nil {
+			return record{}, err
+		}
+		sub, err := decodeRecord(payload)
+		if err != nil {
+			return record{}, err
+		}
+		if sub.op == opBatch {
+			return record{}, errCorrupt
+		}
+		rec.batch = append(rec.batch, sub)
+	}
+	if len(buf) != 0 {
+		return record{}, errCorrupt
+	}
+	return rec, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, errCorrupt
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], nil
+}
+
+func (r record) entry() storage.Entry {
+	return storage.Entry{Value: r.value, ExpireAt: r.expireAt, Kind: r.kind}
+}
+
+func (r record) apply(store storage.Storage) error {
+	switch r.op {
+	case opSet:
+		if r.kind != storage.KindString {
+			return store.SetMulti([]string{r.key}, []storage.Entry{r.entry()})
+		}
+		if r.expireAt.IsZero() {
+			return store.Set(r.key, r.value)
+		}
+		return store.SetWithExpiry(r.key, r.value, r.expireAt)
+	case opDelete:
+		return store.Delete(r.key)
+	case opExpire:
+		if r.expireAt.IsZero() {
+			_, err := store.Persist(r.key)
+			return err
+		}
+		_, err := store.ExpireAt(r.key, r.expireAt)
+		return err
+	case opBatch:
+		for _, rec := range r.batch {
+			if err := rec.apply(store); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown op %d", errCorrupt, r.op)
+	}
+}
+
+// Replay applies every record of the log at path to store. A missing log
+// is not an error. A torn or corrupted tail, as left by a crash in the
+// middle of a write, is logged and cut off so that new records are
+// appended right after the last valid one.
+func Replay(path string, store storage.Storage) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	var count int
+	header := make([]byte, headerSize)
+	for {
+		rec, size, err := readRecord(reader, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("wal: %v at offset %d, truncating", err, offset)
+			if err := file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if err := rec.apply(store); err != nil {
+			return err
+		}
+		offset += size
+		count++
+	}
+	log.Printf("wal: replayed %d records", count)
+	return nil
+}
+
+func readRecord(reader io.Reader, header []byte) (record, int64, error) {
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return record{}, 0, errCorrupt
+		}
+		return record{}, 0, err
+	}
+	sum := binary.BigEndian.Uint32(header[0:4])
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return record{}, 0, errCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return record{}, 0, errCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return record{}, 0, errCorrupt
+	}
+	rec, err := decodeRecord(payload)
+	if err != nil {
+		return record{}, 0, err
+	}
+	return rec, int64(headerSize) + int64(length), nil
+}
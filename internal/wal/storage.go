@@ -0,0 +1,563 @@
+package wal
+
+import (
+	"errors"
+	"hash/maphash"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+// Backend is the storage whose mutations are logged.
+type Backend interface {
+	storage.Storage
+	View() storage.View
+	TakeDelta() storage.Delta
+	MarkDirty(delta storage.Delta)
+	ResetDirty()
+	Replace(data map[string]storage.Entry)
+	SetMemoryLimit(maxBytes int64, policy storage.EvictionPolicy)
+}
+
+// keyLocks is the number of locks the keys are spread over.
+const keyLocks = 256
+
+// errExclusive tells a write made alongside others that it has to evict
+// keys, and is retried with the other writers kept out.
+var errExclusive = errors.New("wal: write needs exclusive access")
+
+// Storage logs every mutation before applying it to the backend, so that
+// an acknowledged write survives a crash. Reads go straight to the backend.
+//
+// Writes of different keys are logged and applied concurrently, and
+// appends waiting for an fsync share it. A write that evicts keys is
+// retried with the other writers kept out, calling the function passed to
+// Update or UpdateKind again.
+type Storage struct {
+	// mu is held shared by the writes of given keys and exclusively by
+	// those that may change any key: transactions, evictions and
+	// replacements, as well as checkpoints, which must see every logged
+	// write applied.
+	mu sync.RWMutex
+	// keys orders the writes of each key, so that the log and the backend
+	// see them in the same order. A shared writer holds the locks of its
+	// keys from the checks it makes until the write is applied.
+	keys [keyLocks]sync.Mutex
+	seed maphash.Seed
+	// limited is set while the backend has a memory limit. All writes then
+	// hold mu exclusively, as the backend may evict keys to apply them,
+	// which only a write planned alone can log beforehand.
+	limited atomic.Bool
+	backend Backend
+	log     *Log
+}
+
+func NewStorage(backend Backend, log *Log) *Storage {
+	return &Storage{
+		seed:    maphash.MakeSeed(),
+		backend: backend,
+		log:     log,
+	}
+}
+
+func (s *Storage) Set(key string, value []byte) error {
+	return s.write([]string{key}, func(w writer) error {
+		return w.Set(key, value)
+	})
+}
+
+func (s *Storage) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	return s.write([]string{key}, func(w writer) error {
+		return w.SetWithExpiry(key, value, expireAt)
+	})
+}
+
+func (s *Storage) Get(key string) ([]byte, error) {
+	return s.backend.Get(key)
+}
+
+func (s *Storage) Delete(key string) error {
+	return s.write([]string{key}, func(w writer) error {
+		return w.Delete(key)
+	})
+}
+
+func (s *Storage) GetEntry(key string) (storage.Entry, bool, error) {
+	return s.backend.GetEntry(key)
+}
+
+func (s *Storage) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	var ok bool
+	err := s.write([]string{key}, func(w writer) error {
+		var err error
+		ok, err = w.ExpireAt(key, expireAt)
+		return err
+	})
+	return ok, err
+}
+
+func (s *Storage) Persist(key string) (bool, error) {
+	var ok bool
+	err := s.write([]string{key}, func(w writer) error {
+		var err error
+		ok, err = w.Persist(key)
+		return err
+	})
+	return ok, err
+}
+
+func (s *Storage) ExpireTime(key string) (time.Time, bool, error) {
+	return s.backend.ExpireTime(key)
+}
+
+func (s *Storage) Keys(prefix string) ([]string, error) {
+	return s.backend.Keys(prefix)
+}
+
+func (s *Storage) Scan(start, end string, limit int) ([]storage.KeyValue, error) {
+	return s.backend.Scan(start, end, limit)
+}
+
+func (s *Storage) ScanPrefix(prefix string, limit int) ([]storage.KeyValue, error) {
+	return s.backend.ScanPrefix(prefix, limit)
+}
+
+func (s *Storage) GetMulti(keys []string) ([][]byte, error) {
+	return s.backend.GetMulti(keys)
+}
+
+func (s *Storage) SetMulti(keys []string, entries []storage.Entry) error {
+	return s.write(keys, func(w writer) error {
+		return w.SetMulti(keys, entries)
+	})
+}
+
+func (s *Storage) DeleteMulti(keys []string) (int, error) {
+	var deleted int
+	err := s.write(keys, func(w writer) error {
+		var err error
+		deleted, err = w.DeleteMulti(keys)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *Storage) GetVersion(key string) ([]byte, uint64, error) {
+	return s.backend.GetVersion(key)
+}
+
+func (s *Storage) SetIf(key string, value []byte, expireAt time.Time, cond storage.Condition) (storage.SetResult, error) {
+	var res storage.SetResult
+	err := s.write([]string{key}, func(w writer) error {
+		var err error
+		res, err = w.SetIf(key, value, expireAt, cond)
+		return err
+	})
+	return res, err
+}
+
+func (s *Storage) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	var value []byte
+	err := s.write([]string{key}, func(w writer) error {
+		var err error
+		value, err = w.Update(key, fn)
+		return err
+	})
+	return value, err
+}
+
+func (s *Storage) UpdateKind(key string, kind storage.Kind, fn func(old []byte) ([]byte, error)) error {
+	return s.write([]string{key}, func(w writer) error {
+		return w.UpdateKind(key, kind, fn)
+	})
+}
+
+// Atomic runs fn while holding the backend. The records of the writes fn
+// makes are collected and logged as a single batch when fn returns, so
+// that a crash never replays part of them. If the batch cannot be logged,
+// the keys it touches are put back the way they were.
+func (s *Storage) Atomic(fn func(tx storage.Storage) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend.Atomic(func(backend storage.Storage) error {
+		tx := &txLog{store: backend, saved: make(map[string]savedEntry)}
+		err := fn(writer{store: backend, log: tx.add})
+		if len(tx.records) == 0 {
+			return err
+		}
+		if logErr := s.log.append(record{op: opBatch, batch: tx.records}); logErr != nil {
+			return errors.Join(logErr, tx.rollback())
+		}
+		return err
+	})
+}
+
+// write runs fn alongside the writes of other keys, holding the locks of
+// keys, or alone if the backend has a memory limit or fn has to evict
+// keys.
+func (s *Storage) write(keys []string, fn func(w writer) error) error {
+	if !s.limited.Load() {
+		s.mu.RLock()
+		unlock := s.lockKeys(keys)
+		err := fn(writer{store: s.backend, log: s.log.append, shared: true})
+		unlock()
+		s.mu.RUnlock()
+		if !errors.Is(err, errExclusive) {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(writer{store: s.backend, log: s.log.append})
+}
+
+// lockKeys locks the locks of keys in index order, so that writes of
+// several keys cannot deadlock, and returns a function that unlocks them.
+func (s *Storage) lockKeys(keys []string) func() {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = int(maphash.String(s.seed, key) % keyLocks)
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		s.keys[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			s.keys[i].Unlock()
+		}
+	}
+}
+
+// SetMemoryLimit sets the memory limit of the backend. While there is one,
+// writes are logged and applied one at a time.
+func (s *Storage) SetMemoryLimit(maxBytes int64, policy storage.EvictionPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backend.SetMemoryLimit(maxBytes, policy)
+	s.limited.Store(maxBytes > 0)
+}
+
+// CheckpointView returns a view of the backend for a full snapshot
+// together with the log offset it corresponds to. Once the snapshot is
+// saved, the log can be truncated up to that offset. Tracked changes are
+// reset, since the full snapshot covers them. The view is taken in
+// constant time and read while writes go on; it must be closed once
+// saved.
+func (s *Storage) CheckpointView() (storage.View, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backend.ResetDirty()
+	return s.backend.View(), s.log.Size()
+}
+
+// CheckpointDelta is like CheckpointView but returns only the changes made
+// since the previous checkpoint. If the delta cannot be saved, it must be
+// handed back with MarkDirty.
+func (s *Storage) CheckpointDelta() (storage.Delta, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend.TakeDelta(), s.log.Size()
+}
+
+func (s *Storage) MarkDirty(delta storage.Delta) {
+	s.backend.MarkDirty(delta)
+}
+
+// Replace swaps the contents of the backend for data, e.g. when a
+// previous snapshot is restored. The replacement is not logged: it is
+// durable only once the full snapshot that must follow it is saved.
+func (s *Storage) Replace(data map[string]storage.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backend.Replace(data)
+}
+
+// writer passes the record of every mutation to log before applying the
+// mutation to store. The caller must keep other writers of the same keys
+// out, so that the checks made by SetIf and Update still hold when the
+// write is applied: only expiry can change a key in between, and the
+// write then goes ahead as if it happened right at the check.
+type writer struct {
+	store storage.Storage
+	log   func(rec record) error
+	// shared is set if writers of other keys run alongside, which keeps
+	// the writer from evicting keys.
+	shared bool
+}
+
+func (w writer) Set(key string, value []byte) error {
+	if err := w.makeRoom([]string{key}, [][]byte{value}); err != nil {
+		return err
+	}
+	if err := w.log(record{op: opSet, key: key, value: value}); err != nil {
+		return err
+	}
+	return w.store.Set(key, value)
+}
+
+func (w writer) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	if err := w.makeRoom([]string{key}, [][]byte{value}); err != nil {
+		return err
+	}
+	if err := w.log(record{op: opSet, key: key, value: value, expireAt: expireAt}); err != nil {
+		return err
+	}
+	return w.store.SetWithExpiry(key, value, expireAt)
+}
+
+func (w writer) Get(key string) ([]byte, error) {
+	return w.store.Get(key)
+}
+
+func (w writer) Delete(key string) error {
+	if err := w.log(record{op: opDelete, key: key}); err != nil {
+		return err
+	}
+	return w.store.Delete(key)
+}
+
+func (w writer) GetEntry(key string) (storage.Entry, bool, error) {
+	return w.store.GetEntry(key)
+}
+
+func (w writer) ExpireAt(key string, expireAt time.Time) (bool, error) {
+	if err := w.log(record{op: opExpire, key: key, expireAt: expireAt}); err != nil {
+		return false, err
+	}
+	return w.store.ExpireAt(key, expireAt)
+}
+
+func (w writer) Persist(key string) (bool, error) {
+	if err := w.log(record{op: opExpire, key: key}); err != nil {
+		return false, err
+	}
+	return w.store.Persist(key)
+}
+
+func (w writer) ExpireTime(key string) (time.Time, bool, error) {
+	return w.store.ExpireTime(key)
+}
+
+func (w writer) Keys(prefix string) ([]string, error) {
+	return w.store.Keys(prefix)
+}
+
+func (w writer) Scan(start, end string, limit int) ([]storage.KeyValue, error) {
+	return w.store.Scan(start, end, limit)
+}
+
+func (w writer) ScanPrefix(prefix string, limit int) ([]storage.KeyValue, error) {
+	return w.store.ScanPrefix(prefix, limit)
+}
+
+func (w writer) GetMulti(keys []string) ([][]byte, error) {
+	return w.store.GetMulti(keys)
+}
+
+func (w writer) SetMulti(keys []string, entries []storage.Entry) error {
+	if len(keys) != len(entries) {
+		return errors.New("wal: keys and entries differ in length")
+	}
+	values := make([][]byte, len(entries))
+	batch := make([]record, len(keys))
+	for i, key := range keys {
+		values[i] = entries[i].Value
+		batch[i] = record{op: opSet, key: key, value: entries[i].Value, expireAt: entries[i].ExpireAt, kind: entries[i].Kind}
+	}
+	if err := w.makeRoom(keys, values); err != nil {
+		return err
+	}
+	if err := w.log(record{op: opBatch, batch: batch}); err != nil {
+		return err
+	}
+	return w.store.SetMulti(keys, entries)
+}
+
+func (w writer) DeleteMulti(keys []string) (int, error) {
+	batch := make([]record, len(keys))
+	for i, key := range keys {
+		batch[i] = record{op: opDelete, key: key}
+	}
+	if err := w.log(record{op: opBatch, batch: batch}); err != nil {
+		return 0, err
+	}
+	return w.store.DeleteMulti(keys)
+}
+
+func (w writer) GetVersion(key string) ([]byte, uint64, error) {
+	return w.store.GetVersion(key)
+}
+
+// SetIf checks the condition before logging, so that only writes that
+// take place are logged.
+func (w writer) SetIf(key string, value []byte, expireAt time.Time, cond storage.Condition) (storage.SetResult, error) {
+	if cond.Kind != storage.Always {
+		_, version, err := w.store.GetVersion(key)
+		if err != nil {
+			return storage.SetResult{}, err
+		}
+		if !cond.Holds(version) {
+			return storage.SetResult{Version: version}, nil
+		}
+	}
+	if err := w.makeRoom([]string{key}, [][]byte{value}); err != nil {
+		return storage.SetResult{}, err
+	}
+	if err := w.log(record{op: opSet, key: key, value: value, expireAt: expireAt}); err != nil {
+		return storage.SetResult{}, err
+	}
+	return w.store.SetIf(key, value, expireAt, storage.Condition{})
+}
+
+// Update logs the new value together with the expiry it keeps.
+func (w writer) Update(key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	expireAt, ok, err := w.store.ExpireTime(key)
+	if err != nil {
+		return nil, err
+	}
+	var old []byte
+	if ok {
+		if old, err = w.store.Get(key); err != nil {
+			return nil, err
+		}
+	}
+	if old == nil {
+		// The key is missing or expired right after the first read.
+		expireAt = time.Time{}
+	}
+	value, err := fn(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.makeRoom([]string{key}, [][]byte{value}); err != nil {
+		return nil, err
+	}
+	if err := w.log(record{op: opSet, key: key, value: value, expireAt: expireAt}); err != nil {
+		return nil, err
+	}
+	if expireAt.IsZero() {
+		err = w.store.Set(key, value)
+	} else {
+		err = w.store.SetWithExpiry(key, value, expireAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// UpdateKind logs the new value together with its kind and the expiry it
+// keeps, or the deletion of the key.
+func (w writer) UpdateKind(key string, kind storage.Kind, fn func(old []byte) ([]byte, error)) error {
+	entry, ok, err := w.store.GetEntry(key)
+	if err != nil {
+		return err
+	}
+	if ok && entry.Kind != kind {
+		return storage.ErrWrongType
+	}
+	value, err := fn(entry.Value)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if !ok {
+			return nil
+		}
+		return w.Delete(key)
+	}
+	if err := w.makeRoom([]string{key}, [][]byte{value}); err != nil {
+		return err
+	}
+	entry.Value, entry.Kind = value, kind
+	if err := w.log(record{op: opSet, key: key, value: value, expireAt: entry.ExpireAt, kind: kind}); err != nil {
+		return err
+	}
+	return w.store.SetMulti([]string{key}, []storage.Entry{entry})
+}
+
+// makeRoom logs and applies the evictions needed to store values under
+// keys. If the store is out of memory, nothing is logged, so that the log
+// never holds a write the store refused.
+func (w writer) makeRoom(keys []string, values [][]byte) error {
+	evictor, ok := w.store.(storage.Evictor)
+	if !ok {
+		return nil
+	}
+	victims, err := evictor.PlanEviction(keys, values)
+	if err != nil || len(victims) == 0 {
+		return err
+	}
+	if w.shared {
+		return errExclusive
+	}
+	batch := make([]record, len(victims))
+	for i, key := range victims {
+		batch[i] = record{op: opDelete, key: key}
+	}
+	if err := w.log(record{op: opBatch, batch: batch}); err != nil {
+		return err
+	}
+	evictor.Evict(victims)
+	return nil
+}
+
+// Atomic runs fn right away, as the writer is already exclusive.
+func (w writer) Atomic(fn func(tx storage.Storage) error) error {
+	return fn(w)
+}
+
+// txLog collects the records of a transaction, remembering the state of
+// every key before its first write so that the writes can be undone.
+type txLog struct {
+	store   storage.Storage
+	records []record
+	saved   map[string]savedEntry
+	order   []string
+}
+
+type savedEntry struct {
+	entry storage.Entry
+	ok    bool
+}
+
+func (t *txLog) add(rec record) error {
+	if rec.op == opBatch {
+		for _, sub := range rec.batch {
+			if err := t.add(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if _, ok := t.saved[rec.key]; !ok {
+		entry, ok, err := t.store.GetEntry(rec.key)
+		if err != nil {
+			return err
+		}
+		t.saved[rec.key] = savedEntry{entry: entry, ok: ok}
+		t.order = append(t.order, rec.key)
+	}
+	t.records = append(t.records, rec)
+	return nil
+}
+
+func (t *txLog) rollback() error {
+	var errs []error
+	for _, key := range t.order {
+		saved := t.saved[key]
+		var err error
+		if saved.ok {
+			err = t.store.SetMulti([]string{key}, []storage.Entry{saved.entry})
+		} else {
+			err = t.store.Delete(key)
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,438 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aptolon/kv-store/internal/storage"
+)
+
+func newTestLog(t *testing.T) (*Log, string) {
+	path := filepath.Join(t.TempDir(), "kv.wal")
+	l, err := Open(path, SyncAlways)
+	if err != nil {
+		t.Fatalf("open wal error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func replayed(t *testing.T, path string) *storage.MemoryStorage {
+	store := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	if err := Replay(path, store); err != nil {
+		t.Fatalf("replay error: %v", err)
+	}
+	return store
+}
+
+func TestReplayRestoresMutations(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	steps := []func() error{
+		func() error { return store.Set("a", []byte("1")) },
+		func() error { return store.Set("b", []byte("2")) },
+		func() error { return store.Set("a", []byte("3")) },
+		func() error { return store.Delete("b") },
+		func() error { return store.SetWithExpiry("c", []byte("4"), expireAt) },
+		func() error { return store.Set("d", []byte("5")) },
+		func() error { _, err := store.ExpireAt("d", expireAt); return err },
+		func() error { _, err := store.Persist("d"); return err },
+		func() error { return store.SetWithExpiry("e", []byte("6"), time.Now().Add(-time.Second)) },
+		func() error {
+			return store.SetMulti([]string{"f", "g", "h"},
+				[]storage.Entry{{Value: []byte("7")}, {Value: []byte("8"), ExpireAt: expireAt}, {Value: []byte("9")}})
+		},
+		func() error { _, err := store.DeleteMulti([]string{"h", "missing"}); return err },
+		func() error {
+			_, err := store.SetIf("f", []byte("10"), time.Time{}, storage.Condition{Kind: storage.IfAbsent})
+			return err
+		},
+		func() error {
+			_, err := store.SetIf("i", []byte("11"), time.Time{}, storage.Condition{Kind: storage.IfAbsent})
+			return err
+		},
+		func() error {
+			_, err := store.Update("g", func(old []byte) ([]byte, error) { return append(old, '0'), nil })
+			return err
+		},
+		func() error {
+			_, err := store.Update("j", func([]byte) ([]byte, error) { return []byte("12"), nil })
+			return err
+		},
+		func() error {
+			return store.SetMulti([]string{"k"},
+				[]storage.Entry{{Value: storage.EncodeList([][]byte{[]byte("13")}), ExpireAt: expireAt, Kind: storage.KindList}})
+		},
+		func() error {
+			return store.UpdateKind("k", storage.KindList, func(old []byte) ([]byte, error) {
+				value, _, err := storage.PushList(old, [][]byte{[]byte("14")}, false)
+				return value, err
+			})
+		},
+		func() error {
+			return store.UpdateKind("l", storage.KindSet, func([]byte) ([]byte, error) {
+				return storage.EncodeSet(map[string]struct{}{"15": {}}), nil
+			})
+		},
+		func() error {
+			return store.UpdateKind("l", storage.KindSet, func([]byte) ([]byte, error) { return nil, nil })
+		},
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: unexpected error: %v", i, err)
+		}
+	}
+
+	got := replayed(t, path).Snapshot()
+	want := map[string]storage.Entry{
+		"a": {Value: []byte("3")},
+		"c": {Value: []byte("4"), ExpireAt: expireAt},
+		"d": {Value: []byte("5")},
+		"f": {Value: []byte("7")},
+		"g": {Value: []byte("80"), ExpireAt: expireAt},
+		"i": {Value: []byte("11")},
+		"j": {Value: []byte("12")},
+		"k": {Value: storage.EncodeList([][]byte{[]byte("13"), []byte("14")}), ExpireAt: expireAt, Kind: storage.KindList},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d keys, got %d: %v", len(want), len(got), got)
+	}
+	for k, w := range want {
+		g, ok := got[k]
+		if !ok {
+			t.Fatalf("missing key %q", k)
+		}
+		if string(g.Value) != string(w.Value) || !g.ExpireAt.Equal(w.ExpireAt) || g.Kind != w.Kind {
+			t.Fatalf("key %q: expected %v, got %v", k, w, g)
+		}
+	}
+}
+
+func TestConcurrentWritesReplayInOrder(t *testing.T) {
+	l, path := newTestLog(t)
+	backend := storage.NewShardedStorage(8, nil)
+	store := NewStorage(backend, l)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("k%d", i%10)
+				var err error
+				switch i % 4 {
+				case 0:
+					err = store.Set(key, fmt.Appendf(nil, "%d:%d", g, i))
+				case 1:
+					_, err = store.Update(key, func(old []byte) ([]byte, error) { return append(old, '+'), nil })
+				case 2:
+					err = store.SetMulti([]string{key, "shared"},
+						[]storage.Entry{{Value: []byte{byte(g)}}, {Value: []byte{byte(i)}}})
+				default:
+					_, err = store.DeleteMulti([]string{key})
+				}
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := backend.Snapshot()
+	got := replayed(t, path).Snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("expected replay to give %v, got %v", want, got)
+	}
+	for key, w := range want {
+		if g, ok := got[key]; !ok || string(g.Value) != string(w.Value) {
+			t.Fatalf("key %q: expected %q, got %q", key, w.Value, g.Value)
+		}
+	}
+}
+
+func TestReplayMissingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.wal")
+	store := replayed(t, path)
+	if len(store.Snapshot()) != 0 {
+		t.Fatalf("expected empty store")
+	}
+}
+
+func TestReplayTruncatesTornTail(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	if err := store.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	valid := l.Size()
+	if err := store.Set("b", []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	if err := os.Truncate(path, l.Size()-1); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+
+	got := replayed(t, path).Snapshot()
+	if len(got) != 1 || string(got["a"].Value) != "1" {
+		t.Fatalf("expected only key a, got %v", got)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat error: %v", err)
+	}
+	if info.Size() != valid {
+		t.Fatalf("expected log to be cut to %d bytes, got %d", valid, info.Size())
+	}
+}
+
+func TestReplayTornBatch(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	if err := store.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries := []storage.Entry{{Value: []byte("2")}, {Value: []byte("3")}}
+	if err := store.SetMulti([]string{"b", "c"}, entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	// Cut the batch right after its first record.
+	if err := os.Truncate(path, l.Size()-8); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+
+	got := replayed(t, path).Snapshot()
+	if len(got) != 1 || string(got["a"].Value) != "1" {
+		t.Fatalf("expected only key a, got %v", got)
+	}
+}
+
+func TestAtomicLogsOneBatch(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	if err := store.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	before := l.Size()
+	err := store.Atomic(func(tx storage.Storage) error {
+		if err := tx.Set("b", []byte("2")); err != nil {
+			return err
+		}
+		if _, err := tx.DeleteMulti([]string{"a"}); err != nil {
+			return err
+		}
+		_, err := tx.Update("b", func(old []byte) ([]byte, error) { return append(old, '0'), nil })
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	// Dropping the last byte must drop the whole transaction.
+	if err := os.Truncate(path, l.Size()-1); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+	got := replayed(t, path).Snapshot()
+	if len(got) != 1 || string(got["a"].Value) != "1" {
+		t.Fatalf("expected only key a, got %v", got)
+	}
+	if info, _ := os.Stat(path); info.Size() != before {
+		t.Fatalf("expected log to be cut to %d bytes, got %d", before, info.Size())
+	}
+}
+
+func TestAtomicUndoesUnloggedWrites(t *testing.T) {
+	l, _ := newTestLog(t)
+	backend := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	store := NewStorage(backend, l)
+
+	expireAt := time.Now().Add(time.Hour)
+	if err := store.SetWithExpiry("a", []byte("1"), expireAt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	set := storage.EncodeSet(map[string]struct{}{"m": {}})
+	if err := store.SetMulti([]string{"s"}, []storage.Entry{{Value: set, Kind: storage.KindSet}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	err := store.Atomic(func(tx storage.Storage) error {
+		tx.Set("a", []byte("2"))
+		tx.Persist("a")
+		tx.Set("s", []byte("4"))
+		return tx.Set("b", []byte("3"))
+	})
+	if err == nil {
+		t.Fatalf("expected an error from a closed log")
+	}
+	got := backend.Snapshot()
+	if len(got) != 2 || string(got["a"].Value) != "1" || !got["a"].ExpireAt.Equal(expireAt) ||
+		got["s"].Kind != storage.KindSet || string(got["s"].Value) != string(set) {
+		t.Fatalf("expected the transaction to be undone, got %v", got)
+	}
+}
+
+func TestEvictionsAreLogged(t *testing.T) {
+	l, path := newTestLog(t)
+	backend := storage.NewMemoryStorage(make(map[string]storage.Entry))
+	backend.SetMemoryLimit(3*(2+1+128), storage.AllKeysLRU)
+	store := NewStorage(backend, l)
+
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if err := store.Set(key, []byte("x")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	err := store.Atomic(func(tx storage.Storage) error {
+		return tx.SetMulti([]string{"k5", "k6"}, []storage.Entry{{Value: []byte("x")}, {Value: []byte("x")}})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := backend.MemoryStats(); stats.Keys != 3 || stats.Evicted != 3 {
+		t.Fatalf("expected 3 keys and 3 evictions, got %+v", stats)
+	}
+
+	want := backend.Snapshot()
+	got := replayed(t, path).Snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("expected replay to evict the same keys: want %v, got %v", want, got)
+	}
+	for key := range want {
+		if _, ok := got[key]; !ok {
+			t.Fatalf("expected key %s after replay, got %v", key, got)
+		}
+	}
+
+	store.SetMemoryLimit(1, storage.NoEviction)
+	before := l.Size()
+	if err := store.Set("k7", []byte("x")); !errors.Is(err, storage.ErrOutOfMemory) {
+		t.Fatalf("expected %v, got %v", storage.ErrOutOfMemory, err)
+	}
+	if l.Size() != before {
+		t.Fatalf("expected a refused write not to be logged")
+	}
+}
+
+func TestReplayCorruptedRecord(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	if err := store.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Set("b", []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	got := replayed(t, path).Snapshot()
+	if len(got) != 1 || string(got["a"].Value) != "1" {
+		t.Fatalf("expected only key a, got %v", got)
+	}
+}
+
+func TestTruncateBeforeKeepsNewerRecords(t *testing.T) {
+	l, path := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+
+	if err := store.Set("a", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	view, offset := store.CheckpointView()
+	view.Close()
+	if err := store.Set("b", []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := l.TruncateBefore(offset); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+	// A stale offset must not cut anything.
+	if err := l.TruncateBefore(offset); err != nil {
+		t.Fatalf("truncate error: %v", err)
+	}
+	if err := store.Set("c", []byte("3")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := replayed(t, path).Snapshot()
+	if len(got) != 2 || string(got["b"].Value) != "2" || string(got["c"].Value) != "3" {
+		t.Fatalf("expected keys b and c, got %v", got)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := map[string]SyncPolicy{
+		"":         SyncEverySecond,
+		"always":   SyncAlways,
+		"everysec": SyncEverySecond,
+		"never":    SyncNever,
+	}
+	for in, want := range tests {
+		got, err := ParseSyncPolicy(in)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("%q: expected %v, got %v", in, want, got)
+		}
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestCheckpointViewDoesNotBlockWrites(t *testing.T) {
+	l, _ := newTestLog(t)
+	store := NewStorage(storage.NewMemoryStorage(make(map[string]storage.Entry)), l)
+	store.Set("a", []byte("1"))
+
+	view, offset := store.CheckpointView()
+	defer view.Close()
+	if err := store.Set("a", []byte("2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Set("b", []byte("3")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := make(map[string]string)
+	for key, entry := range view.All() {
+		got[key] = string(entry.Value)
+	}
+	if len(got) != 1 || got["a"] != "1" {
+		t.Fatalf("expected the state at the checkpoint, got %v", got)
+	}
+	if l.Size() <= offset {
+		t.Fatalf("expected later writes after offset %d", offset)
+	}
+}